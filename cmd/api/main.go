@@ -3,10 +3,22 @@ package main
 import (
 	"context"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"projectpi-backend/internal/handlers"
+	"projectpi-backend/internal/jobs"
+	"projectpi-backend/internal/processing"
+	"projectpi-backend/internal/realtime"
 	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/signing"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/transcode"
 	"projectpi-backend/internal/utils"
 
 	"github.com/gin-contrib/cors"
@@ -44,7 +56,89 @@ func main() {
 	// Initialize services
 	userService := &services.UserService{DB: db}
 	playlistService := &services.PlaylistService{DB: db}
+	if err := playlistService.EnsureIndexes(); err != nil {
+		log.Println("Failed to create playlist indexes:", err)
+	}
 	songService := &services.SongService{DB: db}
+	imageService := &services.ImageService{DB: db}
+	fingerprintService := &services.FingerprintService{DB: db}
+	playService := &services.PlayService{DB: db}
+	// Resume positions rely on a unique index to never go backwards
+	if err := playService.EnsureIndexes(); err != nil {
+		log.Fatal("Failed to create play indexes:", err)
+	}
+	playService.Start()
+	defer playService.Close()
+	queueService := &services.QueueService{DB: db}
+	// Queues are upserted per user, which needs the unique index
+	if err := queueService.EnsureIndexes(); err != nil {
+		log.Fatal("Failed to create queue indexes:", err)
+	}
+	statsService := &services.StatsService{DB: db}
+	apiKeyService := &services.APIKeyService{DB: db}
+	if err := apiKeyService.EnsureIndexes(); err != nil {
+		log.Println("Failed to create API key indexes:", err)
+	}
+
+	// Uploaded songs, images and generated renditions all live under uploads/
+	store := &storage.Local{Root: "uploads"}
+
+	// Initialize the transcoding pipeline used by /stream
+	cacheDir := os.Getenv("TRANSCODE_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = "cache/transcodes"
+	}
+	cacheMaxMB, err := strconv.ParseInt(os.Getenv("TRANSCODE_CACHE_MAX_MB"), 10, 64)
+	if err != nil || cacheMaxMB <= 0 {
+		cacheMaxMB = 2048
+	}
+	transcodeCache, err := transcode.NewCache(cacheDir, cacheMaxMB<<20)
+	if err != nil {
+		log.Fatal("Failed to initialize transcode cache:", err)
+	}
+	ffmpeg := &transcode.FFmpeg{Binary: os.Getenv("FFMPEG_PATH")}
+	pipeline := &transcode.Pipeline{
+		Transcoder: ffmpeg,
+		Cache:      transcodeCache,
+	}
+	hls := &transcode.HLS{Packager: ffmpeg}
+
+	// Background processing of uploaded songs
+	queue := jobs.NewQueue(2, 256)
+	defer queue.Close()
+	processor := &processing.Processor{
+		Queue:        queue,
+		Store:        store,
+		Decoder:      ffmpeg,
+		Prober:       &transcode.FFprobe{Binary: os.Getenv("FFPROBE_PATH")},
+		Analyzer:     ffmpeg,
+		Songs:        songService,
+		Waveforms:    &services.WaveformService{DB: db},
+		Fingerprints: fingerprintService,
+	}
+	// Resume processing owed to songs since the last run. It has to stop
+	// before the queue is closed
+	resumeCtx, stopResume := context.WithCancel(context.Background())
+	resumed := make(chan struct{})
+	go func() {
+		defer close(resumed)
+		if err := processor.ResumePending(resumeCtx); err != nil && resumeCtx.Err() == nil {
+			log.Printf("Failed to resume pending song processing: %v", err)
+		}
+	}()
+	defer func() {
+		stopResume()
+		<-resumed
+	}()
+
+	// Signed stream URLs let clients that can't send an Authorization
+	// header (e.g. <audio src>) stream songs. The key they are signed with
+	// must be the same across restarts and replicas
+	streamKey := []byte(os.Getenv("STREAM_URL_SECRET"))
+	if len(streamKey) == 0 {
+		log.Fatal("STREAM_URL_SECRET environment variable is not set")
+	}
+	signer := &signing.Signer{Key: streamKey}
 
 	// Initialize handlers
 	authHandler := &handlers.AuthHandler{UserService: userService}
@@ -52,8 +146,22 @@ func main() {
 	// Setup Gin
 	r := gin.Default()
 
-	// Set trusted proxies - important for deployment behind proxies/load balancers
-	r.SetTrustedProxies(nil) // trust all proxies
+	// Set trusted proxies - important for deployment behind proxies/load balancers.
+	// Only their X-Forwarded-* headers are believed; with none set, no proxy is.
+	var trustedProxies []string
+	for _, proxy := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			trustedProxies = append(trustedProxies, proxy)
+		}
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	forwardedHeaders, err := handlers.TrustForwardedHeaders(trustedProxies)
+	if err != nil {
+		log.Fatal("Invalid TRUSTED_PROXIES:", err)
+	}
+	r.Use(forwardedHeaders)
 
 	// Set max multipart memory for file uploads (default is 32 MiB, increase for larger audio files)
 	r.MaxMultipartMemory = 64 << 20 // 64 MiB (adjust based on your needs)
@@ -63,17 +171,49 @@ func main() {
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"https://project-pi-frontend.vercel.app"} // Your frontend URL
 	config.AllowOrigins = []string{"https://spotipi.vercel.app"}             // Your frontend URL
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"Origin", "Content-Type", "Accept", "Authorization"}
+	config.ExposeHeaders = []string{"ETag", "Last-Modified", "Content-Range", "Accept-Ranges", "Content-Disposition", "X-Skipped-Tracks"}
 	config.AllowCredentials = true
 	r.Use(cors.New(config))
 
+	// Pushes play queue changes to every connected device of a user
+	hub := realtime.NewHub(config.AllowOrigins)
+
 	// Routes
 	r.GET("/health", func(c *gin.Context) {
 		c.String(200, "Healthy, Running!")
 	})
 	r.POST("/signup", authHandler.Signup)
 	r.POST("/signin", authHandler.Signin)
+	r.GET("/stream/:id/signed", handlers.CacheControl(handlers.CacheNoStore), func(c *gin.Context) {
+		handlers.SignedStreamHandler(c, songService, playlistService, store, pipeline, signer)
+	})
+	r.GET("/shared/:token", handlers.CacheControl(handlers.CacheNoStore), func(c *gin.Context) {
+		handlers.SharedPlaylistHandler(c, playlistService, signer)
+	})
+
+	// Scrobbling APIs for external players, authenticated with API keys.
+	// Last.fm clients call the API root with and without a trailing slash.
+	lastfm := func(c *gin.Context) {
+		handlers.LastfmHandler(c, apiKeyService, userService, songService, playService)
+	}
+	r.GET("/2.0", lastfm)
+	r.POST("/2.0", lastfm)
+	r.GET("/2.0/", lastfm)
+	r.POST("/2.0/", lastfm)
+	r.POST("/1/submit-listens", func(c *gin.Context) {
+		handlers.ListenBrainzSubmitHandler(c, apiKeyService, songService, playService)
+	})
+	r.GET("/1/validate-token", func(c *gin.Context) {
+		handlers.ListenBrainzValidateTokenHandler(c, apiKeyService, userService)
+	})
+
+	// Authenticates itself, with the JWT offered as a subprotocol since
+	// browsers can't set WebSocket headers
+	r.GET("/me/queue/ws", func(c *gin.Context) {
+		handlers.QueueSocketHandler(c, queueService, hub)
+	})
 
 	// Protected routes
 	protected := r.Group("/")
@@ -81,46 +221,211 @@ func main() {
 	{
 		// Song routes
 		protected.POST("/upload", func(c *gin.Context) {
-			handlers.UploadSongHandler(c, songService)
+			handlers.UploadSongHandler(c, songService, store, processor)
+		})
+		protected.GET("/songs", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.ListSongsHandler(c, songService, playService)
+		})
+		protected.GET("/songs/duplicates", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.ListDuplicateSongsHandler(c, songService, fingerprintService)
 		})
-		protected.GET("/songs", func(c *gin.Context) {
-			handlers.ListSongsHandler(c, songService)
+		protected.POST("/songs/merge", func(c *gin.Context) {
+			handlers.MergeSongsHandler(c, songService, store)
 		})
-		protected.GET("/stream/:id", func(c *gin.Context) {
-			handlers.StreamSongHandler(c, songService)
+		protected.GET("/stream/:id", handlers.CacheControl(handlers.CacheMedia), func(c *gin.Context) {
+			handlers.StreamSongHandler(c, songService, store, pipeline)
+		})
+		protected.POST("/stream/:id/url", func(c *gin.Context) {
+			handlers.CreateStreamURLHandler(c, songService, signer)
+		})
+		protected.GET("/hls/:id/master.m3u8", handlers.CacheControl(handlers.CacheMedia), func(c *gin.Context) {
+			handlers.HLSMasterHandler(c, songService, store, hls)
+		})
+		protected.GET("/hls/:id/:rendition/:file", handlers.CacheControl(handlers.CacheImmutable), func(c *gin.Context) {
+			handlers.HLSFileHandler(c, songService, store)
+		})
+		protected.GET("/song/:id", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.GetSongHandler(c, songService, playService)
+		})
+		protected.PUT("/song/:id/position", func(c *gin.Context) {
+			handlers.UpdatePositionHandler(c, songService, playService)
+		})
+		protected.GET("/song/:id/waveform", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.GetWaveformHandler(c, songService, processor)
+		})
+		protected.GET("/song/:id/download", handlers.CacheControl(handlers.CacheMedia), func(c *gin.Context) {
+			handlers.DownloadSongHandler(c, songService, store)
 		})
 		protected.DELETE("/song/:id", func(c *gin.Context) {
-			handlers.DeleteSongHandler(c, songService)
+			handlers.DeleteSongHandler(c, songService, store)
 		})
 		protected.PUT("/song/:id", func(c *gin.Context) {
-			handlers.UpdateSongHandler(c, songService)
+			handlers.UpdateSongHandler(c, songService, imageService, processor)
 		})
-		protected.GET("/search", func(c *gin.Context) {
+		protected.GET("/search", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
 			handlers.SearchSongsHandler(c, songService)
 		})
 
+		// Image routes
+		protected.POST("/images", func(c *gin.Context) {
+			handlers.UploadImageHandler(c, imageService, store)
+		})
+		protected.GET("/images", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.ListImagesHandler(c, imageService)
+		})
+		protected.GET("/image/:id", handlers.CacheControl(handlers.CacheMedia), func(c *gin.Context) {
+			handlers.GetImageHandler(c, imageService, store)
+		})
+		protected.DELETE("/image/:id", func(c *gin.Context) {
+			handlers.DeleteImageHandler(c, imageService, store)
+		})
+		protected.PUT("/me/avatar", func(c *gin.Context) {
+			handlers.SetAvatarHandler(c, userService, imageService)
+		})
+
+		// Listening history routes
+		protected.POST("/plays", func(c *gin.Context) {
+			handlers.RecordPlaysHandler(c, playService, songService)
+		})
+		protected.GET("/me/history", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.GetHistoryHandler(c, playService)
+		})
+		protected.GET("/me/history/export", func(c *gin.Context) {
+			handlers.ExportHistoryHandler(c, playService)
+		})
+		protected.GET("/me/continue-listening", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.ContinueListeningHandler(c, playService)
+		})
+
+		protected.GET("/me/stats", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.GetStatsHandler(c, statsService)
+		})
+		protected.GET("/me/wrapped/:year", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.GetWrappedHandler(c, statsService)
+		})
+
+		// API keys for scrobbling from external players
+		protected.POST("/me/api-keys", func(c *gin.Context) {
+			handlers.CreateAPIKeyHandler(c, apiKeyService)
+		})
+		protected.GET("/me/api-keys", func(c *gin.Context) {
+			handlers.ListAPIKeysHandler(c, apiKeyService)
+		})
+		protected.DELETE("/me/api-keys/:id", func(c *gin.Context) {
+			handlers.DeleteAPIKeyHandler(c, apiKeyService)
+		})
+
+		// Play queue routes
+		protected.GET("/me/queue", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
+			handlers.GetQueueHandler(c, queueService, hub)
+		})
+		protected.PUT("/me/queue", func(c *gin.Context) {
+			handlers.ReplaceQueueHandler(c, queueService, songService, playlistService, hub)
+		})
+		protected.DELETE("/me/queue", func(c *gin.Context) {
+			handlers.ClearQueueHandler(c, queueService, hub)
+		})
+		protected.POST("/me/queue/songs", func(c *gin.Context) {
+			handlers.AddToQueueHandler(c, queueService, songService, hub)
+		})
+		protected.DELETE("/me/queue/songs/:index", func(c *gin.Context) {
+			handlers.RemoveFromQueueHandler(c, queueService, hub)
+		})
+		protected.POST("/me/queue/commands", func(c *gin.Context) {
+			handlers.QueueCommandHandler(c, queueService, hub)
+		})
+
 		// Playlist routes
 		protected.POST("/playlists", func(c *gin.Context) {
 			handlers.CreatePlaylistHandler(c, playlistService)
 		})
-		protected.GET("/playlists", func(c *gin.Context) {
+		protected.POST("/playlists/import", func(c *gin.Context) {
+			handlers.ImportPlaylistHandler(c, playlistService, songService)
+		})
+		protected.GET("/playlists", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
 			handlers.ListPlaylistsHandler(c, playlistService)
 		})
-		protected.GET("/playlist/:id", func(c *gin.Context) {
+		protected.GET("/playlist/:id", handlers.CacheControl(handlers.CacheRevalidate), func(c *gin.Context) {
 			handlers.GetPlaylistHandler(c, playlistService)
 		})
+		protected.GET("/playlist/:id/export", func(c *gin.Context) {
+			handlers.ExportPlaylistHandler(c, playlistService, songService, signer)
+		})
+		protected.GET("/playlist/:id/download", func(c *gin.Context) {
+			handlers.DownloadPlaylistHandler(c, playlistService, songService, store)
+		})
 		protected.PUT("/playlist/:id", func(c *gin.Context) {
-			handlers.UpdatePlaylistHandler(c, playlistService)
+			handlers.UpdatePlaylistHandler(c, playlistService, imageService)
 		})
 		protected.DELETE("/playlist/:id", func(c *gin.Context) {
 			handlers.DeletePlaylistHandler(c, playlistService)
 		})
 		protected.POST("/playlist/:id/songs", func(c *gin.Context) {
-			handlers.AddSongToPlaylistHandler(c, playlistService)
+			handlers.AddSongToPlaylistHandler(c, playlistService, songService)
+		})
+		// Gin can't route a literal colon inside a segment, so the
+		// songs:batch and songs:import custom methods share a param route
+		protected.POST("/playlist/:id/:action", func(c *gin.Context) {
+			switch c.Param("action") {
+			case "songs:batch":
+				handlers.BatchPlaylistSongsHandler(c, playlistService, songService)
+			case "songs:import":
+				handlers.ImportPlaylistSongsHandler(c, playlistService, songService)
+			default:
+				c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+			}
+		})
+		protected.PATCH("/playlist/:id/songs", func(c *gin.Context) {
+			handlers.ReorderPlaylistSongsHandler(c, playlistService)
 		})
 		protected.DELETE("/playlist/:id/songs/:songId", func(c *gin.Context) {
 			handlers.RemoveSongFromPlaylistHandler(c, playlistService)
 		})
+		protected.GET("/playlist/:id/collaborators", func(c *gin.Context) {
+			handlers.ListPlaylistCollaboratorsHandler(c, playlistService, userService)
+		})
+		protected.POST("/playlist/:id/collaborators", func(c *gin.Context) {
+			handlers.AddPlaylistCollaboratorHandler(c, playlistService, userService)
+		})
+		protected.PATCH("/playlist/:id/collaborators/:userId", func(c *gin.Context) {
+			handlers.UpdatePlaylistCollaboratorHandler(c, playlistService)
+		})
+		protected.DELETE("/playlist/:id/collaborators/:userId", func(c *gin.Context) {
+			handlers.RemovePlaylistCollaboratorHandler(c, playlistService)
+		})
+		protected.POST("/playlist/:id/duplicate", func(c *gin.Context) {
+			handlers.DuplicatePlaylistHandler(c, playlistService)
+		})
+		protected.POST("/playlist/:id/fork", func(c *gin.Context) {
+			handlers.ForkPlaylistHandler(c, playlistService)
+		})
+		protected.POST("/playlist/:id/merge", func(c *gin.Context) {
+			handlers.MergePlaylistHandler(c, playlistService)
+		})
+		protected.POST("/shared/:token/fork", func(c *gin.Context) {
+			handlers.ForkSharedPlaylistHandler(c, playlistService)
+		})
+		protected.PUT("/playlist/:id/rules", func(c *gin.Context) {
+			handlers.SetPlaylistRulesHandler(c, playlistService)
+		})
+		protected.DELETE("/playlist/:id/rules", func(c *gin.Context) {
+			handlers.ClearPlaylistRulesHandler(c, playlistService)
+		})
+		protected.GET("/playlist/:id/shares", func(c *gin.Context) {
+			handlers.ListPlaylistSharesHandler(c, playlistService)
+		})
+		protected.POST("/playlist/:id/shares", func(c *gin.Context) {
+			handlers.CreatePlaylistShareHandler(c, playlistService)
+		})
+		protected.DELETE("/playlist/:id/shares/:token", func(c *gin.Context) {
+			handlers.RevokePlaylistShareHandler(c, playlistService)
+		})
+		protected.PATCH("/playlist/:id/entries/:entryId", func(c *gin.Context) {
+			handlers.UpdatePlaylistEntryHandler(c, playlistService)
+		})
+		protected.DELETE("/playlist/:id/entries/:entryId", func(c *gin.Context) {
+			handlers.RemovePlaylistEntryHandler(c, playlistService)
+		})
 	}
 
 	// Start server
@@ -128,5 +433,23 @@ func main() {
 	if port == "" {
 		port = "8080"
 	}
-	r.Run(":" + port)
+	srv := &http.Server{Addr: ":" + port, Handler: r}
+	srv.RegisterOnShutdown(hub.Close)
+
+	// Shut down gracefully on SIGINT/SIGTERM so buffered play events and
+	// background jobs are flushed by the deferred calls above
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("Server failed:", err)
+		}
+	}()
+	<-ctx.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("Server shutdown failed:", err)
+	}
 }
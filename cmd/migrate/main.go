@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/utils"
+
+	"github.com/joho/godotenv"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// migrations maps a migration name to the function that runs it. Each
+// migration must be safe to run more than once.
+var migrations = map[string]func(db *mongo.Database) (string, error){
+	"images": func(db *mongo.Database) (string, error) {
+		imageService := &services.ImageService{DB: db}
+		n, err := imageService.MigrateImageSongs(&storage.Local{Root: "uploads"})
+		return fmt.Sprintf("moved %d image songs to images", n), err
+	},
+	"image-files": func(db *mongo.Database) (string, error) {
+		imageService := &services.ImageService{DB: db}
+		n, err := imageService.MigrateImageFiles(&storage.Local{Root: "uploads"})
+		return fmt.Sprintf("moved %d image files", n), err
+	},
+	"song-formats": func(db *mongo.Database) (string, error) {
+		songService := &services.SongService{DB: db}
+		n, err := songService.MigrateSongFormats(&storage.Local{Root: "uploads"})
+		return fmt.Sprintf("detected the format of %d songs", n), err
+	},
+	"content-hashes": func(db *mongo.Database) (string, error) {
+		songService := &services.SongService{DB: db}
+		n, err := songService.MigrateContentHashes(&storage.Local{Root: "uploads"})
+		return fmt.Sprintf("hashed %d songs", n), err
+	},
+	"hls-renditions": func(db *mongo.Database) (string, error) {
+		songService := &services.SongService{DB: db}
+		n, err := songService.MigrateHLSRenditions(&storage.Local{Root: "uploads"})
+		return fmt.Sprintf("removed the old HLS renditions of %d users", n), err
+	},
+	"song-processing": func(db *mongo.Database) (string, error) {
+		songService := &services.SongService{DB: db}
+		n, err := songService.MigrateSongProcessing()
+		return fmt.Sprintf("marked %d analysis and fingerprinting jobs", n), err
+	},
+	"playlist-ranks": func(db *mongo.Database) (string, error) {
+		playlistService := &services.PlaylistService{DB: db}
+		n, err := playlistService.MigratePlaylistRanks()
+		return fmt.Sprintf("ranked the songs of %d playlists", n), err
+	},
+	"playlist-entries": func(db *mongo.Database) (string, error) {
+		playlistService := &services.PlaylistService{DB: db}
+		n, err := playlistService.MigratePlaylistEntries()
+		return fmt.Sprintf("gave %d playlist entries an entry ID", n), err
+	},
+	"duplicate-scrobbles": func(db *mongo.Database) (string, error) {
+		playService := &services.PlayService{DB: db}
+		n, err := playService.MigrateDuplicateScrobbles()
+		return fmt.Sprintf("removed %d duplicate scrobbles", n), err
+	},
+	"play-rollups": func(db *mongo.Database) (string, error) {
+		playService := &services.PlayService{DB: db}
+		if err := playService.EnsureIndexes(); err != nil {
+			return "", err
+		}
+		n, err := playService.RebuildRollups()
+		return fmt.Sprintf("rebuilt the rollups of %d days", n), err
+	},
+}
+
+func main() {
+	if err := godotenv.Load(); err != nil {
+		log.Println("No .env file found, using environment variables from system")
+	}
+
+	if len(os.Args) < 2 {
+		log.Fatal("usage: migrate <name>...")
+	}
+
+	mongoURI := os.Getenv("MONGO_URI")
+	if mongoURI == "" {
+		log.Fatal("MONGO_URI environment variable is not set")
+	}
+
+	client, err := utils.InitMongoDB(mongoURI)
+	if err != nil {
+		log.Fatal("Failed to connect to MongoDB:", err)
+	}
+	defer client.Disconnect(context.Background())
+
+	db := client.Database("projectpi")
+	for _, name := range os.Args[1:] {
+		migrate, ok := migrations[name]
+		if !ok {
+			log.Fatalf("Unknown migration %q", name)
+		}
+		result, err := migrate(db)
+		if err != nil {
+			log.Fatalf("Migration %s failed: %v", name, err)
+		}
+		log.Printf("Migration %s: %s", name, result)
+	}
+}
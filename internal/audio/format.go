@@ -0,0 +1,106 @@
+package audio
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+)
+
+// Format is an audio format accepted for upload.
+type Format struct {
+	Name        string
+	ContentType string
+	Ext         string
+}
+
+var (
+	MP3  = Format{Name: "mp3", ContentType: "audio/mpeg", Ext: ".mp3"}
+	WAV  = Format{Name: "wav", ContentType: "audio/wav", Ext: ".wav"}
+	FLAC = Format{Name: "flac", ContentType: "audio/flac", Ext: ".flac"}
+	OGG  = Format{Name: "ogg", ContentType: "audio/ogg", Ext: ".ogg"}
+	Opus = Format{Name: "opus", ContentType: "audio/ogg; codecs=opus", Ext: ".opus"}
+	AAC  = Format{Name: "aac", ContentType: "audio/aac", Ext: ".aac"}
+	M4A  = Format{Name: "m4a", ContentType: "audio/mp4", Ext: ".m4a"}
+	AIFF = Format{Name: "aiff", ContentType: "audio/aiff", Ext: ".aiff"}
+)
+
+var formats = []Format{MP3, WAV, FLAC, OGG, Opus, AAC, M4A, AIFF}
+
+// imageBrands are ISO base media brands used for still images.
+var imageBrands = map[string]bool{
+	"heic": true, "heix": true, "heim": true, "heis": true,
+	"mif1": true, "msf1": true, "avif": true, "avis": true,
+}
+
+// HeaderSize is how many leading bytes Detect wants to see.
+const HeaderSize = 512
+
+// Detect identifies the format of an audio file from its first bytes.
+func Detect(header []byte) (Format, bool) {
+	switch {
+	case len(header) >= 12 && bytes.HasPrefix(header, []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WAVE")):
+		return WAV, true
+	case bytes.HasPrefix(header, []byte("fLaC")):
+		return FLAC, true
+	case bytes.HasPrefix(header, []byte("OggS")):
+		// The first page carries the codec identification header
+		if bytes.Contains(header, []byte("OpusHead")) {
+			return Opus, true
+		}
+		if bytes.Contains(header, []byte("\x01vorbis")) {
+			return OGG, true
+		}
+		if bytes.Contains(header, []byte("fLaC")) {
+			return OGG, true
+		}
+		return Format{}, false
+	case len(header) >= 12 && bytes.Equal(header[4:8], []byte("ftyp")):
+		// MP4 brands shared with video are accepted; ffprobe later finds
+		// the audio stream. Image brands (HEIF, AVIF) are not.
+		if imageBrands[string(header[8:12])] {
+			return Format{}, false
+		}
+		return M4A, true
+	case len(header) >= 12 && bytes.HasPrefix(header, []byte("FORM")) &&
+		(bytes.Equal(header[8:12], []byte("AIFF")) || bytes.Equal(header[8:12], []byte("AIFC"))):
+		return AIFF, true
+	case bytes.HasPrefix(header, []byte("ID3")):
+		// ID3 tags are used by MP3 and occasionally by raw AAC
+		return MP3, true
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xF6 == 0xF0:
+		// ADTS sync word with layer 0
+		return AAC, true
+	case len(header) >= 2 && header[0] == 0xFF && header[1]&0xE0 == 0xE0 && header[1]&0x06 != 0:
+		// MPEG audio frame sync with a layer set
+		return MP3, true
+	}
+	return Format{}, false
+}
+
+// ByExtension looks a format up by the filename's extension. It is used for
+// songs uploaded before formats were detected and stored.
+func ByExtension(filename string) (Format, bool) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch ext {
+	case ".aif":
+		return AIFF, true
+	case ".mp4":
+		return M4A, true
+	}
+	for _, f := range formats {
+		if f.Ext == ext {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Lookup returns the format with the given name.
+func Lookup(name string) (Format, bool) {
+	for _, f := range formats {
+		if f.Name == name {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
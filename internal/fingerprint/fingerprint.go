@@ -0,0 +1,203 @@
+package fingerprint
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// SampleRate is the rate audio must be decoded at for Compute.
+const SampleRate = 11025
+
+const (
+	frameSize = 4096
+	hopSize   = frameSize / 3
+	minFreq   = 28.0
+	maxFreq   = 3520.0
+	// smoothing is how many chroma frames are averaged, which makes the
+	// fingerprint robust to differences between encodes
+	smoothing = 8
+)
+
+// Compute derives a Chromaprint-style fingerprint from signed 16-bit
+// little-endian mono PCM at SampleRate: the signal is reduced to a sequence
+// of 12-bin chroma vectors and every frame is summarized as a 32-bit
+// sub-fingerprint describing how the chroma energy changes over time and
+// across pitch classes. maxSeconds limits how much audio is read.
+func Compute(r io.Reader, maxSeconds int) ([]uint32, error) {
+	window := make([]float64, frameSize)
+	for i := range window {
+		window[i] = 0.5 - 0.5*math.Cos(2*math.Pi*float64(i)/float64(frameSize-1))
+	}
+	bins := chromaBins()
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	samples := make([]float64, 0, frameSize)
+	buf := make([]byte, 2*hopSize)
+	maxSamples := maxSeconds * SampleRate
+	read := 0
+
+	var chroma [][12]float64
+	spectrum := make([]complex128, frameSize)
+	for maxSeconds <= 0 || read < maxSamples {
+		n, err := io.ReadFull(br, buf)
+		for i := 0; i+1 < n; i += 2 {
+			samples = append(samples, float64(int16(binary.LittleEndian.Uint16(buf[i:])))/32768)
+		}
+		read += n / 2
+		if err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		if len(samples) < frameSize {
+			continue
+		}
+
+		for i := range spectrum {
+			spectrum[i] = complex(samples[i]*window[i], 0)
+		}
+		fft(spectrum)
+		var frame [12]float64
+		for i, class := range bins {
+			if class >= 0 {
+				re, im := real(spectrum[i]), imag(spectrum[i])
+				frame[class] += re*re + im*im
+			}
+		}
+		chroma = append(chroma, normalize(frame))
+		samples = samples[hopSize:]
+	}
+
+	return subFingerprints(smooth(chroma)), nil
+}
+
+// chromaBins maps each FFT bin to its pitch class, or -1 outside the range
+// the fingerprint looks at.
+func chromaBins() []int {
+	bins := make([]int, frameSize/2)
+	for i := range bins {
+		freq := float64(i) * SampleRate / frameSize
+		if freq < minFreq || freq > maxFreq {
+			bins[i] = -1
+			continue
+		}
+		note := 12 * math.Log2(freq/440)
+		bins[i] = ((int(math.Round(note)) % 12) + 12) % 12
+	}
+	return bins
+}
+
+func normalize(frame [12]float64) [12]float64 {
+	var norm float64
+	for _, v := range frame {
+		norm += v * v
+	}
+	norm = math.Sqrt(norm)
+	if norm < 1e-9 {
+		return [12]float64{}
+	}
+	for i := range frame {
+		frame[i] /= norm
+	}
+	return frame
+}
+
+func smooth(chroma [][12]float64) [][12]float64 {
+	if len(chroma) < smoothing {
+		return nil
+	}
+	out := make([][12]float64, len(chroma)-smoothing+1)
+	for i := range out {
+		for j := 0; j < smoothing; j++ {
+			for k := 0; k < 12; k++ {
+				out[i][k] += chroma[i+j][k]
+			}
+		}
+	}
+	return out
+}
+
+// subFingerprints encodes each frame (after the first) as 32 bits: 12 bits
+// for whether each pitch class got louder since the previous frame, 12 for
+// whether it is louder than its neighbor, and 8 for whether it is louder
+// than the class a whole tone up.
+func subFingerprints(chroma [][12]float64) []uint32 {
+	if len(chroma) < 2 {
+		return nil
+	}
+	fp := make([]uint32, len(chroma)-1)
+	for t := 1; t < len(chroma); t++ {
+		cur, prev := chroma[t], chroma[t-1]
+		var v uint32
+		bit := 0
+		set := func(cond bool) {
+			if cond {
+				v |= 1 << bit
+			}
+			bit++
+		}
+		for i := 0; i < 12; i++ {
+			set(cur[i] > prev[i])
+		}
+		for i := 0; i < 12; i++ {
+			set(cur[i] > cur[(i+1)%12])
+		}
+		for i := 0; i < 8; i++ {
+			set(cur[i] > cur[(i+2)%12])
+		}
+		fp[t-1] = v
+	}
+	return fp
+}
+
+// maxOffset is how far (in sub-fingerprints, ~0.12s each) two fingerprints
+// are shifted against each other when comparing, to absorb leading silence
+// or encoder delay.
+const maxOffset = 40
+
+// minOverlap is the fewest aligned sub-fingerprints a comparison needs.
+const minOverlap = 50
+
+// Similarity compares two fingerprints and returns the fraction of matching
+// bits at the best alignment: 1 for identical audio, around 0.5 for
+// unrelated recordings.
+func Similarity(a, b []uint32) float64 {
+	best := 0.0
+	for offset := -maxOffset; offset <= maxOffset; offset++ {
+		matching, total := 0, 0
+		for i := range a {
+			j := i + offset
+			if j < 0 || j >= len(b) {
+				continue
+			}
+			matching += 32 - bits.OnesCount32(a[i]^b[j])
+			total += 32
+		}
+		if total >= 32*minOverlap {
+			best = math.Max(best, float64(matching)/float64(total))
+		}
+	}
+	return best
+}
+
+// Encode packs a fingerprint into bytes for storage.
+func Encode(fp []uint32) []byte {
+	out := make([]byte, 4*len(fp))
+	for i, v := range fp {
+		binary.LittleEndian.PutUint32(out[4*i:], v)
+	}
+	return out
+}
+
+// Decode unpacks a fingerprint packed by Encode.
+func Decode(data []byte) []uint32 {
+	fp := make([]uint32, len(data)/4)
+	for i := range fp {
+		fp[i] = binary.LittleEndian.Uint32(data[4*i:])
+	}
+	return fp
+}
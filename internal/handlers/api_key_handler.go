@@ -0,0 +1,100 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CreateAPIKeyHandler creates a key for an external player. The secret is
+// only returned here.
+func CreateAPIKeyHandler(c *gin.Context, apiKeyService *services.APIKeyService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var request struct {
+		Name string `json:"name" binding:"required,max=64"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	key, err := utils.GenerateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+	secret, err := utils.GenerateToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate key"})
+		return
+	}
+
+	apiKey := models.APIKey{
+		KeyID:  utils.GenerateAPIKeyID(uint(time.Now().UnixNano() % 10000)),
+		UserID: userID.(string),
+		Name:   request.Name,
+		Key:    key,
+		Secret: secret,
+	}
+	if err := apiKeyService.CreateAPIKey(&apiKey); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, apiKey)
+}
+
+// ListAPIKeysHandler lists the user's API keys without their secrets
+func ListAPIKeysHandler(c *gin.Context, apiKeyService *services.APIKeyService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	keys, err := apiKeyService.GetAPIKeysByUserID(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch keys"})
+		return
+	}
+	if keys == nil {
+		keys = []models.APIKey{}
+	}
+	for i := range keys {
+		keys[i].Secret = ""
+	}
+
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// DeleteAPIKeyHandler revokes one of the user's API keys
+func DeleteAPIKeyHandler(c *gin.Context, apiKeyService *services.APIKeyService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	key, err := apiKeyService.GetAPIKeyByID(c.Param("id"))
+	if err != nil || key.UserID != userID.(string) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Key not found"})
+		return
+	}
+
+	if err := apiKeyService.DeleteAPIKey(key.KeyID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete key"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Key deleted"})
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Cache-Control policies used by the routes in main.
+const (
+	// CacheRevalidate lets clients keep a copy but check it with the ETag
+	// on every use, for JSON that changes whenever the user edits anything.
+	CacheRevalidate = "private, no-cache"
+	// CacheMedia is for audio and images addressed by ID, which change
+	// rarely and are validated by content hash.
+	CacheMedia = "private, max-age=86400"
+	// CacheNoStore is for responses reached through a signed URL or share
+	// link, which must not outlive the signature or a revoked share.
+	CacheNoStore = "private, no-store"
+	// CacheImmutable is for generated files that never change once written.
+	CacheImmutable = "private, max-age=31536000, immutable"
+)
+
+// CacheControl sets the Cache-Control policy for a route's successful and
+// 304 responses. Errors are sent with no-store so a cached 404 or 500
+// doesn't outlive the problem.
+func CacheControl(policy string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = &cacheControlWriter{ResponseWriter: c.Writer, policy: policy}
+		c.Header("Cache-Control", policy)
+		c.Next()
+	}
+}
+
+// cacheControlWriter picks the Cache-Control header by status. gin only
+// sends headers on the first write, so the last status set before that
+// decides.
+type cacheControlWriter struct {
+	gin.ResponseWriter
+	policy string
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if !w.Written() {
+		if code >= 200 && code < 300 || code == http.StatusNotModified {
+			w.Header().Set("Cache-Control", w.policy)
+		} else {
+			w.Header().Set("Cache-Control", "no-store")
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// respondJSON writes body as JSON with a strong ETag computed from the
+// encoded bytes, and answers 304 Not Modified when the client already has
+// that representation. A non-zero modTime, when the resource was last
+// changed, is sent as Last-Modified; it may not cover everything in the
+// body, so conditional requests are answered from the ETag only.
+func respondJSON(c *gin.Context, status int, body interface{}, modTime time.Time) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode response"})
+		return
+	}
+
+	sum := sha256.Sum256(data)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	if !modTime.IsZero() {
+		c.Header("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if status == http.StatusOK && etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(status, "application/json; charset=utf-8", data)
+}
+
+// newest returns the latest of the items' modification times, for the
+// Last-Modified of a list. Removing an item doesn't move it forward; the
+// ETag still changes.
+func newest[T any](items []T, modTime func(T) time.Time) time.Time {
+	var latest time.Time
+	for _, item := range items {
+		if t := modTime(item); t.After(latest) {
+			latest = t
+		}
+	}
+	return latest
+}
+
+// etagMatches implements the weak comparison If-None-Match uses.
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// serveFile serves a file with range support, the given strong ETag and
+// Last-Modified time. http.ServeContent then handles If-None-Match,
+// If-Modified-Since and If-Range.
+func serveFile(c *gin.Context, path string, etag string, modTime time.Time) {
+	f, err := os.Open(path)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	defer f.Close()
+	serveOpenFile(c, f, etag, modTime)
+}
+
+// serveOpenFile is serveFile for a file the caller has opened and closes.
+// An empty etag is derived from the file, as by fileETag.
+func serveOpenFile(c *gin.Context, f *os.File, etag string, modTime time.Time) {
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if modTime.IsZero() {
+		modTime = info.ModTime()
+	}
+	if etag == "" {
+		etag = infoETag(info)
+	}
+	c.Header("ETag", etag)
+	http.ServeContent(c.Writer, c.Request, info.Name(), modTime, f)
+}
+
+// fileETag derives a strong ETag from a file's identity on disk, for files
+// such as cached transcodes that aren't content hashed.
+func fileETag(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return ""
+	}
+	return infoETag(info)
+}
+
+func infoETag(info os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+}
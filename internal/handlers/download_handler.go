@@ -0,0 +1,211 @@
+package handlers
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/storage"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DownloadSongHandler returns a song's original file as an attachment under
+// its original filename
+func DownloadSongHandler(c *gin.Context, songService *services.SongService, store *storage.Local) {
+	song, ok := ownedSong(c, songService)
+	if !ok {
+		return
+	}
+
+	path := store.Path(song.UserID, song.Filename)
+	etag := fileETag(path)
+	if song.ContentHash != "" {
+		etag = `"` + song.ContentHash + `"`
+	}
+	if format := songFormat(song); format.ContentType != "" {
+		c.Header("Content-Type", format.ContentType)
+	}
+	c.Header("Content-Disposition", attachment(song.Filename))
+	serveFile(c, path, etag, song.UpdatedAt)
+}
+
+// DownloadPlaylistHandler streams a ZIP of the caller's own tracks in the
+// playlist in playlist order, plus an M3U playlist referencing them. The
+// archive is written as it is read so large playlists are never held in
+// memory. Tracks left out are listed in the M3U as comments, in their
+// place, and counted in the X-Skipped-Tracks header (which can't include
+// files found missing while writing).
+func DownloadPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService, songService *services.SongService, store *storage.Local) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleViewer)
+	if !ok {
+		return
+	}
+	playlistID := playlist.PlaylistID
+	userID := c.GetString("UserID")
+
+	playlistSongs, err := playlistService.GetPlaylistContents(playlist)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
+		return
+	}
+
+	// Resolve songs before writing anything so errors can still be reported.
+	// Only the caller's own files go in the archive; members can stream
+	// each other's songs but not take copies of them. Other members' songs
+	// are still looked up so the M3U can say what was left out.
+	type songKey struct{ userID, songID string }
+	songIDs := make(map[string][]string)
+	for _, entry := range playlistSongs {
+		if !entry.Unavailable {
+			songIDs[entry.AddedBy] = append(songIDs[entry.AddedBy], entry.SongID)
+		}
+	}
+	found := make(map[songKey]*models.Song)
+	for owner, ids := range songIDs {
+		songs, err := songService.GetSongsByIDs(owner, ids)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
+			return
+		}
+		for i := range songs {
+			found[songKey{owner, songs[i].SongID}] = &songs[i]
+		}
+	}
+
+	// A track is a song to add, or a note on an entry left out
+	type track struct {
+		song    *models.Song
+		skipped string
+	}
+	tracks := make([]track, 0, len(playlistSongs))
+	skipped := 0
+	for _, entry := range playlistSongs {
+		song := found[songKey{entry.AddedBy, entry.SongID}]
+		switch {
+		case song != nil && entry.AddedBy == userID:
+			tracks = append(tracks, track{song: song})
+			continue
+		case song != nil:
+			tracks = append(tracks, track{skipped: trackLabel(song.Artist, song.Title) + " (added by another member)"})
+		case entry.Deleted != nil:
+			tracks = append(tracks, track{skipped: trackLabel(entry.Deleted.Artist, entry.Deleted.Title) + " (deleted)"})
+		default:
+			tracks = append(tracks, track{skipped: "unknown track (no longer available)"})
+		}
+		skipped++
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", attachment(safeFilename(playlist.Name)+".zip"))
+	c.Header("X-Skipped-Tracks", strconv.Itoa(skipped))
+	c.Status(http.StatusOK)
+
+	zw := zip.NewWriter(c.Writer)
+	m3u := []string{"#EXTM3U"}
+	position := 0
+	for _, t := range tracks {
+		if t.song == nil {
+			m3u = append(m3u, "# Skipped: "+t.skipped)
+			continue
+		}
+		song := t.song
+		// A missing file only costs its track
+		f, err := store.Open(song.UserID, song.Filename)
+		if err != nil {
+			log.Printf("Skipping %s in playlist %s download: %v", song.SongID, playlistID, err)
+			m3u = append(m3u, "# Skipped: "+trackLabel(song.Artist, song.Title)+" (file missing)")
+			continue
+		}
+		position++
+		name := trackFilename(position, song)
+		err = addToZip(zw, name, f, song.UpdatedAt)
+		f.Close()
+		if err != nil {
+			// Headers are already sent; all we can do is cut the archive short
+			log.Printf("Failed to add %s to playlist %s download: %v", song.SongID, playlistID, err)
+			return
+		}
+		m3u = append(m3u, fmt.Sprintf("#EXTINF:%d,%s - %s", int(song.Duration), song.Artist, song.Title), name)
+	}
+
+	w, err := zw.Create(safeFilename(playlist.Name) + ".m3u")
+	if err == nil {
+		_, err = io.WriteString(w, strings.Join(m3u, "\n")+"\n")
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if err != nil {
+		log.Printf("Failed to finish playlist %s download: %v", playlistID, err)
+	}
+}
+
+// trackLabel names a track in a comment, e.g. "Artist - Title"
+func trackLabel(artist, title string) string {
+	if title == "" {
+		title = "untitled"
+	}
+	if artist == "" {
+		return title
+	}
+	return artist + " - " + title
+}
+
+// addToZip copies f into the archive uncompressed, since audio is already
+// compressed
+func addToZip(zw *zip.Writer, name string, f io.Reader, modified time.Time) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Store,
+		Modified: modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// trackFilename names a track in a playlist download, e.g.
+// "01 - Artist - Title.mp3"
+func trackFilename(position int, song *models.Song) string {
+	name := song.Title
+	if song.Artist != "" {
+		name = song.Artist + " - " + name
+	}
+	if name == "" {
+		name = strings.TrimSuffix(song.Filename, filepath.Ext(song.Filename))
+	}
+	return fmt.Sprintf("%02d - %s%s", position, safeFilename(name), filepath.Ext(song.Filename))
+}
+
+// safeFilename replaces characters that aren't allowed in filenames on
+// common platforms
+func safeFilename(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if name == "" {
+		return "untitled"
+	}
+	return name
+}
+
+// attachment builds a Content-Disposition header value, encoding
+// non-ASCII filenames as RFC 2231 requires
+func attachment(filename string) string {
+	return mime.FormatMediaType("attachment", map[string]string{"filename": filename})
+}
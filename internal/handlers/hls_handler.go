@@ -0,0 +1,63 @@
+package handlers
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/transcode"
+
+	"github.com/gin-gonic/gin"
+)
+
+var hlsFilePattern = regexp.MustCompile(`^[a-z0-9_]+\.(m3u8|ts)$`)
+
+// HLSMasterHandler serves a song's HLS master playlist, packaging the song
+// into renditions on first request
+func HLSMasterHandler(c *gin.Context, songService *services.SongService, store *storage.Local, hls *transcode.HLS) {
+	song, ok := ownedSong(c, songService)
+	if !ok {
+		return
+	}
+
+	dir := store.Path(storage.HLSParts(song.UserID, song.SongID)...)
+	if err := hls.Ensure(store.Path(song.UserID, song.Filename), dir); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to package song"})
+		return
+	}
+
+	c.Header("Content-Type", "application/vnd.apple.mpegurl")
+	path := store.Path(storage.HLSParts(song.UserID, song.SongID, transcode.HLSMasterPlaylist)...)
+	serveFile(c, path, fileETag(path), time.Time{})
+}
+
+// HLSFileHandler serves a rendition playlist or segment of a packaged song
+func HLSFileHandler(c *gin.Context, songService *services.SongService, store *storage.Local) {
+	rendition := c.Param("rendition")
+	file := c.Param("file")
+	if !transcode.HLSRendition(rendition) || !hlsFilePattern.MatchString(file) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	song, ok := ownedSong(c, songService)
+	if !ok {
+		return
+	}
+
+	if !store.Exists(storage.HLSParts(song.UserID, song.SongID, rendition, file)...) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+
+	contentType := "video/mp2t"
+	if strings.HasSuffix(file, ".m3u8") {
+		contentType = "application/vnd.apple.mpegurl"
+	}
+	c.Header("Content-Type", contentType)
+	path := store.Path(storage.HLSParts(song.UserID, song.SongID, rendition, file)...)
+	serveFile(c, path, fileETag(path), time.Time{})
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+var imageKinds = map[string]bool{
+	models.ImageKindSong:     true,
+	models.ImageKindAlbum:    true,
+	models.ImageKindPlaylist: true,
+	models.ImageKindAvatar:   true,
+}
+
+// UploadImageHandler stores artwork or an avatar for the authenticated user
+func UploadImageHandler(c *gin.Context, imageService *services.ImageService, store *storage.Local) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userIDStr, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	kind := c.DefaultPostForm("kind", models.ImageKindSong)
+	if !imageKinds[kind] {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid image kind"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+		return
+	}
+
+	const maxImageSize = 10 << 20 // 10MB
+	if file.Size > maxImageSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large (max 10MB)"})
+		return
+	}
+
+	// Sniff the content instead of trusting the multipart header
+	f, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+		return
+	}
+	defer f.Close()
+	contentType, width, height, err := utils.DetectImage(f)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file type"})
+		return
+	}
+
+	img := models.Image{
+		ImageID:     utils.GenerateImageID(uint(time.Now().UnixNano() % 10000)),
+		Kind:        kind,
+		Filename:    file.Filename,
+		ContentType: contentType,
+		Size:        file.Size,
+		Width:       width,
+		Height:      height,
+		UserID:      userIDStr,
+	}
+
+	if err := store.Save(f, storage.ImageParts(userIDStr, img.ImageID)...); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	if err := imageService.CreateImage(&img); err != nil {
+		store.Remove(storage.ImageParts(userIDStr, img.ImageID)...)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save image"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, img)
+}
+
+// ListImagesHandler lists all images uploaded by the authenticated user
+func ListImagesHandler(c *gin.Context, imageService *services.ImageService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	images, err := imageService.GetImagesByUserID(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch images"})
+		return
+	}
+
+	respondJSON(c, http.StatusOK, gin.H{"images": images}, newest(images, func(img models.Image) time.Time { return img.UpdatedAt }))
+}
+
+// GetImageHandler serves an image file. Artwork and avatars are shown to
+// other users too, so any authenticated user may fetch an image.
+func GetImageHandler(c *gin.Context, imageService *services.ImageService, store *storage.Local) {
+	img, err := imageService.GetImageByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	c.Header("Content-Type", img.ContentType)
+	path := store.Path(storage.ImageParts(img.UserID, img.ImageID)...)
+	serveFile(c, path, fileETag(path), img.UpdatedAt)
+}
+
+// DeleteImageHandler deletes an image owned by the authenticated user
+func DeleteImageHandler(c *gin.Context, imageService *services.ImageService, store *storage.Local) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	img, err := imageService.GetImageByID(c.Param("id"))
+	if err != nil || img.UserID != userID.(string) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return
+	}
+
+	store.Remove(storage.ImageParts(img.UserID, img.ImageID)...)
+
+	if err := imageService.DeleteImage(img.ImageID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete image"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Image deleted"})
+}
+
+// SetAvatarHandler sets one of the user's images as their avatar
+func SetAvatarHandler(c *gin.Context, userService *services.UserService, imageService *services.ImageService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var request struct {
+		ImageID string `json:"image_id" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if !ownsImage(imageService, request.ImageID, userID.(string)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Image not found"})
+		return
+	}
+
+	if err := userService.UpdateUser(userID.(string), bson.M{"avatar_id": request.ImageID}); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update avatar"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Avatar updated"})
+}
+
+// ownsImage reports whether imageID exists and was uploaded by userID
+func ownsImage(imageService *services.ImageService, imageID string, userID string) bool {
+	img, err := imageService.GetImageByID(imageID)
+	return err == nil && img.UserID == userID
+}
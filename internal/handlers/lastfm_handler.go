@@ -0,0 +1,312 @@
+package handlers
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Last.fm API error codes
+const (
+	lastfmInvalidMethod     = 3
+	lastfmInvalidParameters = 6
+	lastfmOperationFailed   = 8
+	lastfmInvalidSessionKey = 9
+	lastfmInvalidAPIKey     = 10
+	lastfmInvalidSignature  = 13
+)
+
+// Last.fm ignoredMessage codes
+const (
+	lastfmIgnoredArtist       = "1"
+	lastfmIgnoredTrack        = "2"
+	lastfmIgnoredTimestampNew = "4"
+)
+
+// lastfmMaxScrobbles is the most scrobbles Last.fm accepts in one call.
+const lastfmMaxScrobbles = 50
+
+// The response types below marshal to both of Last.fm's formats: XML by
+// default, JSON with format=json.
+
+type lastfmResponse struct {
+	XMLName xml.Name    `xml:"lfm"`
+	Status  string      `xml:"status,attr"`
+	Body    interface{} `xml:",omitempty"`
+}
+
+type lastfmError struct {
+	XMLName xml.Name `xml:"error" json:"-"`
+	Code    int      `xml:"code,attr" json:"error"`
+	Message string   `xml:",chardata" json:"message"`
+}
+
+type lastfmSession struct {
+	XMLName    xml.Name `xml:"session" json:"-"`
+	Name       string   `xml:"name" json:"name"`
+	Key        string   `xml:"key" json:"key"`
+	Subscriber int      `xml:"subscriber" json:"subscriber"`
+}
+
+type lastfmValue struct {
+	Corrected string `xml:"corrected,attr" json:"corrected"`
+	Text      string `xml:",chardata" json:"#text"`
+}
+
+type lastfmIgnored struct {
+	Code string `xml:"code,attr" json:"code"`
+	Text string `xml:",chardata" json:"#text"`
+}
+
+type lastfmTrack struct {
+	XMLName        xml.Name      `json:"-"`
+	Track          lastfmValue   `xml:"track" json:"track"`
+	Artist         lastfmValue   `xml:"artist" json:"artist"`
+	Album          lastfmValue   `xml:"album" json:"album"`
+	AlbumArtist    lastfmValue   `xml:"albumArtist" json:"albumArtist"`
+	Timestamp      string        `xml:"timestamp,omitempty" json:"timestamp,omitempty"`
+	IgnoredMessage lastfmIgnored `xml:"ignoredMessage" json:"ignoredMessage"`
+}
+
+type lastfmScrobbles struct {
+	XMLName  xml.Name      `xml:"scrobbles"`
+	Accepted int           `xml:"accepted,attr"`
+	Ignored  int           `xml:"ignored,attr"`
+	Scrobble []lastfmTrack `xml:"scrobble"`
+}
+
+// MarshalJSON matches Last.fm, which returns a single scrobble as an object
+// rather than an array.
+func (s lastfmScrobbles) MarshalJSON() ([]byte, error) {
+	var scrobbles interface{} = s.Scrobble
+	if len(s.Scrobble) == 1 {
+		scrobbles = s.Scrobble[0]
+	}
+	return json.Marshal(gin.H{
+		"@attr":    gin.H{"accepted": s.Accepted, "ignored": s.Ignored},
+		"scrobble": scrobbles,
+	})
+}
+
+// LastfmHandler implements the scrobbling subset of the Last.fm 2.0 API so
+// that players with Last.fm support can scrobble to ProjectPi. Players are
+// configured with one of the user's API keys and its secret; every call
+// must be signed with the secret as Last.fm requires. The session key
+// returned by auth.getMobileSession and auth.getSession is the API key
+// itself, since the signature already proves the player holds the secret.
+func LastfmHandler(c *gin.Context, apiKeyService *services.APIKeyService, userService *services.UserService, songService *services.SongService, playService *services.PlayService) {
+	if err := c.Request.ParseForm(); err != nil {
+		lastfmFail(c, "", lastfmInvalidParameters, "Invalid parameters")
+		return
+	}
+	params := c.Request.Form
+	format := params.Get("format")
+
+	key, err := apiKeyService.GetAPIKeyByKey(params.Get("api_key"))
+	if err != nil {
+		lastfmFail(c, format, lastfmInvalidAPIKey, "Invalid API key - You must be granted a valid key by last.fm")
+		return
+	}
+	signature := params.Get("api_sig")
+	if subtle.ConstantTimeCompare([]byte(strings.ToLower(signature)), []byte(lastfmSignature(params, key.Secret))) != 1 {
+		lastfmFail(c, format, lastfmInvalidSignature, "Invalid method signature supplied")
+		return
+	}
+
+	method := params.Get("method")
+	switch method {
+	case "auth.getMobileSession", "auth.getSession":
+		user, err := userService.GetUserByID(key.UserID)
+		if err != nil {
+			lastfmFail(c, format, lastfmOperationFailed, "Operation failed - Most likely the backend service failed. Please try again.")
+			return
+		}
+		lastfmOK(c, format, "session", lastfmSession{Name: user.Username, Key: key.Key})
+		return
+	case "track.updateNowPlaying", "track.scrobble":
+	default:
+		lastfmFail(c, format, lastfmInvalidMethod, "Invalid Method - No method with that name in this package")
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(params.Get("sk")), []byte(key.Key)) != 1 {
+		lastfmFail(c, format, lastfmInvalidSessionKey, "Invalid session key - Please re-authenticate")
+		return
+	}
+	apiKeyService.TouchAPIKey(key.KeyID)
+
+	if method == "track.updateNowPlaying" {
+		// Nothing is recorded until the track is scrobbled
+		if params.Get("artist") == "" || params.Get("track") == "" {
+			lastfmFail(c, format, lastfmInvalidParameters, "Invalid parameters - artist and track are required")
+			return
+		}
+		track := lastfmScrobbleTrack(scrobble{
+			Artist: params.Get("artist"),
+			Track:  params.Get("track"),
+			Album:  params.Get("album"),
+		}, params.Get("albumArtist"), "")
+		track.XMLName = xml.Name{Local: "nowplaying"}
+		lastfmOK(c, format, "nowplaying", track)
+		return
+	}
+
+	scrobbles, albumArtists, err := parseLastfmScrobbles(params)
+	if err != nil {
+		lastfmFail(c, format, lastfmInvalidParameters, "Invalid parameters - "+err.Error())
+		return
+	}
+
+	result := lastfmScrobbles{Scrobble: make([]lastfmTrack, 0, len(scrobbles))}
+	plays := make([]models.Play, 0, len(scrobbles))
+	now := time.Now()
+	for i, s := range scrobbles {
+		ignored := ""
+		switch {
+		case s.Artist == "":
+			ignored = lastfmIgnoredArtist
+		case s.Track == "":
+			ignored = lastfmIgnoredTrack
+		case s.Timestamp.After(now.Add(24 * time.Hour)):
+			ignored = lastfmIgnoredTimestampNew
+		}
+
+		track := lastfmScrobbleTrack(s, albumArtists[i], strconv.FormatInt(s.Timestamp.Unix(), 10))
+		track.XMLName = xml.Name{Local: "scrobble"}
+		if ignored != "" {
+			track.IgnoredMessage.Code = ignored
+			result.Ignored++
+			result.Scrobble = append(result.Scrobble, track)
+			continue
+		}
+
+		play, err := scrobblePlay(key.UserID, "lastfm", s, songService)
+		if err != nil {
+			lastfmFail(c, format, lastfmOperationFailed, "Operation failed - Most likely the backend service failed. Please try again.")
+			return
+		}
+		plays = append(plays, play)
+		result.Accepted++
+		result.Scrobble = append(result.Scrobble, track)
+	}
+	playService.RecordPlays(plays)
+
+	lastfmOK(c, format, "scrobbles", result)
+}
+
+// parseLastfmScrobbles reads the scrobbles of a track.scrobble call, given
+// either as artist[i], track[i], ... for a batch or as artist, track, ...
+// for a single one. It also returns each scrobble's albumArtist, which is
+// echoed back but not stored.
+func parseLastfmScrobbles(params url.Values) ([]scrobble, []string, error) {
+	indexed := params.Get("artist[0]") != "" || params.Get("track[0]") != ""
+	param := func(name string, i int) string {
+		if indexed {
+			return strings.TrimSpace(params.Get(fmt.Sprintf("%s[%d]", name, i)))
+		}
+		return strings.TrimSpace(params.Get(name))
+	}
+
+	var scrobbles []scrobble
+	var albumArtists []string
+	for i := 0; ; i++ {
+		if i > 0 && !indexed {
+			break
+		}
+		artist, track := param("artist", i), param("track", i)
+		timestamp := param("timestamp", i)
+		if artist == "" && track == "" && timestamp == "" {
+			break
+		}
+		if i == lastfmMaxScrobbles {
+			return nil, nil, fmt.Errorf("at most %d scrobbles per request", lastfmMaxScrobbles)
+		}
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid timestamp for scrobble %d", i)
+		}
+		scrobbles = append(scrobbles, scrobble{
+			Artist:    artist,
+			Track:     track,
+			Album:     param("album", i),
+			Timestamp: time.Unix(seconds, 0),
+		})
+		albumArtists = append(albumArtists, param("albumArtist", i))
+	}
+	if len(scrobbles) == 0 {
+		return nil, nil, fmt.Errorf("artist, track and timestamp are required")
+	}
+	return scrobbles, albumArtists, nil
+}
+
+func lastfmScrobbleTrack(s scrobble, albumArtist string, timestamp string) lastfmTrack {
+	return lastfmTrack{
+		Track:          lastfmValue{Corrected: "0", Text: s.Track},
+		Artist:         lastfmValue{Corrected: "0", Text: s.Artist},
+		Album:          lastfmValue{Corrected: "0", Text: s.Album},
+		AlbumArtist:    lastfmValue{Corrected: "0", Text: albumArtist},
+		Timestamp:      timestamp,
+		IgnoredMessage: lastfmIgnored{Code: "0"},
+	}
+}
+
+// lastfmSignature computes api_sig: the md5 of every parameter name and
+// value, sorted by name, followed by the secret. format and callback are
+// not signed.
+func lastfmSignature(params url.Values, secret string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		if name != "format" && name != "callback" && name != "api_sig" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteString(params.Get(name))
+	}
+	b.WriteString(secret)
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func lastfmOK(c *gin.Context, format string, name string, body interface{}) {
+	if format == "json" {
+		c.JSON(http.StatusOK, gin.H{name: body})
+		return
+	}
+	c.XML(http.StatusOK, lastfmResponse{Status: "ok", Body: body})
+}
+
+func lastfmFail(c *gin.Context, format string, code int, message string) {
+	status := http.StatusBadRequest
+	switch code {
+	case lastfmInvalidSessionKey, lastfmInvalidAPIKey, lastfmInvalidSignature:
+		status = http.StatusForbidden
+	case lastfmOperationFailed:
+		status = http.StatusInternalServerError
+	}
+
+	body := lastfmError{Code: code, Message: message}
+	if format == "json" {
+		c.JSON(status, body)
+		return
+	}
+	c.XML(status, lastfmResponse{Status: "failed", Body: body})
+}
@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// listenBrainzMaxListens is the most listens ListenBrainz accepts in one
+// submission.
+const listenBrainzMaxListens = 1000
+
+// listenBrainzListen is a listen in the ListenBrainz JSON format, used both
+// for submissions and for exporting history.
+type listenBrainzListen struct {
+	ListenedAt    int64                     `json:"listened_at,omitempty"`
+	TrackMetadata listenBrainzTrackMetadata `json:"track_metadata"`
+}
+
+type listenBrainzTrackMetadata struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info,omitempty"`
+}
+
+// ListenBrainzSubmitHandler implements ListenBrainz's submit-listens so
+// players with ListenBrainz support can submit listens to ProjectPi. The
+// token is one of the user's API keys, sent as "Authorization: Token <key>".
+func ListenBrainzSubmitHandler(c *gin.Context, apiKeyService *services.APIKeyService, songService *services.SongService, playService *services.PlayService) {
+	key, ok := listenBrainzKey(c, apiKeyService)
+	if !ok {
+		listenBrainzFail(c, http.StatusUnauthorized, "Invalid authorization token.")
+		return
+	}
+
+	var request struct {
+		ListenType string               `json:"listen_type"`
+		Payload    []listenBrainzListen `json:"payload"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		listenBrainzFail(c, http.StatusBadRequest, "Cannot parse JSON document: "+err.Error())
+		return
+	}
+
+	switch request.ListenType {
+	case "single", "playing_now":
+		if len(request.Payload) != 1 {
+			listenBrainzFail(c, http.StatusBadRequest, "JSON document must contain exactly one listen for listen_type "+request.ListenType+".")
+			return
+		}
+	case "import":
+		if len(request.Payload) == 0 || len(request.Payload) > listenBrainzMaxListens {
+			listenBrainzFail(c, http.StatusBadRequest, "JSON document must contain between 1 and 1000 listens.")
+			return
+		}
+	default:
+		listenBrainzFail(c, http.StatusBadRequest, "JSON document requires a valid listen_type key.")
+		return
+	}
+
+	for _, listen := range request.Payload {
+		metadata := listen.TrackMetadata
+		if strings.TrimSpace(metadata.ArtistName) == "" || strings.TrimSpace(metadata.TrackName) == "" {
+			listenBrainzFail(c, http.StatusBadRequest, "JSON document does not contain required track_metadata.artist_name and track_metadata.track_name.")
+			return
+		}
+		if request.ListenType != "playing_now" && listen.ListenedAt <= 0 {
+			listenBrainzFail(c, http.StatusBadRequest, "JSON document must contain the key listened_at at the top level.")
+			return
+		}
+	}
+	apiKeyService.TouchAPIKey(key.KeyID)
+
+	// Nothing is recorded until the track is submitted as listened
+	if request.ListenType == "playing_now" {
+		c.JSON(http.StatusOK, gin.H{"status": "ok"})
+		return
+	}
+
+	plays := make([]models.Play, 0, len(request.Payload))
+	for _, listen := range request.Payload {
+		device := "listenbrainz"
+		if client, ok := listen.TrackMetadata.AdditionalInfo["submission_client"].(string); ok && client != "" {
+			device = client
+		}
+		play, err := scrobblePlay(key.UserID, device, scrobble{
+			Artist:    strings.TrimSpace(listen.TrackMetadata.ArtistName),
+			Track:     strings.TrimSpace(listen.TrackMetadata.TrackName),
+			Album:     strings.TrimSpace(listen.TrackMetadata.ReleaseName),
+			Timestamp: time.Unix(listen.ListenedAt, 0),
+		}, songService)
+		if err != nil {
+			listenBrainzFail(c, http.StatusServiceUnavailable, "Failed to record listens.")
+			return
+		}
+		plays = append(plays, play)
+	}
+	playService.RecordPlays(plays)
+
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// ListenBrainzValidateTokenHandler implements ListenBrainz's validate-token,
+// which players call when the user enters their token.
+func ListenBrainzValidateTokenHandler(c *gin.Context, apiKeyService *services.APIKeyService, userService *services.UserService) {
+	key, ok := listenBrainzKey(c, apiKeyService)
+	if !ok {
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "message": "Token invalid.", "valid": false})
+		return
+	}
+	user, err := userService.GetUserByID(key.UserID)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "message": "Token invalid.", "valid": false})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"code": http.StatusOK, "message": "Token valid.", "valid": true, "user_name": user.Username})
+}
+
+// ExportHistoryHandler downloads the user's whole listening history as a
+// ListenBrainz listens export, which ListenBrainz and other services can
+// import
+func ExportHistoryHandler(c *gin.Context, playService *services.PlayService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	c.Header("Content-Type", "application/json")
+	c.Header("Content-Disposition", attachment("listens.json"))
+	c.Status(http.StatusOK)
+
+	// The history is streamed, so an error after the first listen can only
+	// be signalled by cutting the response short
+	w := c.Writer
+	first := true
+	w.WriteString("[")
+	err := playService.EachListen(c.Request.Context(), userID.(string), func(entry models.HistoryEntry) error {
+		data, err := json.Marshal(listenBrainzFromHistory(entry))
+		if err != nil {
+			return err
+		}
+		if !first {
+			w.WriteString(",")
+		}
+		first = false
+		_, err = w.Write(data)
+		return err
+	})
+	if err != nil {
+		c.Abort()
+		return
+	}
+	w.WriteString("]")
+}
+
+func listenBrainzFromHistory(entry models.HistoryEntry) listenBrainzListen {
+	metadata := listenBrainzTrackMetadata{
+		ArtistName:     entry.Artist,
+		TrackName:      entry.Title,
+		ReleaseName:    entry.Album,
+		AdditionalInfo: map[string]interface{}{"media_player": "ProjectPi"},
+	}
+	if entry.Song != nil {
+		metadata.ArtistName = entry.Song.Artist
+		metadata.TrackName = entry.Song.Title
+		metadata.ReleaseName = entry.Song.Album
+		if entry.Song.Duration > 0 {
+			metadata.AdditionalInfo["duration_ms"] = int64(entry.Song.Duration * 1000)
+		}
+	}
+	if entry.Device != "" {
+		metadata.AdditionalInfo["submission_client"] = entry.Device
+	}
+	return listenBrainzListen{
+		ListenedAt:    entry.Timestamp.Unix(),
+		TrackMetadata: metadata,
+	}
+}
+
+// listenBrainzKey authenticates the request by its "Authorization: Token"
+// header. Tokens in the query string aren't accepted, since URLs end up in
+// access logs.
+func listenBrainzKey(c *gin.Context, apiKeyService *services.APIKeyService) (*models.APIKey, bool) {
+	token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Token ")
+	if !ok {
+		return nil, false
+	}
+
+	key, err := apiKeyService.GetAPIKeyByKey(strings.TrimSpace(token))
+	if err != nil {
+		return nil, false
+	}
+	return key, true
+}
+
+func listenBrainzFail(c *gin.Context, status int, message string) {
+	c.JSON(status, gin.H{"code": status, "error": message})
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"net/http"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPlayEvents is the most events a player may send in one request.
+const maxPlayEvents = 100
+
+type playEventInput struct {
+	SongID     string    `json:"song_id" binding:"required"`
+	Event      string    `json:"event" binding:"required,oneof=start progress complete skip"`
+	PositionMs int64     `json:"position_ms" binding:"min=0"`
+	Device     string    `json:"device"`
+	SessionID  string    `json:"session_id"`
+	Timestamp  time.Time `json:"timestamp"`
+}
+
+// RecordPlaysHandler accepts a batch of play events from a player. Events
+// for songs the user doesn't own are rejected individually.
+func RecordPlaysHandler(c *gin.Context, playService *services.PlayService, songService *services.SongService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userIDStr, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var request struct {
+		Events []playEventInput `json:"events" binding:"required,min=1,dive"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Events) > maxPlayEvents {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many events in one request"})
+		return
+	}
+
+	plays, rejected, err := playsFromEvents(userIDStr, request.Events, songService)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to record plays"})
+		return
+	}
+	playService.RecordPlays(plays)
+
+	c.JSON(http.StatusAccepted, gin.H{"accepted": len(plays), "rejected": rejected})
+}
+
+// playsFromEvents turns player events into plays, returning the indexes of
+// events whose song the user doesn't own
+func playsFromEvents(userID string, events []playEventInput, songService *services.SongService) ([]models.Play, []int, error) {
+	songIDs := make([]string, 0, len(events))
+	for _, event := range events {
+		songIDs = append(songIDs, event.SongID)
+	}
+	songs, err := songService.GetSongsByIDs(userID, songIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	owned := make(map[string]bool, len(songs))
+	for _, song := range songs {
+		owned[song.SongID] = true
+	}
+
+	now := time.Now()
+	plays := make([]models.Play, 0, len(events))
+	rejected := []int{}
+	for i, event := range events {
+		if !owned[event.SongID] {
+			rejected = append(rejected, i)
+			continue
+		}
+		// Devices without a clock report no timestamp; ones with a wrong
+		// clock shouldn't create plays in the future
+		timestamp := event.Timestamp
+		if timestamp.IsZero() || timestamp.After(now) {
+			timestamp = now
+		}
+		plays = append(plays, models.Play{
+			UserID:     userID,
+			SongID:     event.SongID,
+			Event:      event.Event,
+			PositionMs: event.PositionMs,
+			Device:     event.Device,
+			SessionID:  event.SessionID,
+			Timestamp:  timestamp,
+		})
+	}
+	return plays, rejected, nil
+}
+
+// GetHistoryHandler returns the user's listening history, newest first,
+// paginated with ?page= and ?limit=
+func GetHistoryHandler(c *gin.Context, playService *services.PlayService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	page, limit := parsePagination(c)
+	history, total, err := playService.GetHistory(userID.(string), page, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch history"})
+		return
+	}
+	if history == nil {
+		history = []models.HistoryEntry{}
+	}
+
+	respondJSON(c, http.StatusOK, gin.H{
+		"history": history,
+		"page":    page,
+		"limit":   limit,
+		"total":   total,
+	}, time.Time{})
+}
+
+// UpdatePositionHandler stores where the user stopped in a song so another
+// device can resume there
+func UpdatePositionHandler(c *gin.Context, songService *services.SongService, playService *services.PlayService) {
+	song, ok := ownedSong(c, songService)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		PositionMs int64  `json:"position_ms" binding:"min=0"`
+		Completed  bool   `json:"completed"`
+		Device     string `json:"device"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	position := models.PlaybackPosition{
+		UserID:     song.UserID,
+		SongID:     song.SongID,
+		PositionMs: request.PositionMs,
+		Completed:  request.Completed,
+		Device:     request.Device,
+		UpdatedAt:  time.Now(),
+	}
+	if request.Completed {
+		position.PositionMs = 0
+	}
+	if err := playService.SavePosition(position); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save playback position"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Playback position saved"})
+}
+
+// ContinueListeningHandler lists songs the user stopped partway through,
+// most recent first, with the position to resume at
+func ContinueListeningHandler(c *gin.Context, playService *services.PlayService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	_, limit := parsePagination(c)
+	entries, err := playService.GetContinueListening(userID.(string), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch continue listening"})
+		return
+	}
+	if entries == nil {
+		entries = []models.ContinueListeningEntry{}
+	}
+
+	respondJSON(c, http.StatusOK, gin.H{"songs": entries}, time.Time{})
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"fmt"
+	"net/http"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxPlaylistBatch is the most songs one batch or import may touch.
+const maxPlaylistBatch = 1000
+
+// Statuses of the operations of a batch.
+const (
+	batchAdded   = "added"
+	batchRemoved = "removed"
+	batchFailed  = "failed"
+	// batchSkipped operations were valid but not applied, because another
+	// operation of an atomic batch failed
+	batchSkipped = "skipped"
+)
+
+type playlistBatchOperation struct {
+	Op      string `json:"op" binding:"required,oneof=add remove"`
+	SongID  string `json:"song_id"`
+	EntryID string `json:"entry_id"`
+	Note    string `json:"note" binding:"max=500"`
+}
+
+type playlistBatchResult struct {
+	Index   int    `json:"index"`
+	Status  string `json:"status"`
+	EntryID string `json:"entry_id,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BatchPlaylistSongsHandler adds and removes many songs in one request.
+// Removes are applied before adds, and the added songs are inserted in
+// order as a block before position, or appended. A remove by song_id
+// removes one occurrence of the song, the first in playlist order; list it
+// again to remove more. Each operation gets a result. With atomic set,
+// nothing is changed unless every operation is valid, and the changes are
+// applied in one transaction; a database that can't run transactions
+// refuses atomic batches.
+func BatchPlaylistSongsHandler(c *gin.Context, playlistService *services.PlaylistService, songService *services.SongService) {
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Operations []playlistBatchOperation `json:"operations" binding:"required,min=1,dive"`
+		Position   int                      `json:"position" binding:"min=0"`
+		Atomic     bool                     `json:"atomic"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(request.Operations) > maxPlaylistBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d operations per batch", maxPlaylistBatch)})
+		return
+	}
+	if request.Atomic && !playlistService.SupportsTransactions() {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Atomic batches need a database that supports transactions"})
+		return
+	}
+
+	userID := c.GetString("UserID")
+	var addIDs []string
+	for _, op := range request.Operations {
+		if op.Op == "add" && op.SongID != "" {
+			addIDs = append(addIDs, op.SongID)
+		}
+	}
+	owned := make(map[string]bool)
+	if len(addIDs) > 0 {
+		songs, err := songService.GetSongsByIDs(userID, addIDs)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get songs"})
+			return
+		}
+		for _, song := range songs {
+			owned[song.SongID] = true
+		}
+	}
+
+	entries, err := playlistService.GetPlaylistSongs(playlist.PlaylistID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get playlist songs"})
+		return
+	}
+	entryIDs := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		entryIDs[entry.EntryID] = true
+	}
+	// Removing by song takes out its first occurrence in playlist order,
+	// like RemoveSongFromPlaylistHandler, skipping entries removed by ID
+	named := make(map[string]bool)
+	for _, op := range request.Operations {
+		if op.Op == "remove" && op.EntryID != "" {
+			named[op.EntryID] = true
+		}
+	}
+	occurrences := make(map[string][]string)
+	for _, entry := range entries {
+		if !named[entry.EntryID] {
+			occurrences[entry.SongID] = append(occurrences[entry.SongID], entry.EntryID)
+		}
+	}
+
+	results := make([]playlistBatchResult, len(request.Operations))
+	var adds []*models.PlaylistSong
+	var addIndexes []int
+	var removeEntryIDs []string
+	failed := false
+	for i, op := range request.Operations {
+		results[i] = playlistBatchResult{Index: i, EntryID: op.EntryID}
+		switch {
+		case op.Op == "add" && !owned[op.SongID]:
+			results[i].Error = "Song not found"
+		case op.Op == "add":
+			adds = append(adds, &models.PlaylistSong{
+				SongID:  op.SongID,
+				AddedBy: userID,
+				Note:    op.Note,
+			})
+			addIndexes = append(addIndexes, i)
+			results[i].Status = batchAdded
+		case op.EntryID != "" && !entryIDs[op.EntryID]:
+			results[i].Error = "Entry not found"
+		case op.EntryID != "":
+			// Listing an entry twice removes it once
+			delete(entryIDs, op.EntryID)
+			removeEntryIDs = append(removeEntryIDs, op.EntryID)
+			results[i].Status = batchRemoved
+		case op.SongID != "" && len(occurrences[op.SongID]) == 0:
+			results[i].Error = "Song not in playlist"
+		case op.SongID != "":
+			results[i].EntryID = occurrences[op.SongID][0]
+			occurrences[op.SongID] = occurrences[op.SongID][1:]
+			delete(entryIDs, results[i].EntryID)
+			removeEntryIDs = append(removeEntryIDs, results[i].EntryID)
+			results[i].Status = batchRemoved
+		default:
+			results[i].Error = "entry_id or song_id is required"
+		}
+		if results[i].Error != "" {
+			results[i].Status = batchFailed
+			failed = true
+		}
+	}
+
+	if failed && request.Atomic {
+		for i := range results {
+			if results[i].Status != batchFailed {
+				results[i].Status = batchSkipped
+			}
+		}
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Some operations are invalid, nothing was changed", "results": results})
+		return
+	}
+
+	if err := playlistService.BatchUpdate(playlist.PlaylistID, adds, request.Position, removeEntryIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update playlist"})
+		return
+	}
+	for i, entry := range adds {
+		results[addIndexes[i]].EntryID = entry.EntryID
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+// ImportPlaylistSongsHandler adds the caller's songs from another playlist
+// they can see, or every result of a search of their songs, to the
+// playlist in order.
+func ImportPlaylistSongsHandler(c *gin.Context, playlistService *services.PlaylistService, songService *services.SongService) {
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
+		return
+	}
+
+	// SkipDuplicates leaves out songs the playlist already has
+	var request struct {
+		PlaylistID     string `json:"playlist_id"`
+		Query          string `json:"query"`
+		Position       int    `json:"position" binding:"min=0"`
+		SkipDuplicates bool   `json:"skip_duplicates"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if (request.PlaylistID == "") == (request.Query == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either playlist_id or query is required"})
+		return
+	}
+
+	userID := c.GetString("UserID")
+	var songIDs []string
+	if request.PlaylistID != "" {
+		source, err := playlistService.GetPlaylistByID(request.PlaylistID)
+		if err != nil || !canAccessPlaylist(source, userID, models.PlaylistRolePublic) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Playlist not found"})
+			return
+		}
+		entries, err := playlistService.GetPlaylistContents(source)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get playlist songs"})
+			return
+		}
+		// An entry's song belongs to whoever added it
+		for _, entry := range entries {
+			if !entry.Unavailable && entry.AddedBy == userID {
+				songIDs = append(songIDs, entry.SongID)
+			}
+		}
+	} else {
+		songs, err := songService.SearchSongs(request.Query, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search songs"})
+			return
+		}
+		for _, song := range songs {
+			songIDs = append(songIDs, song.SongID)
+		}
+	}
+
+	skip := make(map[string]bool)
+	if request.SkipDuplicates {
+		entries, err := playlistService.GetPlaylistSongs(playlist.PlaylistID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get playlist songs"})
+			return
+		}
+		for _, entry := range entries {
+			skip[entry.SongID] = true
+		}
+	}
+
+	var adds []*models.PlaylistSong
+	skipped := 0
+	for _, songID := range songIDs {
+		if skip[songID] {
+			skipped++
+			continue
+		}
+		if request.SkipDuplicates {
+			skip[songID] = true
+		}
+		adds = append(adds, &models.PlaylistSong{SongID: songID, AddedBy: userID})
+	}
+	if len(adds) > maxPlaylistBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d songs can be added at once", maxPlaylistBatch)})
+		return
+	}
+
+	if err := playlistService.BatchUpdate(playlist.PlaylistID, adds, request.Position, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add songs to playlist"})
+		return
+	}
+
+	entryIDs := make([]string, 0, len(adds))
+	for _, entry := range adds {
+		entryIDs = append(entryIDs, entry.EntryID)
+	}
+	c.JSON(http.StatusOK, gin.H{"added": len(adds), "skipped": skipped, "entry_ids": entryIDs})
+}
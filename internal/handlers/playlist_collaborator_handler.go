@@ -0,0 +1,144 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ListPlaylistCollaboratorsHandler lists the playlist's owner and
+// collaborators with their usernames
+func ListPlaylistCollaboratorsHandler(c *gin.Context, playlistService *services.PlaylistService, userService *services.UserService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleViewer)
+	if !ok {
+		return
+	}
+
+	userIDs := []string{playlist.UserID}
+	for _, collaborator := range playlist.Collaborators {
+		userIDs = append(userIDs, collaborator.UserID)
+	}
+	users, err := userService.GetUsersByIDs(userIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch collaborators"})
+		return
+	}
+	usernames := make(map[string]string, len(users))
+	for _, user := range users {
+		usernames[user.UserID] = user.Username
+	}
+
+	members := make([]gin.H, 0, len(playlist.Collaborators)+1)
+	members = append(members, playlistMemberJSON(usernames, playlist.UserID, models.PlaylistRoleOwner, playlist.CreatedAt))
+	for _, collaborator := range playlist.Collaborators {
+		members = append(members, playlistMemberJSON(usernames, collaborator.UserID, collaborator.Role, collaborator.AddedAt))
+	}
+
+	c.JSON(http.StatusOK, gin.H{"members": members})
+}
+
+// AddPlaylistCollaboratorHandler invites a user, by username, as an editor
+// or viewer. Inviting an existing collaborator changes their role.
+func AddPlaylistCollaboratorHandler(c *gin.Context, playlistService *services.PlaylistService, userService *services.UserService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Username string `json:"username" binding:"required"`
+		Role     string `json:"role" binding:"required,oneof=editor viewer"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	user, err := userService.GetUserByUsername(request.Username)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if user.UserID == playlist.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The owner can't be a collaborator"})
+		return
+	}
+
+	if err := playlistService.SetCollaborator(playlist.PlaylistID, user.UserID, request.Role); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add collaborator"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Collaborator added", "user_id": user.UserID, "role": request.Role})
+}
+
+// UpdatePlaylistCollaboratorHandler changes a collaborator's role
+func UpdatePlaylistCollaboratorHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+	userID := c.Param("userId")
+
+	var request struct {
+		Role string `json:"role" binding:"required,oneof=editor viewer"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if userID == playlist.UserID || playlistRole(playlist, userID) == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collaborator not found"})
+		return
+	}
+
+	if err := playlistService.SetCollaborator(playlist.PlaylistID, userID, request.Role); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update collaborator"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Collaborator updated"})
+}
+
+// RemovePlaylistCollaboratorHandler removes a collaborator. The owner may
+// remove anyone; a collaborator may only remove themselves, to leave the
+// playlist.
+func RemovePlaylistCollaboratorHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleViewer)
+	if !ok {
+		return
+	}
+	userID := c.Param("userId")
+
+	caller := c.GetString("UserID")
+	if caller != playlist.UserID && caller != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	err := playlistService.RemoveCollaborator(playlist.PlaylistID, userID)
+	if errors.Is(err, services.ErrCollaboratorNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Collaborator not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove collaborator"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Collaborator removed"})
+}
+
+// playlistMemberJSON renders a member; usernames holds those looked up,
+// and a member missing from it has no username
+func playlistMemberJSON(usernames map[string]string, userID string, role string, addedAt time.Time) gin.H {
+	return gin.H{"UserID": userID, "Username": usernames[userID], "Role": role, "AddedAt": addedAt}
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DuplicatePlaylistHandler copies one of the user's playlists. The copy is
+// named {"name"}, or after the original with " (copy)". Collaborators'
+// songs are replaced by the user's own copies; "unmatched" counts those the
+// user has none of.
+func DuplicatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+
+	name, ok := copyName(c, playlist.Name+" (copy)")
+	if !ok {
+		return
+	}
+
+	duplicate, unmatched, err := playlistService.DuplicatePlaylist(playlist, name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to duplicate playlist"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"playlist": duplicate, "unmatched": unmatched})
+}
+
+// ForkPlaylistHandler copies a playlist the user can see but doesn't own,
+// e.g. a public one or one they collaborate on, into their own library.
+// Other members' songs are replaced by the user's own copies; "unmatched"
+// counts those the user has none of.
+func ForkPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRolePublic)
+	if !ok {
+		return
+	}
+	forkPlaylist(c, playlistService, playlist)
+}
+
+// ForkSharedPlaylistHandler copies a playlist shared through a share link
+// into the user's library
+func ForkSharedPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, err := playlistService.GetSharedPlaylist(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+		return
+	}
+	forkPlaylist(c, playlistService, playlist)
+}
+
+func forkPlaylist(c *gin.Context, playlistService *services.PlaylistService, playlist *models.Playlist) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	name, ok := copyName(c, playlist.Name)
+	if !ok {
+		return
+	}
+
+	fork, unmatched, err := playlistService.ForkPlaylist(playlist, userID.(string), name)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fork playlist"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"playlist": fork, "unmatched": unmatched})
+}
+
+// MergePlaylistHandler appends the songs in {"source_id"} that the playlist
+// doesn't have yet, with other members' songs replaced by the caller's own
+// copies; "unmatched" counts those the caller has none of. With
+// {"delete_source": true} the source playlist is deleted along with the
+// merge, which only its owner may do.
+func MergePlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
+		return
+	}
+	userID := c.GetString("UserID")
+
+	var request struct {
+		SourceID     string `json:"source_id" binding:"required"`
+		DeleteSource bool   `json:"delete_source"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.SourceID == playlist.PlaylistID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Can't merge a playlist into itself"})
+		return
+	}
+
+	source, err := playlistService.GetPlaylistByID(request.SourceID)
+	if err != nil || !canAccessPlaylist(source, userID, models.PlaylistRolePublic) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Playlist not found"})
+		return
+	}
+	if request.DeleteSource && source.UserID != userID {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can delete the source playlist"})
+		return
+	}
+
+	added, skipped, unmatched, err := playlistService.MergePlaylists(playlist, source, userID, request.DeleteSource)
+	if errors.Is(err, services.ErrSmartPlaylist) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Can't merge into a smart playlist"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge playlists"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"added": added, "skipped": skipped, "unmatched": unmatched})
+}
+
+// copyName reads the optional {"name"} of a copy, defaulting to fallback
+func copyName(c *gin.Context, fallback string) (string, bool) {
+	var request struct {
+		Name string `json:"name"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return "", false
+		}
+	}
+	if request.Name == "" {
+		return fallback, true
+	}
+	return request.Name, true
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"fmt"
+	"strings"
+
+	"projectpi-backend/internal/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// playlistField is a field clients can pick with ?fields= on a playlist:
+// its JSON key and how to read it.
+type playlistField struct {
+	key   string
+	entry func(e *models.PlaylistEntry) interface{}
+	song  func(s *models.Song) interface{}
+}
+
+// playlistFields are keyed by their ?fields= name. Song fields are named
+// after their bson field, so they also select what is loaded.
+var playlistFields = map[string]playlistField{
+	"song_id":  {key: "SongID", entry: func(e *models.PlaylistEntry) interface{} { return e.SongID }},
+	"rank":     {key: "Rank", entry: func(e *models.PlaylistEntry) interface{} { return e.Rank }},
+	"added_by": {key: "AddedBy", entry: func(e *models.PlaylistEntry) interface{} { return e.AddedBy }},
+	"added_at": {key: "AddedAt", entry: func(e *models.PlaylistEntry) interface{} { return e.AddedAt }},
+	"note":     {key: "Note", entry: func(e *models.PlaylistEntry) interface{} { return e.Note }},
+
+	"title":        {key: "Title", song: func(s *models.Song) interface{} { return s.Title }},
+	"artist":       {key: "Artist", song: func(s *models.Song) interface{} { return s.Artist }},
+	"album":        {key: "Album", song: func(s *models.Song) interface{} { return s.Album }},
+	"genre":        {key: "Genre", song: func(s *models.Song) interface{} { return s.Genre }},
+	"duration":     {key: "Duration", song: func(s *models.Song) interface{} { return s.Duration }},
+	"artwork_id":   {key: "ArtworkID", song: func(s *models.Song) interface{} { return s.ArtworkID }},
+	"format":       {key: "Format", song: func(s *models.Song) interface{} { return s.Format }},
+	"content_type": {key: "ContentType", song: func(s *models.Song) interface{} { return s.ContentType }},
+	"bitrate":      {key: "Bitrate", song: func(s *models.Song) interface{} { return s.Bitrate }},
+	"loudness":     {key: "Loudness", song: func(s *models.Song) interface{} { return s.Loudness }},
+}
+
+// defaultPlaylistFields are returned when ?fields= is not given.
+const defaultPlaylistFields = "song_id,added_by,added_at,note,title,artist,album,duration,artwork_id"
+
+// parsePlaylistFields splits a comma-separated ?fields= value into entry
+// and song field names.
+func parsePlaylistFields(fields string) ([]string, []string, error) {
+	if fields == "" {
+		fields = defaultPlaylistFields
+	}
+	var entryFields, songFields []string
+	for _, name := range strings.Split(fields, ",") {
+		name = strings.TrimSpace(name)
+		field, ok := playlistFields[name]
+		switch {
+		case name == "":
+			continue
+		case !ok:
+			return nil, nil, fmt.Errorf("unknown field %q", name)
+		case field.song != nil:
+			songFields = append(songFields, name)
+		default:
+			entryFields = append(entryFields, name)
+		}
+	}
+	return entryFields, songFields, nil
+}
+
+// playlistEntryJSON renders an entry with the chosen fields. The entry ID,
+// position and availability are always included, and for an entry whose
+// song was deleted, what the song was.
+func playlistEntryJSON(entry *models.PlaylistEntry, entryFields []string, songFields []string) gin.H {
+	out := gin.H{
+		"EntryID":     entry.EntryID,
+		"Position":    entry.Position,
+		"Unavailable": entry.Unavailable,
+	}
+	for _, name := range entryFields {
+		field := playlistFields[name]
+		out[field.key] = field.entry(entry)
+	}
+	if entry.Unavailable {
+		if entry.Deleted != nil {
+			out["Deleted"] = gin.H{
+				"Title":    entry.Deleted.Title,
+				"Artist":   entry.Deleted.Artist,
+				"Duration": entry.Deleted.Duration,
+			}
+		} else {
+			// Don't hand out the ID of a song that exists but isn't
+			// the adder's to share
+			delete(out, "SongID")
+		}
+	}
+
+	if len(songFields) > 0 {
+		var song gin.H
+		if entry.Song != nil {
+			song = gin.H{}
+			for _, name := range songFields {
+				field := playlistFields[name]
+				song[field.key] = field.song(entry.Song)
+			}
+		}
+		out["Song"] = song
+	}
+	return out
+}
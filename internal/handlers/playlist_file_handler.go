@@ -0,0 +1,296 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/playlistfile"
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/signing"
+	"projectpi-backend/internal/utils"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// maxPlaylistFileSize is the largest playlist file accepted for import
+	maxPlaylistFileSize = 5 << 20
+	// importDurationTolerance is how far apart, in seconds, a track's and a
+	// song's durations may be for them to match
+	importDurationTolerance = 3
+)
+
+// ExportPlaylistHandler downloads a playlist as ?format=m3u8 (default), pls
+// or xspf. With ?paths=stream entries are signed stream URLs valid for a
+// day, for players on other machines, and only the caller's own songs are
+// included; by default they are the songs' original file names, for
+// players next to the user's music folder.
+func ExportPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService, songService *services.SongService, signer *signing.Signer) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleViewer)
+	if !ok {
+		return
+	}
+
+	format, ok := playlistfile.ByName(c.DefaultQuery("format", playlistfile.M3U8.Name))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be m3u8, m3u, pls or xspf"})
+		return
+	}
+	paths := c.DefaultQuery("paths", "relative")
+	if paths != "relative" && paths != "stream" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "paths must be relative or stream"})
+		return
+	}
+
+	entries, err := playlistService.GetPlaylistContents(playlist)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
+		return
+	}
+	songs, err := entrySongs(songService, entries)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch songs"})
+		return
+	}
+
+	userID := c.GetString("UserID")
+	expiresAt := time.Now().Add(maxStreamURLTTL)
+	tracks := make([]playlistfile.Track, 0, len(songs))
+	for _, song := range songs {
+		location := song.Filename
+		if paths == "stream" {
+			// A URL signed for another member's song would hand it to
+			// whoever the file is passed on to
+			if song.UserID != userID {
+				continue
+			}
+			location = signedStreamURL(c, signer, song.SongID, song.UserID, expiresAt)
+		}
+		tracks = append(tracks, playlistfile.Track{
+			Location: location,
+			Title:    song.Title,
+			Artist:   song.Artist,
+			Album:    song.Album,
+			Duration: song.Duration,
+		})
+	}
+
+	c.Header("Content-Type", format.ContentType)
+	c.Header("Content-Disposition", attachment(safeFilename(playlist.Name)+format.Ext))
+	c.Status(http.StatusOK)
+	if err := format.Write(c.Writer, playlist.Name, tracks); err != nil {
+		log.Printf("Failed to export playlist %s: %v", playlist.PlaylistID, err)
+	}
+}
+
+// ImportPlaylistHandler creates a playlist from an uploaded M3U/M3U8, PLS
+// or XSPF file ("file"), named "name" or after the file. Entries are
+// matched to the user's songs by file name, then by title, artist and
+// duration; the ones that match nothing are listed in the response.
+func ImportPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService, songService *services.SongService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	userIDStr := userID.(string)
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+		return
+	}
+	if file.Size > maxPlaylistFileSize {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "File too large (max 5MB)"})
+		return
+	}
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+		return
+	}
+	defer src.Close()
+	data, err := io.ReadAll(io.LimitReader(src, maxPlaylistFileSize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+		return
+	}
+
+	format, ok := playlistfile.Detect(file.Filename, data)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown playlist format, use m3u, m3u8, pls or xspf"})
+		return
+	}
+	title, tracks, err := format.Parse(data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid %s file: %v", format.Name, err)})
+		return
+	}
+	if len(tracks) > maxPlaylistBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("At most %d entries can be imported", maxPlaylistBatch)})
+		return
+	}
+
+	name := c.PostForm("name")
+	if name == "" {
+		name = title
+	}
+	if name == "" {
+		name = strings.TrimSuffix(filepath.Base(file.Filename), filepath.Ext(file.Filename))
+	}
+
+	library, err := songService.GetSongsByUserID(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch songs"})
+		return
+	}
+	matcher := newSongMatcher(library)
+
+	var adds []*models.PlaylistSong
+	unmatched := []gin.H{}
+	for i, track := range tracks {
+		song := matcher.match(track)
+		if song == nil {
+			unmatched = append(unmatched, gin.H{
+				"Position": i + 1,
+				"Location": track.Location,
+				"Title":    track.Title,
+				"Artist":   track.Artist,
+			})
+			continue
+		}
+		adds = append(adds, &models.PlaylistSong{SongID: song.SongID, AddedBy: userIDStr})
+	}
+
+	playlist := models.Playlist{
+		PlaylistID: utils.GeneratePlaylistID(),
+		Name:       name,
+		UserID:     userIDStr,
+	}
+	if err := playlistService.CreatePlaylist(&playlist); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create playlist"})
+		return
+	}
+	if err := playlistService.BatchUpdate(playlist.PlaylistID, adds, 0, nil); err != nil {
+		// Don't leave an empty playlist behind
+		if err := playlistService.DeletePlaylist(playlist.PlaylistID); err != nil {
+			log.Printf("Failed to remove playlist %s after a failed import: %v", playlist.PlaylistID, err)
+		}
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add songs to playlist"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"playlist":  playlist,
+		"added":     len(adds),
+		"unmatched": unmatched,
+	})
+}
+
+// entrySongs resolves playlist entries to their songs in order, skipping
+// unavailable ones and songs that don't belong to whoever added the entry.
+func entrySongs(songService *services.SongService, entries []models.PlaylistSong) ([]*models.Song, error) {
+	byOwner := make(map[string][]string)
+	for _, entry := range entries {
+		if !entry.Unavailable {
+			byOwner[entry.AddedBy] = append(byOwner[entry.AddedBy], entry.SongID)
+		}
+	}
+	found := make(map[string]*models.Song)
+	for owner, songIDs := range byOwner {
+		songs, err := songService.GetSongsByIDs(owner, songIDs)
+		if err != nil {
+			return nil, err
+		}
+		for i := range songs {
+			found[songs[i].SongID] = &songs[i]
+		}
+	}
+
+	songs := make([]*models.Song, 0, len(entries))
+	for _, entry := range entries {
+		if song, ok := found[entry.SongID]; ok && !entry.Unavailable && song.UserID == entry.AddedBy {
+			songs = append(songs, song)
+		}
+	}
+	return songs, nil
+}
+
+// songMatcher matches playlist file tracks to songs in a user's library.
+type songMatcher struct {
+	byID       map[string]*models.Song
+	byFilename map[string]*models.Song
+	byTitle    map[string][]*models.Song
+}
+
+func newSongMatcher(songs []models.Song) *songMatcher {
+	m := &songMatcher{
+		byID:       make(map[string]*models.Song, len(songs)),
+		byFilename: make(map[string]*models.Song, len(songs)),
+		byTitle:    make(map[string][]*models.Song, len(songs)),
+	}
+	for i := range songs {
+		song := &songs[i]
+		m.byID[song.SongID] = song
+		m.byFilename[strings.ToLower(song.Filename)] = song
+		title := matchKey(song.Title)
+		m.byTitle[title] = append(m.byTitle[title], song)
+	}
+	return m
+}
+
+// match returns the song a track refers to, or nil. Stream URLs exported
+// from ProjectPi match their song directly.
+func (m *songMatcher) match(track playlistfile.Track) *models.Song {
+	location := strings.ReplaceAll(track.Location, `\`, "/")
+	// A one letter scheme is a Windows drive, e.g. C:/Music
+	if u, err := url.Parse(location); err == nil && len(u.Scheme) > 1 {
+		location = u.Path
+		parts := strings.Split(u.Path, "/")
+		for i := 0; i+1 < len(parts); i++ {
+			if song, ok := m.byID[parts[i+1]]; ok && parts[i] == "stream" {
+				return song
+			}
+		}
+	}
+	if unescaped, err := url.PathUnescape(location); err == nil {
+		location = unescaped
+	}
+	if song, ok := m.byFilename[strings.ToLower(path.Base(location))]; ok {
+		return song
+	}
+
+	title := track.Title
+	if title == "" {
+		base := path.Base(location)
+		title = strings.TrimSuffix(base, path.Ext(base))
+	}
+	var best *models.Song
+	bestDiff := math.Inf(1)
+	for _, song := range m.byTitle[matchKey(title)] {
+		if track.Artist != "" && matchKey(song.Artist) != matchKey(track.Artist) {
+			continue
+		}
+		diff := 0.0
+		if track.Duration > 0 && song.Duration > 0 {
+			diff = math.Abs(track.Duration - song.Duration)
+		}
+		if diff <= importDurationTolerance && diff < bestDiff {
+			best, bestDiff = song, diff
+		}
+	}
+	return best
+}
+
+func matchKey(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
@@ -1,22 +1,26 @@
 package handlers
 
 import (
-	"fmt"
+	"errors"
 	"net/http"
 	"time"
 
 	"projectpi-backend/internal/models"
 	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/utils"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-// CreatePlaylistHandler creates a new playlist
+// CreatePlaylistHandler creates a new playlist, or a smart playlist when
+// rules are given (see SetPlaylistRulesHandler)
 func CreatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
 	var request struct {
-		Name        string `json:"name" binding:"required"`
-		Description string `json:"description"`
+		Name        string             `json:"name" binding:"required"`
+		Description string             `json:"description"`
+		Visibility  string             `json:"visibility" binding:"omitempty,oneof=private unlisted public"`
+		Smart       *smartRulesRequest `json:"smart"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -24,6 +28,15 @@ func CreatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistSer
 		return
 	}
 
+	var smart *models.SmartRules
+	if request.Smart != nil {
+		var err error
+		if smart, err = request.Smart.smartRules(); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
 	// Get user ID from context (set by AuthMiddleware)
 	userID, exists := c.Get("UserID")
 	if !exists {
@@ -32,13 +45,15 @@ func CreatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistSer
 	}
 
 	// Generate playlist ID
-	playlistID := fmt.Sprintf("PLAYLIST-%d-%d", time.Now().Unix(), time.Now().UnixNano()%1000000)
+	playlistID := utils.GeneratePlaylistID()
 
 	playlist := models.Playlist{
 		PlaylistID:  playlistID,
 		Name:        request.Name,
 		Description: request.Description,
 		UserID:      userID.(string),
+		Visibility:  request.Visibility,
+		Smart:       smart,
 	}
 
 	if err := playlistService.CreatePlaylist(&playlist); err != nil {
@@ -49,7 +64,8 @@ func CreatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistSer
 	c.JSON(http.StatusCreated, playlist)
 }
 
-// ListPlaylistsHandler lists all playlists for the authenticated user
+// ListPlaylistsHandler lists the playlists the authenticated user owns or
+// collaborates on
 func ListPlaylistsHandler(c *gin.Context, playlistService *services.PlaylistService) {
 	userID, exists := c.Get("UserID")
 	if !exists {
@@ -63,69 +79,80 @@ func ListPlaylistsHandler(c *gin.Context, playlistService *services.PlaylistServ
 		return
 	}
 
-	c.JSON(http.StatusOK, playlists)
+	respondJSON(c, http.StatusOK, playlists, newest(playlists, func(p models.Playlist) time.Time { return p.UpdatedAt }))
 }
 
-// GetPlaylistHandler retrieves a specific playlist with its songs
+// GetPlaylistHandler retrieves a specific playlist with a page of its
+// entries (?page=, ?limit=), each joined with its song. ?fields= picks the
+// entry and song fields returned, e.g. ?fields=title,artist,duration.
+// Entries whose song was deleted, or isn't the song of whoever added the
+// entry, are flagged unavailable and have no song; unavailable counts them
+// across the whole playlist. Role is the caller's.
 func GetPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
-	playlistID := c.Param("id")
-
-	userID, exists := c.Get("UserID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRolePublic)
+	if !ok {
 		return
 	}
+	role := playlistRole(playlist, c.GetString("UserID"))
 
-	playlist, err := playlistService.GetPlaylistByID(playlistID)
+	entryFields, songFields, err := parsePlaylistFields(c.Query("fields"))
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-
-	// Check if playlist belongs to user
-	if playlist.UserID != userID.(string) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		return
+	var playlistJSON interface{} = playlist
+	if role == models.PlaylistRolePublic {
+		// Non-members get the share view of the playlist
+		playlistJSON = publicPlaylistJSON(playlist)
+		entryFields = publicEntryFields(entryFields)
 	}
 
-	// Get songs in playlist
-	playlistSongs, err := playlistService.GetPlaylistSongs(playlistID)
+	page, limit := parsePagination(c)
+	entries, total, err := playlistService.GetPlaylistEntries(playlist, songFields, page, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
 		return
 	}
-
-	c.JSON(http.StatusOK, gin.H{
-		"playlist": playlist,
-		"songs":    playlistSongs,
-	})
-}
-
-// UpdatePlaylistHandler updates a playlist's name or description
-func UpdatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
-	playlistID := c.Param("id")
-
-	userID, exists := c.Get("UserID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	unavailable, err := playlistService.CountUnavailableEntries(playlist)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
 		return
 	}
 
-	playlist, err := playlistService.GetPlaylistByID(playlistID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
-		return
+	songs := make([]gin.H, 0, len(entries))
+	for i := range entries {
+		songs = append(songs, playlistEntryJSON(&entries[i], entryFields, songFields))
+	}
+	modTime := playlist.UpdatedAt
+	if playlist.Smart != nil {
+		// A smart playlist's songs change with the owner's library
+		modTime = time.Time{}
 	}
 
-	// Check ownership
-	if playlist.UserID != userID.(string) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	respondJSON(c, http.StatusOK, gin.H{
+		"playlist":    playlistJSON,
+		"role":        role,
+		"songs":       songs,
+		"page":        page,
+		"limit":       limit,
+		"total":       total,
+		"unavailable": unavailable,
+	}, modTime)
+}
+
+// UpdatePlaylistHandler updates a playlist's name, description or artwork,
+// or, for the owner, its visibility
+func UpdatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistService, imageService *services.ImageService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleEditor)
+	if !ok {
 		return
 	}
 
 	var request struct {
 		Name        string `json:"name"`
 		Description string `json:"description"`
+		ArtworkID   string `json:"artwork_id"`
+		Visibility  string `json:"visibility" binding:"omitempty,oneof=private unlisted public"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -140,8 +167,22 @@ func UpdatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistSer
 	if request.Description != "" {
 		updates["description"] = request.Description
 	}
+	if request.ArtworkID != "" {
+		if !ownsImage(imageService, request.ArtworkID, c.GetString("UserID")) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Artwork image not found"})
+			return
+		}
+		updates["artwork_id"] = request.ArtworkID
+	}
+	if request.Visibility != "" {
+		if !canAccessPlaylist(playlist, c.GetString("UserID"), models.PlaylistRoleOwner) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Only the owner can change visibility"})
+			return
+		}
+		updates["visibility"] = request.Visibility
+	}
 
-	if err := playlistService.UpdatePlaylist(playlistID, updates); err != nil {
+	if err := playlistService.UpdatePlaylist(playlist.PlaylistID, updates); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update playlist"})
 		return
 	}
@@ -151,59 +192,120 @@ func UpdatePlaylistHandler(c *gin.Context, playlistService *services.PlaylistSer
 
 // DeletePlaylistHandler deletes a playlist and all its songs
 func DeletePlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
-	playlistID := c.Param("id")
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
 
-	userID, exists := c.Get("UserID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	if err := playlistService.DeletePlaylist(playlist.PlaylistID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete playlist"})
 		return
 	}
 
-	playlist, err := playlistService.GetPlaylistByID(playlistID)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+	c.JSON(http.StatusOK, gin.H{"message": "Playlist deleted"})
+}
+
+// AddSongToPlaylistHandler adds one of the caller's songs to a playlist
+// they can edit. The same song may be added more than once; each addition
+// is a separate entry.
+func AddSongToPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService, songService *services.SongService) {
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
 		return
 	}
 
-	// Check ownership
-	if playlist.UserID != userID.(string) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	// Position inserts the song before the entry at that position (1-based);
+	// without one the song is appended
+	var request struct {
+		SongID   string `json:"song_id" binding:"required"`
+		Position int    `json:"position" binding:"min=0"`
+		Note     string `json:"note" binding:"max=500"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if err := playlistService.DeletePlaylist(playlistID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete playlist"})
+	userID := c.GetString("UserID")
+	song, err := songService.GetSongByID(request.SongID)
+	if err != nil || song.UserID != userID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Song not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Playlist deleted"})
+	entry := models.PlaylistSong{
+		PlaylistID: playlist.PlaylistID,
+		SongID:     request.SongID,
+		AddedBy:    userID,
+		Note:       request.Note,
+	}
+	if err := playlistService.AddSongToPlaylist(&entry, request.Position); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add song to playlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Song added to playlist", "entry": entry})
 }
 
-// AddSongToPlaylistHandler adds a song to a playlist
-func AddSongToPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
-	playlistID := c.Param("id")
+// ReorderPlaylistSongsHandler moves one entry with {"entry_id", "to"} or
+// {"from", "to"}, or reorders the whole playlist with {"order"}: the IDs of
+// all entries in their new order. Positions are 1-based.
+func ReorderPlaylistSongsHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
+		return
+	}
 
-	userID, exists := c.Get("UserID")
-	if !exists {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+	var request struct {
+		EntryID string   `json:"entry_id"`
+		From    int      `json:"from"`
+		To      int      `json:"to"`
+		Order   []string `json:"order"`
+	}
+
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	playlist, err := playlistService.GetPlaylistByID(playlistID)
+	var err error
+	switch {
+	case request.Order != nil:
+		err = playlistService.ReorderSongs(playlist.PlaylistID, request.Order)
+	case request.EntryID != "" && request.To > 0:
+		err = playlistService.MoveEntry(playlist.PlaylistID, request.EntryID, request.To)
+	case request.From > 0 && request.To > 0:
+		err = playlistService.MoveSong(playlist.PlaylistID, request.From, request.To)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "entry_id or from, and to, or order are required"})
+		return
+	}
+	if playlistEntryError(c, err, "Failed to reorder playlist") {
+		return
+	}
+
+	playlistSongs, err := playlistService.GetPlaylistSongs(playlist.PlaylistID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
 		return
 	}
 
-	// Check ownership
-	if playlist.UserID != userID.(string) {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+	c.JSON(http.StatusOK, gin.H{"songs": playlistSongs})
+}
+
+// UpdatePlaylistEntryHandler changes an entry's note, or moves it with
+// {"position"}
+func UpdatePlaylistEntryHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
 		return
 	}
+	entryID := c.Param("entryId")
 
 	var request struct {
-		SongID   string `json:"song_id" binding:"required"`
-		Position int    `json:"position"`
+		Note     *string `json:"note" binding:"omitempty,max=500"`
+		Position int     `json:"position" binding:"min=0"`
 	}
 
 	if err := c.ShouldBindJSON(&request); err != nil {
@@ -211,47 +313,141 @@ func AddSongToPlaylistHandler(c *gin.Context, playlistService *services.Playlist
 		return
 	}
 
-	// Get current songs to determine position if not specified
-	if request.Position == 0 {
-		playlistSongs, _ := playlistService.GetPlaylistSongs(playlistID)
-		request.Position = len(playlistSongs) + 1
+	if request.Note != nil {
+		err := playlistService.UpdateEntry(playlist.PlaylistID, entryID, bson.M{"note": *request.Note})
+		if playlistEntryError(c, err, "Failed to update playlist entry") {
+			return
+		}
+	}
+	if request.Position > 0 {
+		err := playlistService.MoveEntry(playlist.PlaylistID, entryID, request.Position)
+		if playlistEntryError(c, err, "Failed to move playlist entry") {
+			return
+		}
 	}
 
-	if err := playlistService.AddSongToPlaylist(playlistID, request.SongID, request.Position); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add song to playlist"})
+	entry, err := playlistService.GetEntry(playlist.PlaylistID, entryID)
+	if playlistEntryError(c, err, "Failed to fetch playlist entry") {
+		return
+	}
+
+	c.JSON(http.StatusOK, entry)
+}
+
+// RemovePlaylistEntryHandler removes one entry from a playlist, leaving any
+// other entries of the same song
+func RemovePlaylistEntryHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Song added to playlist"})
+	err := playlistService.RemoveEntry(playlist.PlaylistID, c.Param("entryId"))
+	if playlistEntryError(c, err, "Failed to remove song from playlist") {
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Song removed from playlist"})
 }
 
-// RemoveSongFromPlaylistHandler removes a song from a playlist
+// RemoveSongFromPlaylistHandler removes a song from a playlist. If the song
+// is in the playlist more than once, its first entry is removed; use
+// RemovePlaylistEntryHandler to choose which.
 func RemoveSongFromPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService) {
-	playlistID := c.Param("id")
-	songID := c.Param("songId")
+	playlist, ok := editablePlaylist(c, playlistService)
+	if !ok {
+		return
+	}
+
+	if err := playlistService.RemoveSongFromPlaylist(playlist.PlaylistID, c.Param("songId")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove song from playlist"})
+		return
+	}
 
+	c.JSON(http.StatusOK, gin.H{"message": "Song removed from playlist"})
+}
+
+// playlistRoleRanks orders the member roles; each role may do everything
+// the roles below it may.
+var playlistRoleRanks = map[string]int{
+	models.PlaylistRolePublic: 1,
+	models.PlaylistRoleViewer: 2,
+	models.PlaylistRoleEditor: 3,
+	models.PlaylistRoleOwner:  4,
+}
+
+// playlistRole returns the user's role on the playlist, or "" when they
+// have no access. Anyone may read a public playlist as PlaylistRolePublic.
+func playlistRole(playlist *models.Playlist, userID string) string {
+	if playlist.UserID == userID {
+		return models.PlaylistRoleOwner
+	}
+	for _, collaborator := range playlist.Collaborators {
+		if collaborator.UserID == userID {
+			return collaborator.Role
+		}
+	}
+	if playlist.Visibility == models.PlaylistPublic {
+		return models.PlaylistRolePublic
+	}
+	return ""
+}
+
+// canAccessPlaylist reports whether the user has at least role on the
+// playlist.
+func canAccessPlaylist(playlist *models.Playlist, userID string, role string) bool {
+	return playlistRoleRanks[playlistRole(playlist, userID)] >= playlistRoleRanks[role]
+}
+
+// authorizePlaylist loads the playlist named by the :id param and checks
+// that the caller has at least role on it. It writes the error response
+// itself and reports whether the caller should continue.
+func authorizePlaylist(c *gin.Context, playlistService *services.PlaylistService, role string) (*models.Playlist, bool) {
 	userID, exists := c.Get("UserID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
-		return
+		return nil, false
 	}
 
-	playlist, err := playlistService.GetPlaylistByID(playlistID)
+	playlist, err := playlistService.GetPlaylistByID(c.Param("id"))
 	if err != nil {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
-		return
+		return nil, false
 	}
 
-	// Check ownership
-	if playlist.UserID != userID.(string) {
+	if !canAccessPlaylist(playlist, userID.(string), role) {
 		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
-		return
+		return nil, false
 	}
+	return playlist, true
+}
 
-	if err := playlistService.RemoveSongFromPlaylist(playlistID, songID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove song from playlist"})
-		return
+// editablePlaylist is authorizePlaylist for changing a playlist's
+// entries, which smart playlists don't have.
+func editablePlaylist(c *gin.Context, playlistService *services.PlaylistService) (*models.Playlist, bool) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleEditor)
+	if !ok {
+		return nil, false
 	}
+	if playlist.Smart != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Smart playlists can't be edited by hand"})
+		return nil, false
+	}
+	return playlist, true
+}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Song removed from playlist"})
+// playlistEntryError writes the response for an error from an entry
+// operation and reports whether there was one.
+func playlistEntryError(c *gin.Context, err error, message string) bool {
+	switch {
+	case err == nil:
+		return false
+	case errors.Is(err, services.ErrPlaylistEntryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist entry not found"})
+	case errors.Is(err, services.ErrPlaylistPosition), errors.Is(err, services.ErrPlaylistOrder):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": message})
+	}
+	return true
 }
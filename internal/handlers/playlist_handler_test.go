@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"testing"
+
+	"projectpi-backend/internal/models"
+)
+
+func TestPlaylistRole(t *testing.T) {
+	playlist := func(visibility string) *models.Playlist {
+		return &models.Playlist{
+			UserID:     "USER-owner",
+			Visibility: visibility,
+			Collaborators: []models.PlaylistCollaborator{
+				{UserID: "USER-editor", Role: models.PlaylistRoleEditor},
+				{UserID: "USER-viewer", Role: models.PlaylistRoleViewer},
+			},
+		}
+	}
+
+	tests := []struct {
+		name       string
+		visibility string
+		userID     string
+		want       string
+	}{
+		{"owner", models.PlaylistPrivate, "USER-owner", models.PlaylistRoleOwner},
+		{"editor", models.PlaylistPrivate, "USER-editor", models.PlaylistRoleEditor},
+		{"viewer", models.PlaylistPrivate, "USER-viewer", models.PlaylistRoleViewer},
+		{"stranger on private", models.PlaylistPrivate, "USER-other", ""},
+		{"stranger on unlisted", models.PlaylistUnlisted, "USER-other", ""},
+		{"stranger on public", models.PlaylistPublic, "USER-other", models.PlaylistRolePublic},
+		{"viewer on public keeps their role", models.PlaylistPublic, "USER-viewer", models.PlaylistRoleViewer},
+		{"owner on public", models.PlaylistPublic, "USER-owner", models.PlaylistRoleOwner},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := playlistRole(playlist(tt.visibility), tt.userID); got != tt.want {
+				t.Errorf("playlistRole() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanAccessPlaylist(t *testing.T) {
+	private := &models.Playlist{
+		UserID:     "USER-owner",
+		Visibility: models.PlaylistPrivate,
+		Collaborators: []models.PlaylistCollaborator{
+			{UserID: "USER-viewer", Role: models.PlaylistRoleViewer},
+		},
+	}
+	public := &models.Playlist{UserID: "USER-owner", Visibility: models.PlaylistPublic}
+
+	tests := []struct {
+		name     string
+		playlist *models.Playlist
+		userID   string
+		role     string
+		want     bool
+	}{
+		{"owner may do anything", private, "USER-owner", models.PlaylistRoleOwner, true},
+		{"viewer may read", private, "USER-viewer", models.PlaylistRoleViewer, true},
+		{"viewer may not edit", private, "USER-viewer", models.PlaylistRoleEditor, false},
+		{"stranger may not read private", private, "USER-other", models.PlaylistRolePublic, false},
+		{"stranger may read public", public, "USER-other", models.PlaylistRolePublic, true},
+		{"stranger on public is not a viewer", public, "USER-other", models.PlaylistRoleViewer, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canAccessPlaylist(tt.playlist, tt.userID, tt.role); got != tt.want {
+				t.Errorf("canAccessPlaylist(%q) = %v, want %v", tt.role, got, tt.want)
+			}
+		})
+	}
+}
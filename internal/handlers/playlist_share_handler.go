@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/signing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// shareSubjectPrefix marks signed stream URLs handed out through a share
+// link; the rest of the subject is the share token.
+const shareSubjectPrefix = "share:"
+
+// CreatePlaylistShareHandler creates a share link for an unlisted or public
+// playlist
+func CreatePlaylistShareHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+
+	if playlist.Visibility != models.PlaylistUnlisted && playlist.Visibility != models.PlaylistPublic {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Make the playlist unlisted or public to share it"})
+		return
+	}
+
+	share, err := playlistService.CreateShare(playlist.PlaylistID, playlist.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create share link"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"share": share, "url": baseURL(c) + "/shared/" + share.Token})
+}
+
+// ListPlaylistSharesHandler lists the playlist's share links
+func ListPlaylistSharesHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+
+	shares, err := playlistService.GetShares(playlist.PlaylistID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch share links"})
+		return
+	}
+
+	c.JSON(http.StatusOK, shares)
+}
+
+// RevokePlaylistShareHandler revokes a share link. Stream URLs already
+// handed out through it stop working too.
+func RevokePlaylistShareHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+
+	err := playlistService.RevokeShare(playlist.PlaylistID, c.Param("token"))
+	if errors.Is(err, services.ErrShareNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Share link not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke share link"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Share link revoked"})
+}
+
+// SharedPlaylistHandler is the unauthenticated, read-only view of a
+// playlist through a share link. It takes the same ?page=, ?limit= and
+// ?fields= as GetPlaylistHandler, and each available entry comes with a
+// signed StreamURL.
+func SharedPlaylistHandler(c *gin.Context, playlistService *services.PlaylistService, signer *signing.Signer) {
+	token := c.Param("token")
+	playlist, err := playlistService.GetSharedPlaylist(token)
+	if errors.Is(err, services.ErrShareNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist"})
+		return
+	}
+
+	entryFields, songFields, err := parsePlaylistFields(c.Query("fields"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	entryFields = publicEntryFields(entryFields)
+
+	page, limit := parsePagination(c)
+	entries, total, err := playlistService.GetPlaylistEntries(playlist, songFields, page, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
+		return
+	}
+
+	expiresAt := time.Now().Add(defaultStreamURLTTL)
+	songs := make([]gin.H, 0, len(entries))
+	for i := range entries {
+		song := playlistEntryJSON(&entries[i], entryFields, songFields)
+		if !entries[i].Unavailable {
+			song["StreamURL"] = signedStreamURL(c, signer, entries[i].SongID, shareSubjectPrefix+token, expiresAt)
+		}
+		songs = append(songs, song)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"playlist": publicPlaylistJSON(playlist),
+		"songs":    songs,
+		"page":     page,
+		"limit":    limit,
+		"total":    total,
+	})
+}
+
+// sharedSongAllowed reports whether a signed stream URL with a share
+// subject may stream the song: the share must still be live and the song
+// in its playlist.
+func sharedSongAllowed(playlistService *services.PlaylistService, subject string, song *models.Song) bool {
+	token, ok := strings.CutPrefix(subject, shareSubjectPrefix)
+	if !ok {
+		return false
+	}
+	playlist, err := playlistService.GetSharedPlaylist(token)
+	if err != nil {
+		return false
+	}
+	found, err := playlistService.HasSong(playlist, song.SongID, song.UserID)
+	return err == nil && found
+}
+
+// publicPlaylistJSON renders the parts of a playlist non-members may see:
+// not its owner, members or visibility.
+func publicPlaylistJSON(playlist *models.Playlist) gin.H {
+	return gin.H{
+		"PlaylistID":  playlist.PlaylistID,
+		"Name":        playlist.Name,
+		"Description": playlist.Description,
+		"UpdatedAt":   playlist.UpdatedAt,
+	}
+}
+
+// publicEntryFields drops the entry fields non-members may not see from
+// entryFields: who added what is for members only.
+func publicEntryFields(entryFields []string) []string {
+	fields := make([]string, 0, len(entryFields))
+	for _, name := range entryFields {
+		if name != "added_by" {
+			fields = append(fields, name)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// smartRulesRequest is the JSON form of models.SmartRules. Rule values may
+// be strings or numbers.
+type smartRulesRequest struct {
+	Match string `json:"match" binding:"omitempty,oneof=all any"`
+	Rules []struct {
+		Field    string      `json:"field" binding:"required"`
+		Operator string      `json:"operator" binding:"required"`
+		Value    interface{} `json:"value"`
+	} `json:"rules" binding:"dive"`
+	Sort  string `json:"sort"`
+	Limit int    `json:"limit" binding:"min=0"`
+}
+
+// smartRules converts and validates the request.
+func (r *smartRulesRequest) smartRules() (*models.SmartRules, error) {
+	rules := &models.SmartRules{Match: r.Match, Sort: r.Sort, Limit: r.Limit}
+	for _, rule := range r.Rules {
+		value := ""
+		switch v := rule.Value.(type) {
+		case string:
+			value = v
+		case float64:
+			value = strconv.FormatFloat(v, 'f', -1, 64)
+		}
+		rules.Rules = append(rules.Rules, models.SmartRule{Field: rule.Field, Operator: rule.Operator, Value: value})
+	}
+	if err := services.ValidateSmartRules(rules); err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+// SetPlaylistRulesHandler makes a playlist smart, or changes its rules.
+// Fields are title, artist, album and genre (is, is_not, contains,
+// not_contains, starts_with), duration in seconds and plays (is, is_not,
+// gt, lt), and added and last_played (in_last, not_in_last a number of
+// days). Sort is a field, prefixed with "-" for descending. Rules match
+// the owner's whole library, so only the owner may set them.
+func SetPlaylistRulesHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+
+	var request smartRulesRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rules, err := request.smartRules()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := playlistService.SetSmartRules(playlist.PlaylistID, rules); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update playlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Playlist rules updated", "rules": rules})
+}
+
+// ClearPlaylistRulesHandler turns a smart playlist back into a regular one.
+// Only the owner may.
+func ClearPlaylistRulesHandler(c *gin.Context, playlistService *services.PlaylistService) {
+	playlist, ok := authorizePlaylist(c, playlistService, models.PlaylistRoleOwner)
+	if !ok {
+		return
+	}
+
+	if err := playlistService.SetSmartRules(playlist.PlaylistID, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update playlist"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Playlist rules removed"})
+}
@@ -0,0 +1,436 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/realtime"
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/gorilla/websocket"
+)
+
+var errInvalidCommand = errors.New("invalid queue command")
+
+// queueCommand is a playback control sent by a device, over HTTP or the
+// queue WebSocket.
+type queueCommand struct {
+	Action     string `json:"action" binding:"required,oneof=play pause next previous seek jump shuffle repeat transfer"`
+	PositionMs *int64 `json:"position_ms" binding:"omitempty,min=0"`
+	Index      *int   `json:"index"`
+	Shuffle    *bool  `json:"shuffle"`
+	Repeat     string `json:"repeat" binding:"omitempty,oneof=off all one"`
+	Device     string `json:"device"`
+}
+
+// GetQueueHandler returns the user's play queue and connected devices
+func GetQueueHandler(c *gin.Context, queueService *services.QueueService, hub *realtime.Hub) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	queue, err := queueService.GetQueue(userID.(string))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch queue"})
+		return
+	}
+
+	respondJSON(c, http.StatusOK, queueState(queue, hub), queue.UpdatedAt)
+}
+
+// ReplaceQueueHandler starts playing a list of songs or one of the user's
+// playlists
+func ReplaceQueueHandler(c *gin.Context, queueService *services.QueueService, songService *services.SongService, playlistService *services.PlaylistService, hub *realtime.Hub) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userIDStr := userID.(string)
+
+	var request struct {
+		SongIDs    []string `json:"song_ids"`
+		PlaylistID string   `json:"playlist_id"`
+		StartIndex int      `json:"start_index" binding:"min=0"`
+		PositionMs int64    `json:"position_ms" binding:"min=0"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	songIDs := request.SongIDs
+	switch {
+	case request.PlaylistID != "":
+		playlist, err := playlistService.GetPlaylistByID(request.PlaylistID)
+		if err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Playlist not found"})
+			return
+		}
+		if !canAccessPlaylist(playlist, userIDStr, models.PlaylistRolePublic) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+		songIDs, err = playlistSongIDs(userIDStr, playlist, playlistService, songService)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playlist songs"})
+			return
+		}
+	case len(songIDs) > 0:
+		if !ownsAllSongs(c, userIDStr, songIDs, songService) {
+			return
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "song_ids or playlist_id is required"})
+		return
+	}
+
+	queue, err := queueService.UpdateQueue(userIDStr, func(q *models.PlayQueue) error {
+		if err := services.ReplaceQueue(q, songIDs, request.StartIndex, request.PlaylistID); err != nil {
+			return err
+		}
+		q.PositionMs = request.PositionMs
+		return nil
+	})
+	if err != nil {
+		queueError(c, err)
+		return
+	}
+
+	publishQueue(hub, queue)
+	c.JSON(http.StatusOK, queueState(queue, hub))
+}
+
+// AddToQueueHandler appends songs to the queue, or plays them next
+func AddToQueueHandler(c *gin.Context, queueService *services.QueueService, songService *services.SongService, hub *realtime.Hub) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userIDStr := userID.(string)
+
+	var request struct {
+		SongIDs []string `json:"song_ids" binding:"required,min=1"`
+		Next    bool     `json:"next"`
+	}
+	if err := c.ShouldBindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !ownsAllSongs(c, userIDStr, request.SongIDs, songService) {
+		return
+	}
+
+	queue, err := queueService.UpdateQueue(userIDStr, func(q *models.PlayQueue) error {
+		return services.AddToQueue(q, request.SongIDs, request.Next)
+	})
+	if err != nil {
+		queueError(c, err)
+		return
+	}
+
+	publishQueue(hub, queue)
+	c.JSON(http.StatusOK, queueState(queue, hub))
+}
+
+// RemoveFromQueueHandler removes the song at an index of the queue
+func RemoveFromQueueHandler(c *gin.Context, queueService *services.QueueService, hub *realtime.Hub) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	index, err := strconv.Atoi(c.Param("index"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid index"})
+		return
+	}
+
+	queue, err := queueService.UpdateQueue(userID.(string), func(q *models.PlayQueue) error {
+		return services.RemoveFromQueue(q, index)
+	})
+	if err != nil {
+		queueError(c, err)
+		return
+	}
+
+	publishQueue(hub, queue)
+	c.JSON(http.StatusOK, queueState(queue, hub))
+}
+
+// ClearQueueHandler empties the queue
+func ClearQueueHandler(c *gin.Context, queueService *services.QueueService, hub *realtime.Hub) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	queue, err := queueService.UpdateQueue(userID.(string), func(q *models.PlayQueue) error {
+		services.ClearQueue(q)
+		return nil
+	})
+	if err != nil {
+		queueError(c, err)
+		return
+	}
+
+	publishQueue(hub, queue)
+	c.JSON(http.StatusOK, queueState(queue, hub))
+}
+
+// QueueCommandHandler applies a playback command, e.g. from a remote
+// control, and pushes the new state to every device
+func QueueCommandHandler(c *gin.Context, queueService *services.QueueService, hub *realtime.Hub) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	var command queueCommand
+	if err := c.ShouldBindJSON(&command); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	queue, err := queueService.UpdateQueue(userID.(string), func(q *models.PlayQueue) error {
+		return applyQueueCommand(q, command)
+	})
+	if err != nil {
+		queueError(c, err)
+		return
+	}
+
+	publishQueue(hub, queue)
+	c.JSON(http.StatusOK, queueState(queue, hub))
+}
+
+// QueueSocketHandler connects a device to the queue WebSocket. Browsers
+// can't set headers on WebSocket requests, so they pass the JWT as a
+// subprotocol next to realtime.Subprotocol, e.g.
+// new WebSocket(url, ["projectpi.queue", token]); other clients may send an
+// Authorization header. Tokens are kept out of the URL, which ends up in
+// access logs. The device names itself with ?device=. It receives the queue
+// state on connect and after every change, and may send commands.
+func QueueSocketHandler(c *gin.Context, queueService *services.QueueService, hub *realtime.Hub) {
+	userID, err := userIDFromToken(socketToken(c))
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	device := c.DefaultQuery("device", "unknown")
+
+	client, err := hub.Connect(c.Writer, c.Request, userID, device)
+	if err != nil {
+		// The upgrader has already written an error response
+		return
+	}
+
+	// Every device sees the new one in its device list
+	if queue, err := queueService.GetQueue(userID); err == nil {
+		publishQueue(hub, queue)
+	}
+
+	client.Listen(func(message []byte) {
+		var command queueCommand
+		err := json.Unmarshal(message, &command)
+		if err == nil {
+			err = binding.Validator.ValidateStruct(&command)
+		}
+		if err != nil {
+			client.Send(socketError(err.Error()))
+			return
+		}
+		if command.Device == "" {
+			command.Device = device
+		}
+
+		queue, err := queueService.UpdateQueue(userID, func(q *models.PlayQueue) error {
+			return applyQueueCommand(q, command)
+		})
+		if err != nil {
+			_, message := queueErrorStatus(err)
+			client.Send(socketError(message))
+			return
+		}
+		publishQueue(hub, queue)
+	})
+
+	if queue, err := queueService.GetQueue(userID); err == nil {
+		publishQueue(hub, queue)
+	}
+}
+
+// socketToken returns the JWT of a WebSocket request, from the
+// Authorization header or offered as a subprotocol.
+func socketToken(c *gin.Context) string {
+	if token, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+		return token
+	}
+	for _, protocol := range websocket.Subprotocols(c.Request) {
+		if protocol != realtime.Subprotocol {
+			return protocol
+		}
+	}
+	return ""
+}
+
+func applyQueueCommand(q *models.PlayQueue, command queueCommand) error {
+	switch command.Action {
+	case "play":
+		if q.CurrentIndex < 0 {
+			return services.ErrQueueIndex
+		}
+		q.IsPlaying = true
+		if q.ActiveDevice == "" {
+			q.ActiveDevice = command.Device
+		}
+	case "pause":
+		q.IsPlaying = false
+	case "next":
+		services.SkipQueue(q, 1)
+	case "previous":
+		services.SkipQueue(q, -1)
+	case "seek":
+		if command.PositionMs == nil {
+			return fmt.Errorf("%w: position_ms is required", errInvalidCommand)
+		}
+	case "jump":
+		if command.Index == nil {
+			return fmt.Errorf("%w: index is required", errInvalidCommand)
+		}
+		if *command.Index < 0 || *command.Index >= len(q.SongIDs) {
+			return services.ErrQueueIndex
+		}
+		q.CurrentIndex = *command.Index
+		q.PositionMs = 0
+		q.IsPlaying = true
+	case "shuffle":
+		if command.Shuffle == nil {
+			return fmt.Errorf("%w: shuffle is required", errInvalidCommand)
+		}
+		services.SetShuffle(q, *command.Shuffle)
+	case "repeat":
+		if command.Repeat == "" {
+			return fmt.Errorf("%w: repeat is required", errInvalidCommand)
+		}
+		q.Repeat = command.Repeat
+	case "transfer":
+		if command.Device == "" {
+			return fmt.Errorf("%w: device is required", errInvalidCommand)
+		}
+		q.ActiveDevice = command.Device
+	}
+
+	// Players report where they are with every command
+	if command.PositionMs != nil && command.Action != "next" && command.Action != "previous" && command.Action != "jump" {
+		q.PositionMs = *command.PositionMs
+	}
+	return nil
+}
+
+// ownsAllSongs checks that every song exists and belongs to the user,
+// writing a 400 listing the others if not
+func ownsAllSongs(c *gin.Context, userID string, songIDs []string, songService *services.SongService) bool {
+	songs, err := songService.GetSongsByIDs(userID, songIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch songs"})
+		return false
+	}
+	owned := make(map[string]bool, len(songs))
+	for _, song := range songs {
+		owned[song.SongID] = true
+	}
+
+	unknown := []string{}
+	for _, songID := range songIDs {
+		if !owned[songID] {
+			unknown = append(unknown, songID)
+		}
+	}
+	if len(unknown) > 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown songs", "song_ids": unknown})
+		return false
+	}
+	return true
+}
+
+// playlistSongIDs returns a playlist's songs in order, skipping ones that
+// no longer exist
+func playlistSongIDs(userID string, playlist *models.Playlist, playlistService *services.PlaylistService, songService *services.SongService) ([]string, error) {
+	entries, err := playlistService.GetPlaylistContents(playlist)
+	if err != nil {
+		return nil, err
+	}
+
+	songIDs := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		songIDs = append(songIDs, entry.SongID)
+	}
+	songs, err := songService.GetSongsByIDs(userID, songIDs)
+	if err != nil {
+		return nil, err
+	}
+	owned := make(map[string]bool, len(songs))
+	for _, song := range songs {
+		owned[song.SongID] = true
+	}
+
+	available := make([]string, 0, len(songIDs))
+	for _, songID := range songIDs {
+		if owned[songID] {
+			available = append(available, songID)
+		}
+	}
+	return available, nil
+}
+
+func queueError(c *gin.Context, err error) {
+	status, message := queueErrorStatus(err)
+	c.JSON(status, gin.H{"error": message})
+}
+
+func queueErrorStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, services.ErrQueueConflict):
+		return http.StatusConflict, err.Error()
+	case errors.Is(err, services.ErrQueueIndex), errors.Is(err, services.ErrQueueTooLong), errors.Is(err, errInvalidCommand):
+		return http.StatusBadRequest, err.Error()
+	default:
+		return http.StatusInternalServerError, "Failed to update queue"
+	}
+}
+
+func queueState(queue *models.PlayQueue, hub *realtime.Hub) gin.H {
+	return gin.H{
+		"type":    "state",
+		"queue":   queue,
+		"devices": hub.Devices(queue.UserID),
+	}
+}
+
+// publishQueue pushes the queue state to all of the user's devices
+func publishQueue(hub *realtime.Hub, queue *models.PlayQueue) {
+	message, err := json.Marshal(queueState(queue, hub))
+	if err != nil {
+		return
+	}
+	hub.Broadcast(queue.UserID, message)
+}
+
+func socketError(message string) []byte {
+	data, _ := json.Marshal(gin.H{"type": "error", "error": message})
+	return data
+}
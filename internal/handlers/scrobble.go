@@ -0,0 +1,41 @@
+package handlers
+
+import (
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// scrobble is a listen reported by an external player.
+type scrobble struct {
+	Artist    string
+	Track     string
+	Album     string
+	Timestamp time.Time
+}
+
+// scrobblePlay turns a scrobble into a play, matched against the user's
+// songs by title and artist. Listens of songs the user hasn't uploaded are
+// still kept in their history, without a song.
+func scrobblePlay(userID string, device string, s scrobble, songService *services.SongService) (models.Play, error) {
+	play := models.Play{
+		UserID:    userID,
+		Event:     models.PlayEventScrobble,
+		Device:    device,
+		Timestamp: s.Timestamp,
+		Title:     s.Track,
+		Artist:    s.Artist,
+		Album:     s.Album,
+	}
+	song, err := songService.FindSongByTitleArtist(userID, s.Track, s.Artist)
+	switch {
+	case err == nil:
+		play.SongID = song.SongID
+	case err != mongo.ErrNoDocuments:
+		return play, err
+	}
+	return play, nil
+}
@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/signing"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/transcode"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultStreamURLTTL = time.Hour
+	maxStreamURLTTL     = 24 * time.Hour
+)
+
+// CreateStreamURLHandler returns a short-lived signed URL for streaming a
+// song without an Authorization header, for <audio src>, casting devices
+// and download managers
+func CreateStreamURLHandler(c *gin.Context, songService *services.SongService, signer *signing.Signer) {
+	song, ok := ownedSong(c, songService)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		TTL int `json:"ttl"` // seconds
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ttl := defaultStreamURLTTL
+	if request.TTL > 0 {
+		ttl = time.Duration(request.TTL) * time.Second
+	}
+	if ttl > maxStreamURLTTL {
+		ttl = maxStreamURLTTL
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	c.JSON(http.StatusOK, gin.H{
+		"url":        signedStreamURL(c, signer, song.SongID, song.UserID, expiresAt),
+		"expires_at": expiresAt,
+	})
+}
+
+// SignedStreamHandler streams a song through a URL from
+// CreateStreamURLHandler or a shared playlist. It takes the same format,
+// bitrate and normalize parameters as StreamSongHandler and supports range
+// requests.
+func SignedStreamHandler(c *gin.Context, songService *services.SongService, playlistService *services.PlaylistService, store *storage.Local, pipeline *transcode.Pipeline, signer *signing.Signer) {
+	songID := c.Param("id")
+	subject := c.Query("u")
+	expires, err := strconv.ParseInt(c.Query("exp"), 10, 64)
+	if err != nil || !signer.Verify(songID, subject, expires, c.Query("sig")) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Invalid or expired signature"})
+		return
+	}
+
+	// The subject is the song's owner, or a share link to a playlist with
+	// the song
+	song, err := songService.GetSongByID(songID)
+	if err != nil || (song.UserID != subject && !sharedSongAllowed(playlistService, subject, song)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+		return
+	}
+
+	streamSong(c, song, store, pipeline)
+}
+
+// signedStreamURL builds an absolute signed stream URL for the song, bound
+// to subject until expiresAt
+func signedStreamURL(c *gin.Context, signer *signing.Signer, songID, subject string, expiresAt time.Time) string {
+	query := url.Values{}
+	query.Set("u", subject)
+	query.Set("exp", strconv.FormatInt(expiresAt.Unix(), 10))
+	query.Set("sig", signer.Sign(songID, subject, expiresAt.Unix()))
+	return fmt.Sprintf("%s/stream/%s/signed?%s", baseURL(c), url.PathEscape(songID), query.Encode())
+}
+
+// baseURL is the scheme and host the client used to reach the API, taking
+// proxies into account
+func baseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := c.GetHeader("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := c.Request.Host
+	if forwarded := c.GetHeader("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return scheme + "://" + host
+}
+
+// TrustForwardedHeaders returns middleware that drops the X-Forwarded-Host
+// and X-Forwarded-Proto headers of requests that don't come straight from
+// one of proxies (IPs or CIDRs), so clients can't point the URLs baseURL
+// builds at a host of their choosing.
+func TrustForwardedHeaders(proxies []string) (gin.HandlerFunc, error) {
+	var networks []*net.IPNet
+	for _, proxy := range proxies {
+		if !strings.Contains(proxy, "/") {
+			if ip := net.ParseIP(proxy); ip != nil && ip.To4() != nil {
+				proxy += "/32"
+			} else {
+				proxy += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return func(c *gin.Context) {
+		ip := net.ParseIP(c.RemoteIP())
+		trusted := false
+		for _, network := range networks {
+			if ip != nil && network.Contains(ip) {
+				trusted = true
+				break
+			}
+		}
+		if !trusted {
+			c.Request.Header.Del("X-Forwarded-Host")
+			c.Request.Header.Del("X-Forwarded-Proto")
+		}
+		c.Next()
+	}, nil
+}
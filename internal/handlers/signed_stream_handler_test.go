@@ -0,0 +1,104 @@
+package handlers
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/signing"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func TestSignedStreamHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	signer := &signing.Signer{Key: []byte("test key")}
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+	signature := signer.Sign("SONG-1", "USER-1", future)
+	tampered := "1" + signature[1:]
+	if signature[0] == '1' {
+		tampered = "0" + signature[1:]
+	}
+
+	tests := []struct {
+		name    string
+		subject string
+		expires int64
+		sig     string
+		// responses are what the database answers, in order
+		responses []bson.D
+		want      int
+	}{
+		{
+			name:    "expired",
+			subject: "USER-1",
+			expires: past,
+			sig:     signer.Sign("SONG-1", "USER-1", past),
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "tampered signature",
+			subject: "USER-1",
+			expires: future,
+			sig:     tampered,
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "subject swapped",
+			subject: "USER-2",
+			expires: future,
+			sig:     signature,
+			want:    http.StatusForbidden,
+		},
+		{
+			name:    "revoked share",
+			subject: shareSubjectPrefix + "TOKEN-1",
+			expires: future,
+			sig:     signer.Sign("SONG-1", shareSubjectPrefix+"TOKEN-1", future),
+			responses: []bson.D{
+				mtest.CreateCursorResponse(0, "db.songs", mtest.FirstBatch, bson.D{
+					{Key: "song_id", Value: "SONG-1"},
+					{Key: "user_id", Value: "USER-1"},
+					{Key: "filename", Value: "song.mp3"},
+				}),
+				// The share's token was revoked, so no share matches it
+				mtest.CreateCursorResponse(0, "db.playlist_shares", mtest.FirstBatch),
+			},
+			want: http.StatusNotFound,
+		},
+	}
+
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	for _, tt := range tests {
+		mt.Run(tt.name, func(mt *mtest.T) {
+			mt.AddMockResponses(tt.responses...)
+			songService := &services.SongService{DB: mt.DB}
+			playlistService := &services.PlaylistService{DB: mt.DB}
+
+			query := url.Values{}
+			query.Set("u", tt.subject)
+			query.Set("exp", strconv.FormatInt(tt.expires, 10))
+			query.Set("sig", tt.sig)
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodGet, "/stream/SONG-1/signed?"+query.Encode(), nil)
+			c.Params = gin.Params{{Key: "id", Value: "SONG-1"}}
+
+			SignedStreamHandler(c, songService, playlistService, nil, nil, signer)
+			if w.Code != tt.want {
+				mt.Errorf("SignedStreamHandler() status = %d, want %d: %s", w.Code, tt.want, w.Body.String())
+			}
+			// A bad signature is refused before any lookup
+			if got := len(mt.GetAllStartedEvents()); got != len(tt.responses) {
+				mt.Errorf("SignedStreamHandler() ran %d queries, want %d", got, len(tt.responses))
+			}
+		})
+	}
+}
@@ -1,22 +1,34 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"math"
 	"net/http"
-	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
+	"projectpi-backend/internal/audio"
 	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/processing"
 	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/transcode"
 	"projectpi-backend/internal/utils"
 
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson"
 )
 
-func UploadSongHandler(c *gin.Context, songService *services.SongService) {
+func UploadSongHandler(c *gin.Context, songService *services.SongService, store *storage.Local, processor *processing.Processor) {
 	title := c.PostForm("title")
 	artist := c.PostForm("artist")
+	album := c.PostForm("album")
 
 	userID, exists := c.Get("UserID")
 	if !exists {
@@ -42,50 +54,104 @@ func UploadSongHandler(c *gin.Context, songService *services.SongService) {
 		return
 	}
 
-	// Validate file type (allow only mp3, wav, jpg, png)
-	allowedTypes := map[string]bool{
-		"audio/mpeg": true,
-		"audio/wav":  true,
-		"image/jpeg": true,
-		"image/png":  true,
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
+		return
 	}
-	if !allowedTypes[file.Header.Get("Content-Type")] {
+	defer src.Close()
+
+	// Validate file type from its content (mp3, wav, flac, ogg, opus,
+	// aac/m4a, aiff). Images go through /images.
+	header := make([]byte, audio.HeaderSize)
+	n, _ := io.ReadFull(src, header)
+	format, ok := audio.Detect(header[:n])
+	if !ok {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file type"})
 		return
 	}
-
-	// Create user-specific directory: uploads/<user_id>/
-	userDir := filepath.Join("uploads", userIDStr)
-	if err := os.MkdirAll(userDir, os.ModePerm); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user directory"})
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid file"})
 		return
 	}
 
-	// Save file in user-specific directory
-	filePath := filepath.Join(userDir, file.Filename)
-	if err := c.SaveUploadedFile(file, filePath); err != nil {
+	// Save file in user-specific directory: uploads/<user_id>/, hashing it
+	// on the way for ETags. It's kept under a name of its own until the song
+	// is created, so a rejected upload never touches another song's file.
+	songID := utils.GenerateSongID(uint(time.Now().UnixNano() % 10000))
+	tmpName := ".upload-" + songID + filepath.Ext(file.Filename)
+	hash := sha256.New()
+	if err := store.Save(io.TeeReader(src, hash), userIDStr, tmpName); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
 		return
 	}
 
-	songID := utils.GenerateSongID(uint(time.Now().UnixNano() % 10000))
 	song := models.Song{
-		SongID:   songID,
-		Title:    title,
-		Artist:   artist,
-		Filename: file.Filename,
-		UserID:   userIDStr,
+		SongID:      songID,
+		Title:       title,
+		Artist:      artist,
+		Album:       album,
+		Filename:    tmpName,
+		Format:      format.Name,
+		ContentType: format.ContentType,
+		ContentHash: hex.EncodeToString(hash.Sum(nil)),
+		UserID:      userIDStr,
 	}
 
+	// Fill in duration and missing metadata from the file's tags. A file
+	// with the right magic bytes but no audio in it isn't a song.
+	if err := processor.ProbeSong(&song); err != nil {
+		store.Remove(userIDStr, tmpName)
+		if errors.Is(err, transcode.ErrNotAudio) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "File has no playable audio"})
+			return
+		}
+		log.Printf("Failed to probe %s: %v", song.SongID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	if song.Title == "" {
+		song.Title = strings.TrimSuffix(file.Filename, filepath.Ext(file.Filename))
+	}
+
+	song.Filename = uploadFilename(store, userIDStr, file.Filename)
 	if err := songService.CreateSong(&song); err != nil {
+		store.Remove(userIDStr, tmpName)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save song"})
 		return
 	}
+	if err := store.Rename([]string{userIDStr, tmpName}, []string{userIDStr, song.Filename}); err != nil {
+		log.Printf("Failed to move upload of %s into place: %v", song.SongID, err)
+		songService.DeleteSong(song.SongID)
+		store.Remove(userIDStr, tmpName)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+		return
+	}
+
+	// Waveform and other analysis run in the background
+	processor.SongUploaded(&song)
 
 	c.JSON(http.StatusOK, gin.H{"message": "Song uploaded successfully", "song_id": song.SongID})
 }
 
-func ListSongsHandler(c *gin.Context, songService *services.SongService) {
+func songUpdatedAt(song models.Song) time.Time {
+	return song.UpdatedAt
+}
+
+// uploadFilename returns the name an upload is stored under: its own name,
+// or, when the user already has a file by that name, the name numbered like
+// "Song (2).mp3" so the existing song keeps its file.
+func uploadFilename(store *storage.Local, userID string, name string) string {
+	name = filepath.Base(name)
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; store.Exists(userID, name); i++ {
+		name = base + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	return name
+}
+
+func ListSongsHandler(c *gin.Context, songService *services.SongService, playService *services.PlayService) {
 	userID, exists := c.Get("UserID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
@@ -103,10 +169,33 @@ func ListSongsHandler(c *gin.Context, songService *services.SongService) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"songs": songs})
+	// Resume positions (ms) keyed by song ID, for songs the user stopped in
+	positions, err := playService.GetPositions(userIDStr, nil)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playback positions"})
+		return
+	}
+
+	respondJSON(c, http.StatusOK, gin.H{"songs": songs, "positions": positions}, newest(songs, songUpdatedAt))
 }
 
-func StreamSongHandler(c *gin.Context, songService *services.SongService) {
+// GetSongHandler returns a song's metadata with the user's resume position
+func GetSongHandler(c *gin.Context, songService *services.SongService, playService *services.PlayService) {
+	song, ok := ownedSong(c, songService)
+	if !ok {
+		return
+	}
+
+	positions, err := playService.GetPositions(song.UserID, []string{song.SongID})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch playback position"})
+		return
+	}
+
+	respondJSON(c, http.StatusOK, gin.H{"song": song, "position_ms": positions[song.SongID]}, song.UpdatedAt)
+}
+
+func StreamSongHandler(c *gin.Context, songService *services.SongService, store *storage.Local, pipeline *transcode.Pipeline) {
 	userID, exists := c.Get("UserID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
@@ -125,12 +214,86 @@ func StreamSongHandler(c *gin.Context, songService *services.SongService) {
 		return
 	}
 
-	userDir := filepath.Join("uploads", userIDStr)
-	filePath := filepath.Join(userDir, song.Filename)
-	c.File(filePath)
+	streamSong(c, song, store, pipeline)
+}
+
+// streamSong serves the song's original file, or a cached transcode when the
+// client asks for ?format= (a name or "auto" to negotiate from Accept and
+// ?supports=), ?bitrate= or ?normalize= (true/track or album gain), or when
+// it can't play the original format. Both are served with range support.
+func streamSong(c *gin.Context, song *models.Song, store *storage.Local, pipeline *transcode.Pipeline) {
+	filePath := store.Path(song.UserID, song.Filename)
+
+	formatParam := c.Query("format")
+	bitrateParam := c.Query("bitrate")
+	normalize := c.Query("normalize")
+	switch normalize {
+	case "", "false":
+		normalize = ""
+	case "true", "track", "album":
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "normalize must be true, track, album or false"})
+		return
+	}
+	// Songs that haven't been analyzed yet are served as they are
+	gain := normalizationGain(song.Loudness, normalize)
+	if gain == 0 {
+		normalize = ""
+	}
+	var supports []string
+	if c.Query("supports") != "" {
+		supports = strings.Split(c.Query("supports"), ",")
+	}
+
+	source := songFormat(song)
+	if formatParam == "" {
+		c.Header("Vary", "Accept")
+	}
+	if formatParam == "" && bitrateParam == "" && normalize == "" && clientCanPlay(c, source, supports) {
+		if source.ContentType != "" {
+			c.Header("Content-Type", source.ContentType)
+		}
+		etag := fileETag(filePath)
+		if song.ContentHash != "" {
+			etag = `"` + song.ContentHash + `"`
+		}
+		serveFile(c, filePath, etag, song.UpdatedAt)
+		return
+	}
+
+	format, ok := transcode.Negotiate(formatParam, c.GetHeader("Accept"), supports)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unsupported format"})
+		return
+	}
+	bitrate := 0
+	if bitrateParam != "" {
+		var err error
+		if bitrate, err = strconv.Atoi(bitrateParam); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid bitrate"})
+			return
+		}
+	}
+
+	transcoded, err := pipeline.Transcoded(song.SongID, filePath, transcode.Options{
+		Format:  format,
+		Bitrate: transcode.ClampBitrate(format, bitrate),
+		GainDB:  gain,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transcode song"})
+		return
+	}
+	defer transcoded.Close()
+
+	if formatParam == "auto" {
+		c.Header("Vary", "Accept")
+	}
+	c.Header("Content-Type", format.ContentType)
+	serveOpenFile(c, transcoded, "", song.UpdatedAt)
 }
 
-func DeleteSongHandler(c *gin.Context, songService *services.SongService) {
+func DeleteSongHandler(c *gin.Context, songService *services.SongService, store *storage.Local) {
 	userID, exists := c.Get("UserID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
@@ -149,21 +312,24 @@ func DeleteSongHandler(c *gin.Context, songService *services.SongService) {
 		return
 	}
 
-	// Delete file from disk
-	userDir := filepath.Join("uploads", userIDStr)
-	filePath := filepath.Join(userDir, song.Filename)
-	os.Remove(filePath)
+	// Delete file and its HLS renditions from disk
+	store.Remove(song.UserID, song.Filename)
+	store.RemoveAll(storage.HLSParts(song.UserID, song.SongID)...)
 
 	// Delete from DB
 	if err := songService.DeleteSong(songID); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete song"})
 		return
 	}
+	// The rest of the album no longer counts the song's loudness
+	if err := songService.UpdateAlbumGain(song.UserID, song.Album); err != nil {
+		log.Printf("Failed to update album gain after deleting %s: %v", song.SongID, err)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Song deleted"})
 }
 
-func UpdateSongHandler(c *gin.Context, songService *services.SongService) {
+func UpdateSongHandler(c *gin.Context, songService *services.SongService, imageService *services.ImageService, processor *processing.Processor) {
 	userID, exists := c.Get("UserID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
@@ -183,8 +349,10 @@ func UpdateSongHandler(c *gin.Context, songService *services.SongService) {
 	}
 
 	var input struct {
-		Title  string `json:"title"`
-		Artist string `json:"artist"`
+		Title     string  `json:"title"`
+		Artist    string  `json:"artist"`
+		Album     *string `json:"album"`
+		ArtworkID *string `json:"artwork_id"`
 	}
 	if err := c.ShouldBindJSON(&input); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
@@ -195,12 +363,30 @@ func UpdateSongHandler(c *gin.Context, songService *services.SongService) {
 		"title":  input.Title,
 		"artist": input.Artist,
 	}
+	if input.Album != nil {
+		updates["album"] = *input.Album
+	}
+	if input.ArtworkID != nil {
+		if *input.ArtworkID != "" && !ownsImage(imageService, *input.ArtworkID, userIDStr) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Artwork image not found"})
+			return
+		}
+		updates["artwork_id"] = *input.ArtworkID
+	}
 
 	if err := songService.UpdateSong(songID, updates); err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update song"})
 		return
 	}
 
+	if input.Album != nil && *input.Album != song.Album {
+		oldAlbum := song.Album
+		song.Album = *input.Album
+		if err := processor.SongAlbumChanged(song, oldAlbum); err != nil {
+			log.Printf("Failed to queue album gain update of %s: %v", song.SongID, err)
+		}
+	}
+
 	c.JSON(http.StatusOK, gin.H{"message": "Song updated"})
 }
 
@@ -228,5 +414,206 @@ func SearchSongsHandler(c *gin.Context, songService *services.SongService) {
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"songs": songs})
+	respondJSON(c, http.StatusOK, gin.H{"songs": songs}, newest(songs, songUpdatedAt))
+}
+
+// songFormat returns the song's stored format, falling back to its file
+// extension for songs uploaded before formats were detected.
+func songFormat(song *models.Song) audio.Format {
+	if f, ok := audio.Lookup(song.Format); ok {
+		return f
+	}
+	f, _ := audio.ByExtension(song.Filename)
+	return f
+}
+
+// clientCanPlay reports whether the client can play the source format
+// natively. Clients list formats in ?supports= or explicit audio types in
+// Accept; anything else (no Accept, */*, audio/*) is assumed to cope.
+func clientCanPlay(c *gin.Context, source audio.Format, supports []string) bool {
+	if source.Name == "" {
+		return true
+	}
+	if len(supports) > 0 {
+		for _, name := range supports {
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == source.Name || (name == "aac" && source == audio.M4A) {
+				return true
+			}
+		}
+		return false
+	}
+
+	accept := c.GetHeader("Accept")
+	if accept == "" || strings.Contains(accept, "*/*") || strings.Contains(accept, "audio/*") {
+		return true
+	}
+	return transcode.Accepts(accept, source.ContentType)
+}
+
+// normalizationGain returns the gain (dB) to apply for the ?normalize= mode,
+// reduced where needed so the song's peak doesn't clip. Songs that haven't
+// been analyzed yet play unchanged.
+func normalizationGain(loudness *models.Loudness, mode string) float64 {
+	if loudness == nil {
+		return 0
+	}
+
+	var gain, peak float64
+	switch mode {
+	case "true", "track":
+		gain, peak = loudness.TrackGainDB, loudness.TrackPeak
+	case "album":
+		gain, peak = loudness.AlbumGainDB, loudness.AlbumPeak
+	default:
+		return 0
+	}
+	if peak > 0 {
+		gain = math.Min(gain, -20*math.Log10(peak))
+	}
+	return gain
+}
+
+// ownedSong loads the song named by the :id param, applying the same
+// authorization rules as StreamSongHandler. It writes the error response
+// itself and reports whether the caller should continue.
+func ownedSong(c *gin.Context, songService *services.SongService) (*models.Song, bool) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return nil, false
+	}
+	userIDStr, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return nil, false
+	}
+
+	song, err := songService.GetSongByID(c.Param("id"))
+	if err != nil || song.UserID != userIDStr {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+		return nil, false
+	}
+	return song, true
+}
+
+// ListDuplicateSongsHandler groups the user's songs that are near-identical
+// recordings according to their acoustic fingerprints
+func ListDuplicateSongsHandler(c *gin.Context, songService *services.SongService, fingerprintService *services.FingerprintService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userIDStr, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	groups, err := fingerprintService.FindDuplicates(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find duplicates"})
+		return
+	}
+
+	songs, err := songService.GetSongsByUserID(userIDStr)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch songs"})
+		return
+	}
+	songsByID := make(map[string]models.Song, len(songs))
+	for _, song := range songs {
+		songsByID[song.SongID] = song
+	}
+
+	result := make([]gin.H, 0, len(groups))
+	for _, group := range groups {
+		groupSongs := make([]models.Song, 0, len(group.SongIDs))
+		for _, id := range group.SongIDs {
+			if song, ok := songsByID[id]; ok {
+				groupSongs = append(groupSongs, song)
+			}
+		}
+		if len(groupSongs) > 1 {
+			result = append(result, gin.H{"songs": groupSongs, "similarity": group.Similarity})
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"duplicates": result})
+}
+
+// MergeSongsHandler keeps one song and deletes its duplicates, repointing
+// playlist entries, plays, stats and queues to the kept song
+func MergeSongsHandler(c *gin.Context, songService *services.SongService, store *storage.Local) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+	userIDStr, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID"})
+		return
+	}
+
+	var input struct {
+		KeepSongID string   `json:"keep_song_id" binding:"required"`
+		SongIDs    []string `json:"song_ids" binding:"required,min=1"`
+	}
+	if err := c.ShouldBindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	keep, err := songService.GetSongByID(input.KeepSongID)
+	if err != nil || keep.UserID != userIDStr {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Song not found"})
+		return
+	}
+
+	var duplicates []*models.Song
+	var duplicateIDs []string
+	for _, id := range input.SongIDs {
+		if id == keep.SongID {
+			continue
+		}
+		song, err := songService.GetSongByID(id)
+		if err != nil || song.UserID != userIDStr {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Song not found: " + id})
+			return
+		}
+		duplicates = append(duplicates, song)
+		duplicateIDs = append(duplicateIDs, id)
+	}
+	if len(duplicateIDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No songs to merge"})
+		return
+	}
+
+	if err := songService.MergeSongs(keep.SongID, duplicateIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to merge songs"})
+		return
+	}
+
+	// Files go only once the merge has committed; a failed merge leaves
+	// every song playable
+	for _, song := range duplicates {
+		// Duplicates may share a filename with the kept song
+		if song.Filename != keep.Filename {
+			store.Remove(song.UserID, song.Filename)
+		}
+		store.RemoveAll(storage.HLSParts(song.UserID, song.SongID)...)
+	}
+	albums := map[string]bool{keep.Album: true}
+	for _, song := range duplicates {
+		albums[song.Album] = true
+	}
+	for album := range albums {
+		if err := songService.UpdateAlbumGain(keep.UserID, album); err != nil {
+			log.Printf("Failed to update album gain after merging into %s: %v", keep.SongID, err)
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Songs merged", "song_id": keep.SongID, "removed": duplicateIDs})
 }
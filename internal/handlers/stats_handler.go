@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"projectpi-backend/internal/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultTopItems = 10
+	maxTopItems     = 50
+)
+
+// statsRanges are the ?range= values of /me/stats, as a number of days
+// ending today. 0 means all time.
+var statsRanges = map[string]int{
+	"week":  7,
+	"month": 30,
+	"year":  365,
+	"all":   0,
+}
+
+// GetStatsHandler returns the user's top songs and artists, listening
+// minutes per day and streaks for ?range=week|month|year|all (default
+// month). Days are in UTC.
+func GetStatsHandler(c *gin.Context, statsService *services.StatsService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	days, ok := statsRanges[c.DefaultQuery("range", "month")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid range (week, month, year or all)"})
+		return
+	}
+	today := time.Now().UTC()
+	from := ""
+	if days > 0 {
+		from = today.AddDate(0, 0, 1-days).Format(services.RollupDayFormat)
+	}
+
+	stats, err := statsService.GetStats(userID.(string), from, today.Format(services.RollupDayFormat), parseTopItems(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch stats"})
+		return
+	}
+
+	respondJSON(c, http.StatusOK, stats, time.Time{})
+}
+
+// GetWrappedHandler returns the user's year in review
+func GetWrappedHandler(c *gin.Context, statsService *services.StatsService) {
+	userID, exists := c.Get("UserID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	year, err := strconv.Atoi(c.Param("year"))
+	if err != nil || year < 2000 || year > time.Now().UTC().Year() {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid year"})
+		return
+	}
+
+	wrapped, err := statsService.GetWrapped(userID.(string), year, parseTopItems(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch wrapped"})
+		return
+	}
+
+	respondJSON(c, http.StatusOK, wrapped, time.Time{})
+}
+
+// parseTopItems reads ?limit=, the number of top songs and artists.
+func parseTopItems(c *gin.Context) int {
+	limit, err := strconv.Atoi(c.Query("limit"))
+	if err != nil || limit < 1 {
+		return defaultTopItems
+	}
+	if limit > maxTopItems {
+		return maxTopItems
+	}
+	return limit
+}
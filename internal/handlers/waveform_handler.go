@@ -0,0 +1,85 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/processing"
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/waveform"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// staleWaveformAfter is how long a waveform may stay pending before it is
+// assumed lost (e.g. to a restart) and queued again.
+const staleWaveformAfter = 15 * time.Minute
+
+// GetWaveformHandler serves a song's waveform peaks in audiowaveform JSON
+// form, or the binary .dat form with ?format=dat. ?samples_per_pixel picks
+// the closest stored resolution. While peaks are being generated it
+// responds 202 Accepted.
+func GetWaveformHandler(c *gin.Context, songService *services.SongService, processor *processing.Processor) {
+	song, ok := ownedSong(c, songService)
+	if !ok {
+		return
+	}
+
+	wf, err := processor.Waveforms.GetWaveformBySongID(song.SongID)
+	if err != nil && err != mongo.ErrNoDocuments {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to fetch waveform"})
+		return
+	}
+	if err == mongo.ErrNoDocuments || (wf.Status == models.StatusPending && time.Since(wf.UpdatedAt) > staleWaveformAfter) {
+		err := processor.QueueWaveform(song)
+		if err == processing.ErrQueueFull {
+			c.Header("Retry-After", "30")
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too busy to generate the waveform, try again later"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue waveform"})
+			return
+		}
+		c.JSON(http.StatusAccepted, gin.H{"status": models.StatusPending})
+		return
+	}
+
+	switch wf.Status {
+	case models.StatusPending:
+		c.JSON(http.StatusAccepted, gin.H{"status": models.StatusPending})
+		return
+	case models.StatusFailed:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"status": models.StatusFailed, "error": "Failed to decode song"})
+		return
+	}
+	if len(wf.Levels) == 0 {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Waveform has no data"})
+		return
+	}
+
+	requested, _ := strconv.Atoi(c.Query("samples_per_pixel"))
+	level := wf.Levels[len(wf.Levels)-1]
+	for _, l := range wf.Levels {
+		if l.SamplesPerPixel >= requested {
+			level = l
+			break
+		}
+	}
+	peaks := waveform.Peaks{
+		SampleRate:      wf.SampleRate,
+		SamplesPerPixel: level.SamplesPerPixel,
+		Data:            level.Data,
+	}
+
+	if c.Query("format") == "dat" {
+		c.Header("Content-Type", "application/octet-stream")
+		c.Status(http.StatusOK)
+		peaks.WriteBinary(c.Writer)
+		return
+	}
+	respondJSON(c, http.StatusOK, peaks.JSON(), wf.UpdatedAt)
+}
@@ -0,0 +1,68 @@
+package jobs
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+type job struct {
+	name string
+	run  func() error
+}
+
+// Queue runs jobs in the background on a fixed number of workers.
+type Queue struct {
+	jobs chan job
+	wg   sync.WaitGroup
+}
+
+// NewQueue starts workers that drain a queue holding up to size pending jobs.
+func NewQueue(workers, size int) *Queue {
+	q := &Queue{jobs: make(chan job, size)}
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	return q
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for j := range q.jobs {
+		if err := j.run(); err != nil {
+			log.Printf("job %s failed: %v", j.name, err)
+		}
+	}
+}
+
+// Enqueue schedules run and reports whether it was accepted. Jobs are
+// dropped rather than blocking the caller when the queue is full; callers
+// are expected to retry lazily.
+func (q *Queue) Enqueue(name string, run func() error) bool {
+	select {
+	case q.jobs <- job{name, run}:
+		return true
+	default:
+		log.Printf("job queue full, dropping %s", name)
+		return false
+	}
+}
+
+// EnqueueWait schedules run, waiting for room in the queue, and reports
+// whether it was accepted before ctx was done. It's for backfills, which
+// shouldn't be dropped but can wait.
+func (q *Queue) EnqueueWait(ctx context.Context, name string, run func() error) bool {
+	select {
+	case q.jobs <- job{name, run}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Close stops accepting jobs and waits for pending ones to finish.
+func (q *Queue) Close() {
+	close(q.jobs)
+	q.wg.Wait()
+}
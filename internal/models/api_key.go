@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// APIKey lets an external player submit listens for a user through the
+// Last.fm and ListenBrainz compatible endpoints. Key is the Last.fm api_key
+// and session key and the ListenBrainz token; Secret signs Last.fm calls.
+type APIKey struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	KeyID      string             `bson:"key_id"`
+	UserID     string             `bson:"user_id"`
+	Name       string             `bson:"name"`
+	Key        string             `bson:"key"`
+	Secret     string             `bson:"secret"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	LastUsedAt time.Time          `bson:"last_used_at"`
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+type Fingerprint struct {
+	ID        primitive.ObjectID `bson:"_id,omitempty"`
+	SongID    string             `bson:"song_id"`
+	UserID    string             `bson:"user_id"`
+	Duration  float64            `bson:"duration"`
+	Data      []byte             `bson:"data"`
+	CreatedAt time.Time          `bson:"created_at"`
+}
+
+// DuplicateGroup is a set of songs that are near-identical recordings.
+type DuplicateGroup struct {
+	SongIDs    []string
+	Similarity float64 // lowest similarity between linked songs in the group
+}
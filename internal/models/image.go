@@ -0,0 +1,29 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Image kinds describe what an uploaded image is used for.
+const (
+	ImageKindSong     = "song"
+	ImageKindAlbum    = "album"
+	ImageKindPlaylist = "playlist"
+	ImageKindAvatar   = "avatar"
+)
+
+type Image struct {
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	ImageID     string             `bson:"image_id"`
+	Kind        string             `bson:"kind"`
+	Filename    string             `bson:"filename"`
+	ContentType string             `bson:"content_type"`
+	Size        int64              `bson:"size"`
+	Width       int                `bson:"width"`
+	Height      int                `bson:"height"`
+	UserID      string             `bson:"user_id"`
+	CreatedAt   time.Time          `bson:"created_at"`
+	UpdatedAt   time.Time          `bson:"updated_at"`
+}
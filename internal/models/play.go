@@ -0,0 +1,59 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Play event types reported by players.
+const (
+	PlayEventStart    = "start"
+	PlayEventProgress = "progress"
+	PlayEventComplete = "complete"
+	PlayEventSkip     = "skip"
+	// PlayEventScrobble is a finished listen submitted by an external
+	// player through the Last.fm or ListenBrainz compatible APIs
+	PlayEventScrobble = "scrobble"
+)
+
+type Play struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     string             `bson:"user_id"`
+	SongID     string             `bson:"song_id"` // empty for scrobbles that match no song
+	Event      string             `bson:"event"`
+	PositionMs int64              `bson:"position_ms"`
+	Device     string             `bson:"device"`
+	SessionID  string             `bson:"session_id"`
+	Timestamp  time.Time          `bson:"timestamp"` // when the event happened on the device
+	CreatedAt  time.Time          `bson:"created_at"`
+
+	// Track as reported by a scrobbling player
+	Title  string `bson:"title,omitempty"`
+	Artist string `bson:"artist,omitempty"`
+	Album  string `bson:"album,omitempty"`
+}
+
+// HistoryEntry is a play joined with the song that was played.
+type HistoryEntry struct {
+	Play `bson:",inline"`
+	Song *Song `bson:"song,omitempty"`
+}
+
+// PlaybackPosition is where a user last stopped in a song, for resuming on
+// any device.
+type PlaybackPosition struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     string             `bson:"user_id"`
+	SongID     string             `bson:"song_id"`
+	PositionMs int64              `bson:"position_ms"`
+	Completed  bool               `bson:"completed"`
+	Device     string             `bson:"device"`
+	UpdatedAt  time.Time          `bson:"updated_at"`
+}
+
+// ContinueListeningEntry is an unfinished song with the position to resume at.
+type ContinueListeningEntry struct {
+	PlaybackPosition `bson:",inline"`
+	Song             Song `bson:"song"`
+}
@@ -6,20 +6,109 @@ import (
 	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
+// Playlist member roles. The owner is the playlist's UserID; everyone else
+// with access is listed in Collaborators.
+const (
+	PlaylistRoleOwner  = "owner"
+	PlaylistRoleEditor = "editor" // may change the playlist and its entries
+	PlaylistRoleViewer = "viewer" // may only read it
+	// PlaylistRolePublic is any signed-in user's on a public playlist: they
+	// may read its songs, but not who added them, who the members are or
+	// download its files.
+	PlaylistRolePublic = "public"
+)
+
+// Playlist visibility levels. Unlisted and public playlists can be read by
+// anyone with a share link; public ones also by any signed-in user.
+const (
+	PlaylistPrivate  = "private"
+	PlaylistUnlisted = "unlisted"
+	PlaylistPublic   = "public"
+)
+
 type Playlist struct {
-	ID          primitive.ObjectID `bson:"_id,omitempty"`
-	PlaylistID  string             `bson:"playlist_id"`
-	Name        string             `bson:"name"`
-	Description string             `bson:"description"`
-	UserID      string             `bson:"user_id"`
-	CreatedAt   time.Time          `bson:"created_at"`
-	UpdatedAt   time.Time          `bson:"updated_at"`
+	ID            primitive.ObjectID     `bson:"_id,omitempty"`
+	PlaylistID    string                 `bson:"playlist_id"`
+	Name          string                 `bson:"name"`
+	Description   string                 `bson:"description"`
+	ArtworkID     string                 `bson:"artwork_id"`
+	UserID        string                 `bson:"user_id"`
+	Visibility    string                 `bson:"visibility"` // empty means private
+	Collaborators []PlaylistCollaborator `bson:"collaborators,omitempty"`
+	Smart         *SmartRules            `bson:"smart,omitempty"`       // set for smart playlists
+	ForkedFrom    string                 `bson:"forked_from,omitempty"` // playlist this one was copied from
+	CreatedAt     time.Time              `bson:"created_at"`
+	UpdatedAt     time.Time              `bson:"updated_at"`
+}
+
+// PlaylistCollaborator is a user the owner invited to a playlist.
+type PlaylistCollaborator struct {
+	UserID  string    `bson:"user_id"`
+	Role    string    `bson:"role"`
+	AddedAt time.Time `bson:"added_at"`
+}
+
+// SmartRules define a smart playlist. Its songs are the owner's songs that
+// match all of the rules (or any, when Match is "any"), computed on every
+// read instead of stored as entries.
+type SmartRules struct {
+	Match string      `bson:"match"` // "all" or "any"
+	Rules []SmartRule `bson:"rules"`
+	Sort  string      `bson:"sort"`  // a rule field, prefixed with "-" for descending
+	Limit int         `bson:"limit"` // 0 for the maximum
+}
+
+// SmartRule is a condition on a song, e.g. {"artist", "contains", "Miles"}
+// or {"added", "in_last", "30"}.
+type SmartRule struct {
+	Field    string `bson:"field"`
+	Operator string `bson:"operator"`
+	Value    string `bson:"value"`
 }
 
+// PlaylistShare is a revocable link token that lets anyone read an
+// unlisted or public playlist and stream its songs without an account.
+type PlaylistShare struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	Token      string             `bson:"token"`
+	PlaylistID string             `bson:"playlist_id"`
+	CreatedBy  string             `bson:"created_by"`
+	CreatedAt  time.Time          `bson:"created_at"`
+}
+
+// PlaylistSong is an entry of a playlist. A song may be in a playlist more
+// than once, so entries are addressed by EntryID. Entries are ordered by
+// Rank; moving an entry only changes its own rank, to a value between its
+// new neighbours'. The song belongs to AddedBy, who may be a collaborator
+// rather than the owner.
 type PlaylistSong struct {
 	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	EntryID    string             `bson:"entry_id"`
 	PlaylistID string             `bson:"playlist_id"`
 	SongID     string             `bson:"song_id"`
-	Position   int                `bson:"position"`
-	CreatedAt  time.Time          `bson:"created_at"`
+	Rank       float64            `bson:"rank"`
+	Position   int                `bson:"-"` // 1-based, computed from Rank on read
+	AddedBy    string             `bson:"added_by"`
+	AddedAt    time.Time          `bson:"added_at"`
+	Note       string             `bson:"note"`
+	// Unavailable is set once the song is deleted. The entry keeps its
+	// place, and Deleted what the song was, so the user can see what was
+	// there.
+	Unavailable bool         `bson:"unavailable"`
+	Deleted     *DeletedSong `bson:"deleted,omitempty"`
+}
+
+// DeletedSong is what a playlist entry remembers of its song once the song
+// is deleted.
+type DeletedSong struct {
+	Title    string  `bson:"title"`
+	Artist   string  `bson:"artist"`
+	Duration float64 `bson:"duration"`
+}
+
+// PlaylistEntry is a playlist entry joined with its song. Song is nil when
+// the song is unavailable, and may only have some fields loaded.
+type PlaylistEntry struct {
+	PlaylistSong `bson:",inline"`
+	Song         *Song `bson:"song,omitempty"`
 }
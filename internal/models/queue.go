@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Repeat modes of a play queue.
+const (
+	RepeatOff = "off"
+	RepeatAll = "all"
+	RepeatOne = "one"
+)
+
+// PlayQueue is a user's server-side playback state, shared by all of their
+// devices.
+type PlayQueue struct {
+	ID                primitive.ObjectID `bson:"_id,omitempty"`
+	UserID            string             `bson:"user_id"`
+	SongIDs           []string           `bson:"song_ids"`
+	CurrentIndex      int                `bson:"current_index"` // index into SongIDs, -1 when empty
+	PositionMs        int64              `bson:"position_ms"`
+	IsPlaying         bool               `bson:"is_playing"`
+	Shuffle           bool               `bson:"shuffle"`
+	ShuffleOrder      []int              `bson:"shuffle_order"` // play order of SongIDs indexes while shuffling
+	Repeat            string             `bson:"repeat"`
+	ActiveDevice      string             `bson:"active_device"`
+	ContextPlaylistID string             `bson:"context_playlist_id"`
+	Version           int64              `bson:"version"`
+	UpdatedAt         time.Time          `bson:"updated_at"`
+}
@@ -7,12 +7,50 @@ import (
 )
 
 type Song struct {
-	ID        primitive.ObjectID `bson:"_id,omitempty"`
-	SongID    string             `bson:"song_id"`
-	Title     string             `bson:"title"`
-	Artist    string             `bson:"artist"`
-	Filename  string             `bson:"filename"`
-	UserID    string             `bson:"user_id"`
-	CreatedAt time.Time          `bson:"created_at"`
-	UpdatedAt time.Time          `bson:"updated_at"`
+	ID          primitive.ObjectID `bson:"_id,omitempty"`
+	SongID      string             `bson:"song_id"`
+	Title       string             `bson:"title"`
+	Artist      string             `bson:"artist"`
+	Album       string             `bson:"album"`
+	Genre       string             `bson:"genre"`
+	ArtworkID   string             `bson:"artwork_id"`
+	Filename    string             `bson:"filename"`
+	Format      string             `bson:"format"`
+	ContentType string             `bson:"content_type"`
+	ContentHash string             `bson:"content_hash"` // hex SHA-256 of the file
+	Codec       string             `bson:"codec"`
+	Duration    float64            `bson:"duration"` // seconds
+	Bitrate     int                `bson:"bitrate"`  // bits per second
+	SampleRate  int                `bson:"sample_rate"`
+	Channels    int                `bson:"channels"`
+	UserID      string             `bson:"user_id"`
+	Loudness    *Loudness          `bson:"loudness,omitempty"`
+	// PendingJobs is the background processing still owed to the song
+	// (Job*), resumed when the API starts
+	PendingJobs []string  `bson:"pending_jobs,omitempty"`
+	CreatedAt   time.Time `bson:"created_at"`
+	UpdatedAt   time.Time `bson:"updated_at"`
+}
+
+// Background processing jobs a song can be owed.
+const (
+	JobLoudness    = "loudness"
+	JobAlbumGain   = "album_gain" // recompute the gain of the song's album
+	JobFingerprint = "fingerprint"
+)
+
+// ReplayGainReference is the target loudness (LUFS) gains are computed against.
+const ReplayGainReference = -18.0
+
+// Loudness holds the EBU R128 analysis of a song and the ReplayGain-style
+// gains derived from it. Peaks are linear sample values (1.0 = full scale).
+type Loudness struct {
+	IntegratedLUFS float64   `bson:"integrated_lufs"`
+	TruePeakDBTP   float64   `bson:"true_peak_dbtp"`
+	RangeLU        float64   `bson:"range_lu"`
+	TrackGainDB    float64   `bson:"track_gain_db"`
+	TrackPeak      float64   `bson:"track_peak"`
+	AlbumGainDB    float64   `bson:"album_gain_db"`
+	AlbumPeak      float64   `bson:"album_peak"`
+	AnalyzedAt     time.Time `bson:"analyzed_at"`
 }
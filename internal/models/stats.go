@@ -0,0 +1,66 @@
+package models
+
+import "go.mongodb.org/mongo-driver/bson/primitive"
+
+// PlayRollup totals a user's listens of one song on one day (UTC). Stats
+// are aggregated from rollups rather than from raw play events.
+type PlayRollup struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	UserID     string             `bson:"user_id"`
+	Day        string             `bson:"day"`     // YYYY-MM-DD
+	SongID     string             `bson:"song_id"` // empty for unmatched scrobbles
+	Title      string             `bson:"title"`
+	Artist     string             `bson:"artist"`
+	Plays      int64              `bson:"plays"`
+	ListenedMs int64              `bson:"listened_ms"`
+}
+
+type SongStat struct {
+	SongID     string `bson:"song_id"`
+	Title      string `bson:"title"`
+	Artist     string `bson:"artist"`
+	Plays      int64  `bson:"plays"`
+	ListenedMs int64  `bson:"listened_ms"`
+}
+
+type ArtistStat struct {
+	Artist     string `bson:"_id"`
+	Plays      int64  `bson:"plays"`
+	ListenedMs int64  `bson:"listened_ms"`
+	Songs      int    `bson:"songs"`
+}
+
+// PeriodStat totals the listens of a day (YYYY-MM-DD) or month (YYYY-MM).
+type PeriodStat struct {
+	Period     string `bson:"_id"`
+	Plays      int64  `bson:"plays"`
+	ListenedMs int64  `bson:"listened_ms"`
+	Minutes    int64  `bson:"minutes"`
+}
+
+// ListeningStats summarizes a user's listening between two days.
+type ListeningStats struct {
+	From          string
+	To            string
+	Plays         int64
+	Minutes       int64
+	TopSongs      []SongStat
+	TopArtists    []ArtistStat
+	Days          []PeriodStat
+	CurrentStreak int // consecutive days with a listen, up to today
+	LongestStreak int
+}
+
+// Wrapped is a user's year in review.
+type Wrapped struct {
+	Year            int
+	Plays           int64
+	Minutes         int64
+	DistinctSongs   int
+	DistinctArtists int
+	TopSongs        []SongStat
+	TopArtists      []ArtistStat
+	Months          []PeriodStat
+	BusiestDay      *PeriodStat
+	LongestStreak   int
+}
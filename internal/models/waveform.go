@@ -0,0 +1,32 @@
+package models
+
+import (
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// Processing states of generated song data such as waveforms.
+const (
+	StatusPending = "pending"
+	StatusReady   = "ready"
+	StatusFailed  = "failed"
+)
+
+type Waveform struct {
+	ID         primitive.ObjectID `bson:"_id,omitempty"`
+	SongID     string             `bson:"song_id"`
+	UserID     string             `bson:"user_id"`
+	Status     string             `bson:"status"`
+	Error      string             `bson:"error,omitempty"`
+	SampleRate int                `bson:"sample_rate"`
+	Levels     []WaveformLevel    `bson:"levels"`
+	CreatedAt  time.Time          `bson:"created_at"`
+	UpdatedAt  time.Time          `bson:"updated_at"`
+}
+
+// WaveformLevel holds 8-bit min/max peak pairs at one resolution.
+type WaveformLevel struct {
+	SamplesPerPixel int    `bson:"samples_per_pixel"`
+	Data            []byte `bson:"data"`
+}
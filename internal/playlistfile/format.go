@@ -0,0 +1,104 @@
+// Package playlistfile reads and writes the playlist files desktop players
+// use: M3U/M3U8, PLS and XSPF.
+package playlistfile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Track is an entry of a playlist file. Formats that don't carry some of
+// the fields leave them empty.
+type Track struct {
+	Location string // URL or file path
+	Title    string
+	Artist   string
+	Album    string
+	Duration float64 // seconds, 0 when unknown
+}
+
+// Format is a playlist file format.
+type Format struct {
+	Name        string
+	ContentType string
+	Ext         string
+	write       func(w io.Writer, title string, tracks []Track) error
+	parse       func(data []byte) (string, []Track, error)
+}
+
+var (
+	M3U8 = Format{Name: "m3u8", ContentType: "audio/x-mpegurl; charset=utf-8", Ext: ".m3u8", write: writeM3U, parse: parseM3U}
+	// M3U files are read and written as UTF-8 too, like M3U8
+	M3U  = Format{Name: "m3u", ContentType: "audio/x-mpegurl", Ext: ".m3u", write: writeM3U, parse: parseM3U}
+	PLS  = Format{Name: "pls", ContentType: "audio/x-scpls", Ext: ".pls", write: writePLS, parse: parsePLS}
+	XSPF = Format{Name: "xspf", ContentType: "application/xspf+xml", Ext: ".xspf", write: writeXSPF, parse: parseXSPF}
+)
+
+var formats = []Format{M3U8, M3U, PLS, XSPF}
+
+var ErrUnknownFormat = errors.New("unknown playlist format")
+
+// ByName returns the format called name, e.g. "pls".
+func ByName(name string) (Format, bool) {
+	for _, f := range formats {
+		if f.Name == strings.ToLower(name) {
+			return f, true
+		}
+	}
+	return Format{}, false
+}
+
+// Detect picks the format of a playlist file from its extension, falling
+// back to its content.
+func Detect(filename string, data []byte) (Format, bool) {
+	ext := strings.ToLower(filepath.Ext(filename))
+	for _, f := range formats {
+		if f.Ext == ext {
+			return f, true
+		}
+	}
+
+	head := bytes.TrimSpace(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+	switch {
+	case bytes.HasPrefix(head, []byte("#EXTM3U")):
+		return M3U8, true
+	case bytes.HasPrefix(bytes.ToLower(head), []byte("[playlist]")):
+		return PLS, true
+	case bytes.HasPrefix(head, []byte("<?xml")) || bytes.HasPrefix(head, []byte("<playlist")):
+		return XSPF, true
+	}
+	return Format{}, false
+}
+
+// Write writes tracks as a playlist file titled title.
+func (f Format) Write(w io.Writer, title string, tracks []Track) error {
+	return f.write(w, title, tracks)
+}
+
+// Parse reads a playlist file, returning its title, if it has one, and
+// its tracks.
+func (f Format) Parse(data []byte) (string, []Track, error) {
+	if f.parse == nil {
+		return "", nil, ErrUnknownFormat
+	}
+	return f.parse(bytes.TrimPrefix(data, []byte("\xef\xbb\xbf")))
+}
+
+// splitArtistTitle splits the "Artist - Title" display names of M3U and
+// PLS files.
+func splitArtistTitle(name string) (string, string) {
+	if artist, title, ok := strings.Cut(name, " - "); ok {
+		return strings.TrimSpace(artist), strings.TrimSpace(title)
+	}
+	return "", strings.TrimSpace(name)
+}
+
+func displayName(track Track) string {
+	if track.Artist == "" {
+		return track.Title
+	}
+	return track.Artist + " - " + track.Title
+}
@@ -0,0 +1,154 @@
+package playlistfile
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tracks := []Track{
+		{Location: "01 Intro.mp3", Title: "Intro", Artist: "The Band", Album: "First", Duration: 61},
+		{Location: "Ünïcode & more #1?.flac", Title: "Ünïcode", Artist: "Ärtist", Album: "Second", Duration: 240},
+		{Location: "https://example.com/stream/SONG-1?expires=1&sig=abc", Title: "Streamed", Artist: "Someone", Duration: 180},
+	}
+
+	tests := []struct {
+		format Format
+		title  string
+		// want is what survives the format: PLS has no albums or
+		// playlist title
+		want      []Track
+		wantTitle string
+	}{
+		{format: M3U8, title: "Mix", want: tracks, wantTitle: "Mix"},
+		{format: M3U, title: "Mix", want: tracks, wantTitle: "Mix"},
+		{format: PLS, title: "Mix", want: withoutAlbums(tracks), wantTitle: ""},
+		{format: XSPF, title: "Mix", want: tracks, wantTitle: "Mix"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format.Name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := tt.format.Write(&buf, tt.title, tracks); err != nil {
+				t.Fatalf("Write() error = %v", err)
+			}
+			title, got, err := tt.format.Parse(buf.Bytes())
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if title != tt.wantTitle {
+				t.Errorf("Parse() title = %q, want %q", title, tt.wantTitle)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() tracks = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func withoutAlbums(tracks []Track) []Track {
+	out := make([]Track, len(tracks))
+	for i, track := range tracks {
+		track.Album = ""
+		out[i] = track
+	}
+	return out
+}
+
+func TestXSPFLocations(t *testing.T) {
+	tests := []struct {
+		name     string
+		location string
+		uri      string
+	}{
+		{"plain file name", "song.mp3", "song.mp3"},
+		{"spaces and reserved characters", "My Song #1?.mp3", "My%20Song%20%231%3F.mp3"},
+		{"relative path", "Album/01 Intro.mp3", "Album/01%20Intro.mp3"},
+		{"colon in the first segment", "a:b.mp3", "./a:b.mp3"},
+		{"URL kept as is", "https://example.com/stream/SONG-1?sig=a&b=c", "https://example.com/stream/SONG-1?sig=a&b=c"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := locationURI(tt.location); got != tt.uri {
+				t.Errorf("locationURI(%q) = %q, want %q", tt.location, got, tt.uri)
+			}
+			if got := locationPath(tt.uri); got != tt.location {
+				t.Errorf("locationPath(%q) = %q, want %q", tt.uri, got, tt.location)
+			}
+		})
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		data   string
+		want   []Track
+	}{
+		{
+			name:   "m3u without extended info",
+			format: M3U,
+			data:   "song one.mp3\r\n\r\nsong two.mp3\n",
+			want:   []Track{{Location: "song one.mp3"}, {Location: "song two.mp3"}},
+		},
+		{
+			name:   "m3u with a BOM and attributes",
+			format: M3U8,
+			data:   "\xef\xbb\xbf#EXTM3U\n#EXTINF:-1 tvg-id=\"x\",Artist - Title\nsong.mp3\n",
+			want:   []Track{{Location: "song.mp3", Artist: "Artist", Title: "Title"}},
+		},
+		{
+			name:   "pls out of order and mixed case",
+			format: PLS,
+			data:   "[playlist]\nFILE2=b.mp3\nfile1=a.mp3\nTitle1=A\nLength1=-1\nNumberOfEntries=2\n",
+			want:   []Track{{Location: "a.mp3", Title: "A"}, {Location: "b.mp3"}},
+		},
+		{
+			name:   "xspf without a namespace and with a file URI",
+			format: XSPF,
+			data:   "<playlist><trackList><track><location>file:///music/My%20Song.mp3</location><duration>1500</duration></track></trackList></playlist>",
+			want:   []Track{{Location: "/music/My Song.mp3", Duration: 1.5}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, got, err := tt.format.Parse([]byte(tt.data))
+			if err != nil {
+				t.Fatalf("Parse() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name     string
+		filename string
+		data     string
+		want     string
+		ok       bool
+	}{
+		{"extension in any case", "mix.M3U8", "", "m3u8", true},
+		{"pls extension", "mix.pls", "", "pls", true},
+		{"m3u content", "upload", "#EXTM3U\n", "m3u8", true},
+		{"pls content", "upload", "[Playlist]\n", "pls", true},
+		{"xspf content", "upload", "<?xml version=\"1.0\"?><playlist/>", "xspf", true},
+		{"unknown", "upload", "just text", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Detect(tt.filename, []byte(tt.data))
+			if ok != tt.ok || got.Name != tt.want {
+				t.Errorf("Detect() = %q, %v, want %q, %v", got.Name, ok, tt.want, tt.ok)
+			}
+		})
+	}
+}
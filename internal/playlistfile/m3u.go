@@ -0,0 +1,72 @@
+package playlistfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// writeM3U writes an extended M3U file. Durations are whole seconds, -1
+// when unknown.
+func writeM3U(w io.Writer, title string, tracks []Track) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "#EXTM3U")
+	if title != "" {
+		fmt.Fprintf(bw, "#PLAYLIST:%s\n", oneLine(title))
+	}
+	for _, track := range tracks {
+		duration := -1
+		if track.Duration > 0 {
+			duration = int(track.Duration)
+		}
+		fmt.Fprintf(bw, "#EXTINF:%d,%s\n", duration, oneLine(displayName(track)))
+		if track.Album != "" {
+			fmt.Fprintf(bw, "#EXTALB:%s\n", oneLine(track.Album))
+		}
+		fmt.Fprintln(bw, oneLine(track.Location))
+	}
+	return bw.Flush()
+}
+
+func parseM3U(data []byte) (string, []Track, error) {
+	var title string
+	var tracks []Track
+	var next Track
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXTINF:"):
+			info, name, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			// The duration may be followed by attributes, e.g. tvg-id="x"
+			if fields := strings.Fields(info); len(fields) > 0 {
+				if duration, err := strconv.ParseFloat(fields[0], 64); err == nil && duration > 0 {
+					next.Duration = duration
+				}
+			}
+			next.Artist, next.Title = splitArtistTitle(name)
+		case strings.HasPrefix(line, "#EXTALB:"):
+			next.Album = strings.TrimSpace(strings.TrimPrefix(line, "#EXTALB:"))
+		case strings.HasPrefix(line, "#EXTART:"):
+			next.Artist = strings.TrimSpace(strings.TrimPrefix(line, "#EXTART:"))
+		case strings.HasPrefix(line, "#PLAYLIST:"):
+			title = strings.TrimSpace(strings.TrimPrefix(line, "#PLAYLIST:"))
+		case strings.HasPrefix(line, "#"):
+		default:
+			next.Location = line
+			tracks = append(tracks, next)
+			next = Track{}
+		}
+	}
+	return title, tracks, scanner.Err()
+}
+
+// oneLine keeps a value from breaking the line-based format
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+}
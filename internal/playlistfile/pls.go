@@ -0,0 +1,88 @@
+package playlistfile
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func writePLS(w io.Writer, title string, tracks []Track) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "[playlist]")
+	for i, track := range tracks {
+		n := i + 1
+		duration := -1
+		if track.Duration > 0 {
+			duration = int(track.Duration)
+		}
+		fmt.Fprintf(bw, "File%d=%s\n", n, oneLine(track.Location))
+		fmt.Fprintf(bw, "Title%d=%s\n", n, oneLine(displayName(track)))
+		fmt.Fprintf(bw, "Length%d=%d\n", n, duration)
+	}
+	fmt.Fprintf(bw, "NumberOfEntries=%d\n", len(tracks))
+	fmt.Fprintln(bw, "Version=2")
+	return bw.Flush()
+}
+
+// parsePLS reads a PLS file. Keys are matched without regard to case, and
+// entries are ordered by their number.
+func parsePLS(data []byte) (string, []Track, error) {
+	entries := make(map[int]*Track)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if !ok {
+			continue
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		value = strings.TrimSpace(value)
+
+		var field string
+		for _, prefix := range []string{"file", "title", "length"} {
+			if strings.HasPrefix(key, prefix) {
+				field = prefix
+				break
+			}
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(key, field))
+		if field == "" || err != nil {
+			continue
+		}
+		entry := entries[n]
+		if entry == nil {
+			entry = &Track{}
+			entries[n] = entry
+		}
+		switch field {
+		case "file":
+			entry.Location = value
+		case "title":
+			entry.Artist, entry.Title = splitArtistTitle(value)
+		case "length":
+			if duration, err := strconv.ParseFloat(value, 64); err == nil && duration > 0 {
+				entry.Duration = duration
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", nil, err
+	}
+
+	numbers := make([]int, 0, len(entries))
+	for n, entry := range entries {
+		if entry.Location != "" {
+			numbers = append(numbers, n)
+		}
+	}
+	sort.Ints(numbers)
+	tracks := make([]Track, 0, len(numbers))
+	for _, n := range numbers {
+		tracks = append(tracks, *entries[n])
+	}
+	return "", tracks, nil
+}
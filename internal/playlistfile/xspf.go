@@ -0,0 +1,114 @@
+package playlistfile
+
+import (
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strings"
+)
+
+type xspfPlaylist struct {
+	XMLName xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version string      `xml:"version,attr"`
+	Title   string      `xml:"title,omitempty"`
+	Tracks  []xspfTrack `xml:"trackList>track"`
+}
+
+type xspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int64  `xml:"duration,omitempty"` // milliseconds
+}
+
+func writeXSPF(w io.Writer, title string, tracks []Track) error {
+	playlist := xspfPlaylist{Version: "1", Title: title}
+	for _, track := range tracks {
+		playlist.Tracks = append(playlist.Tracks, xspfTrack{
+			Location: locationURI(track.Location),
+			Title:    track.Title,
+			Creator:  track.Artist,
+			Album:    track.Album,
+			Duration: int64(track.Duration * 1000),
+		})
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(playlist); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// parseXSPF reads an XSPF file. Tracks with several locations keep one.
+func parseXSPF(data []byte) (string, []Track, error) {
+	// Accept files that leave out the namespace
+	var playlist struct {
+		Title  string      `xml:"title"`
+		Tracks []xspfTrack `xml:"trackList>track"`
+	}
+	if err := xml.Unmarshal(data, &playlist); err != nil {
+		return "", nil, err
+	}
+
+	tracks := make([]Track, 0, len(playlist.Tracks))
+	for _, track := range playlist.Tracks {
+		tracks = append(tracks, Track{
+			Location: locationPath(strings.TrimSpace(track.Location)),
+			Title:    strings.TrimSpace(track.Title),
+			Artist:   strings.TrimSpace(track.Creator),
+			Album:    strings.TrimSpace(track.Album),
+			Duration: float64(track.Duration) / 1000,
+		})
+	}
+	return strings.TrimSpace(playlist.Title), tracks, nil
+}
+
+// locationURI turns a track location into the URI XSPF requires. URLs are
+// kept; file paths become relative URIs with each segment escaped.
+func locationURI(location string) string {
+	if hasScheme(location) {
+		return location
+	}
+	segments := strings.Split(strings.ReplaceAll(location, `\`, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	uri := strings.Join(segments, "/")
+	// A colon in the first segment would read as a scheme
+	if first, _, _ := strings.Cut(uri, "/"); strings.Contains(first, ":") {
+		uri = "./" + uri
+	}
+	return uri
+}
+
+// locationPath turns an XSPF location back into a track location: file
+// URIs and relative URIs become unescaped paths, other URLs are kept.
+func locationPath(uri string) string {
+	u, err := url.Parse(uri)
+	switch {
+	case err != nil:
+		return uri
+	case u.Scheme == "file":
+		return u.Path
+	case hasScheme(uri):
+		return uri
+	}
+	if u.RawQuery != "" || u.Fragment != "" {
+		return uri
+	}
+	return strings.TrimPrefix(u.Path, "./")
+}
+
+// hasScheme reports whether location is a URL rather than a file path. A
+// one letter scheme is a Windows drive, e.g. C:/Music.
+func hasScheme(location string) bool {
+	u, err := url.Parse(location)
+	return err == nil && len(u.Scheme) > 1
+}
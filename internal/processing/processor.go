@@ -0,0 +1,319 @@
+package processing
+
+import (
+	"context"
+	"errors"
+	"log"
+	"math"
+	"time"
+
+	"projectpi-backend/internal/fingerprint"
+	"projectpi-backend/internal/jobs"
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/services"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/transcode"
+	"projectpi-backend/internal/waveform"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// WaveformSampleRate is the rate songs are decoded at for waveform peaks.
+const WaveformSampleRate = 22050
+
+// fingerprintSeconds is how much of each song is fingerprinted; the start of
+// a recording is enough to tell encodes of it apart from other songs.
+const fingerprintSeconds = 120
+
+// WaveformResolutions are the samples-per-pixel levels stored for each song.
+var WaveformResolutions = []int{256, 1024, 4096}
+
+// decodeTimeout bounds decoding a single song.
+const decodeTimeout = 10 * time.Minute
+
+// probeTimeout bounds reading a song's stream information and tags.
+const probeTimeout = 15 * time.Second
+
+// ErrQueueFull is returned when processing couldn't be scheduled because the
+// job queue is full. Nothing is left marked as pending, so asking again
+// later schedules it.
+var ErrQueueFull = errors.New("processing queue is full")
+
+// Processor runs the analysis that follows an upload in the background so
+// /upload doesn't block on decoding.
+type Processor struct {
+	Queue        *jobs.Queue
+	Store        *storage.Local
+	Decoder      transcode.Decoder
+	Prober       transcode.Prober
+	Analyzer     transcode.LoudnessAnalyzer
+	Songs        *services.SongService
+	Waveforms    *services.WaveformService
+	Fingerprints *services.FingerprintService
+}
+
+// ProbeSong fills in the song's stream information from its file, and its
+// title, artist, album and genre from the file's tags where they weren't
+// given. Probing only reads headers, so it runs during the upload.
+func (p *Processor) ProbeSong(song *models.Song) error {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	result, err := p.Prober.Probe(ctx, p.Store.Path(song.UserID, song.Filename))
+	if err != nil {
+		return err
+	}
+
+	song.Codec = result.Codec
+	song.Duration = result.Duration
+	song.Bitrate = result.Bitrate
+	song.SampleRate = result.SampleRate
+	song.Channels = result.Channels
+	for field, tag := range map[*string]string{
+		&song.Title:  "title",
+		&song.Artist: "artist",
+		&song.Album:  "album",
+		&song.Genre:  "genre",
+	} {
+		if *field == "" {
+			*field = result.Tags[tag]
+		}
+	}
+	return nil
+}
+
+// SongUploaded schedules all background processing for a new song. A
+// waveform that couldn't be scheduled is scheduled again when it's first
+// requested; loudness analysis and fingerprinting stay pending on the song
+// and are resumed when the API next starts.
+func (p *Processor) SongUploaded(song *models.Song) {
+	if err := p.QueueWaveform(song); err != nil && err != ErrQueueFull {
+		log.Printf("Failed to queue waveform of %s: %v", song.SongID, err)
+	}
+	if err := p.QueueLoudness(song); err != nil && err != ErrQueueFull {
+		log.Printf("Failed to queue loudness analysis of %s: %v", song.SongID, err)
+	}
+	if err := p.QueueFingerprint(song); err != nil && err != ErrQueueFull {
+		log.Printf("Failed to queue fingerprint of %s: %v", song.SongID, err)
+	}
+}
+
+// QueueWaveform marks the song's waveform as pending and schedules its
+// generation. When the queue is full the pending mark is taken back, so the
+// next request for the waveform schedules it again instead of waiting for it
+// to go stale.
+func (p *Processor) QueueWaveform(song *models.Song) error {
+	if err := p.Waveforms.SetStatus(song.SongID, song.UserID, models.StatusPending, ""); err != nil {
+		return err
+	}
+	s := *song
+	if !p.Queue.Enqueue("waveform "+song.SongID, func() error {
+		return p.generateWaveform(&s)
+	}) {
+		if err := p.Waveforms.DeletePending(song.SongID); err != nil {
+			return err
+		}
+		return ErrQueueFull
+	}
+	return nil
+}
+
+func (p *Processor) generateWaveform(song *models.Song) error {
+	peaks, err := p.computePeaks(song)
+	if err != nil {
+		p.Waveforms.SetStatus(song.SongID, song.UserID, models.StatusFailed, err.Error())
+		return err
+	}
+
+	levels := make([]models.WaveformLevel, len(peaks))
+	for i, level := range peaks {
+		levels[i] = models.WaveformLevel{SamplesPerPixel: level.SamplesPerPixel, Data: level.Data}
+	}
+	return p.Waveforms.SaveWaveform(&models.Waveform{
+		SongID:     song.SongID,
+		UserID:     song.UserID,
+		Status:     models.StatusReady,
+		SampleRate: WaveformSampleRate,
+		Levels:     levels,
+	})
+}
+
+func (p *Processor) computePeaks(song *models.Song) ([]waveform.Peaks, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), decodeTimeout)
+	defer cancel()
+
+	pcm, err := p.Decoder.DecodePCM(ctx, p.Store.Path(song.UserID, song.Filename), WaveformSampleRate)
+	if err != nil {
+		return nil, err
+	}
+	peaks, err := waveform.Compute(pcm, WaveformSampleRate, WaveformResolutions)
+	if closeErr := pcm.Close(); err == nil {
+		err = closeErr
+	}
+	return peaks, err
+}
+
+// QueueLoudness marks the song's loudness analysis as pending and schedules
+// it. When the queue is full the mark stays, and ResumePending schedules the
+// analysis later.
+func (p *Processor) QueueLoudness(song *models.Song) error {
+	if err := p.Songs.MarkPending(song.SongID, models.JobLoudness); err != nil {
+		return err
+	}
+	s := *song
+	if !p.Queue.Enqueue("loudness "+song.SongID, func() error {
+		return p.analyzeLoudness(&s)
+	}) {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// SongAlbumChanged marks the album gain of the song's old and new album as
+// pending and schedules updating them. Like QueueLoudness, the marks stay
+// when the queue is full.
+func (p *Processor) SongAlbumChanged(song *models.Song, oldAlbum string) error {
+	if oldAlbum != "" {
+		if err := p.Songs.MarkAlbumPending(song.UserID, oldAlbum); err != nil {
+			return err
+		}
+	}
+	if err := p.Songs.MarkPending(song.SongID, models.JobAlbumGain); err != nil {
+		return err
+	}
+	s := *song
+	if !p.Queue.Enqueue("album gain "+song.SongID, func() error {
+		if err := p.updateAlbumGain(&s); err != nil {
+			return err
+		}
+		return p.Songs.UpdateAlbumGain(s.UserID, oldAlbum)
+	}) {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+// updateAlbumGain updates the album gain of the song's album, or of the
+// song alone when it has no album.
+func (p *Processor) updateAlbumGain(song *models.Song) error {
+	if song.Album != "" {
+		return p.Songs.UpdateAlbumGain(song.UserID, song.Album)
+	}
+	if err := p.Songs.ResetAlbumGain(song.SongID); err != nil {
+		return err
+	}
+	return p.Songs.ClearPending(song.SongID, models.JobAlbumGain)
+}
+
+// ResumePending schedules the processing songs are still owed, e.g. because
+// the queue was full or the API stopped before it ran. It waits for room in
+// the queue rather than dropping jobs, until ctx is done.
+func (p *Processor) ResumePending(ctx context.Context) error {
+	songs, err := p.Songs.GetPendingSongs()
+	if err != nil {
+		return err
+	}
+
+	type album struct{ userID, name string }
+	albums := make(map[album]bool)
+	for i := range songs {
+		s := songs[i]
+		for _, job := range s.PendingJobs {
+			var run func() error
+			switch job {
+			case models.JobLoudness:
+				run = func() error { return p.analyzeLoudness(&s) }
+			case models.JobFingerprint:
+				run = func() error { return p.computeFingerprint(&s) }
+			case models.JobAlbumGain:
+				// One update covers every song of the album
+				if s.Album != "" && albums[album{s.UserID, s.Album}] {
+					continue
+				}
+				albums[album{s.UserID, s.Album}] = true
+				run = func() error { return p.updateAlbumGain(&s) }
+			default:
+				continue
+			}
+			if !p.Queue.EnqueueWait(ctx, job+" "+s.SongID, run) {
+				return ctx.Err()
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Processor) analyzeLoudness(song *models.Song) error {
+	ctx, cancel := context.WithTimeout(context.Background(), decodeTimeout)
+	defer cancel()
+
+	l, err := p.Analyzer.AnalyzeLoudness(ctx, p.Store.Path(song.UserID, song.Filename))
+	if err != nil {
+		return err
+	}
+
+	// Until the rest of the album is known a track is its own album
+	trackGain := models.ReplayGainReference - l.Integrated
+	trackPeak := math.Pow(10, l.TruePeak/20)
+	loudness := models.Loudness{
+		IntegratedLUFS: l.Integrated,
+		TruePeakDBTP:   l.TruePeak,
+		RangeLU:        l.Range,
+		TrackGainDB:    trackGain,
+		TrackPeak:      trackPeak,
+		AlbumGainDB:    trackGain,
+		AlbumPeak:      trackPeak,
+		AnalyzedAt:     time.Now(),
+	}
+	if err := p.Songs.UpdateSong(song.SongID, bson.M{"loudness": loudness}); err != nil {
+		return err
+	}
+	if err := p.Songs.UpdateAlbumGain(song.UserID, song.Album); err != nil {
+		return err
+	}
+	return p.Songs.ClearPending(song.SongID, models.JobLoudness)
+}
+
+// QueueFingerprint marks the song's acoustic fingerprint as pending and
+// schedules computing it. Like QueueLoudness, the mark stays when the queue
+// is full.
+func (p *Processor) QueueFingerprint(song *models.Song) error {
+	if err := p.Songs.MarkPending(song.SongID, models.JobFingerprint); err != nil {
+		return err
+	}
+	s := *song
+	if !p.Queue.Enqueue("fingerprint "+song.SongID, func() error {
+		return p.computeFingerprint(&s)
+	}) {
+		return ErrQueueFull
+	}
+	return nil
+}
+
+func (p *Processor) computeFingerprint(song *models.Song) error {
+	ctx, cancel := context.WithTimeout(context.Background(), decodeTimeout)
+	defer cancel()
+
+	pcm, err := p.Decoder.DecodePCM(ctx, p.Store.Path(song.UserID, song.Filename), fingerprint.SampleRate)
+	if err != nil {
+		return err
+	}
+	fp, err := fingerprint.Compute(pcm, fingerprintSeconds)
+	if closeErr := pcm.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = p.Fingerprints.SaveFingerprint(&models.Fingerprint{
+		SongID:   song.SongID,
+		UserID:   song.UserID,
+		Duration: song.Duration,
+		Data:     fingerprint.Encode(fp),
+	})
+	if err != nil {
+		return err
+	}
+	return p.Songs.ClearPending(song.SongID, models.JobFingerprint)
+}
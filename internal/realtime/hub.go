@@ -0,0 +1,216 @@
+package realtime
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	writeWait      = 10 * time.Second
+	pongWait       = 60 * time.Second
+	pingPeriod     = pongWait * 9 / 10
+	maxMessageSize = 4096
+	sendBuffer     = 16
+)
+
+// Subprotocol is the WebSocket subprotocol the hub speaks. Browsers can't
+// set an Authorization header on WebSocket requests, so they offer the JWT
+// as a second subprotocol next to it; the hub only ever selects this one.
+const Subprotocol = "projectpi.queue"
+
+// Hub keeps the WebSocket connections of every online device, grouped by
+// user, so state changes can be pushed to all of a user's devices.
+type Hub struct {
+	upgrader websocket.Upgrader
+
+	mu      sync.Mutex
+	clients map[string]map[*Client]struct{}
+}
+
+// Client is one connected device.
+type Client struct {
+	UserID string
+	Device string
+
+	hub    *Hub
+	conn   *websocket.Conn
+	send   chan []byte
+	closed bool
+}
+
+// NewHub returns a hub accepting connections from origins. Requests without
+// an Origin header come from native clients and are always accepted.
+func NewHub(origins []string) *Hub {
+	h := &Hub{clients: make(map[string]map[*Client]struct{})}
+	h.upgrader = websocket.Upgrader{
+		Subprotocols: []string{Subprotocol},
+		CheckOrigin: func(r *http.Request) bool {
+			origin := r.Header.Get("Origin")
+			if origin == "" {
+				return true
+			}
+			for _, allowed := range origins {
+				if allowed == "*" || allowed == origin {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	return h
+}
+
+// Connect upgrades the request and registers the connection as device of
+// userID. Callers must call Listen on the returned client.
+func (h *Hub) Connect(w http.ResponseWriter, r *http.Request, userID string, device string) (*Client, error) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &Client{
+		UserID: userID,
+		Device: device,
+		hub:    h,
+		conn:   conn,
+		send:   make(chan []byte, sendBuffer),
+	}
+	h.mu.Lock()
+	if h.clients[userID] == nil {
+		h.clients[userID] = make(map[*Client]struct{})
+	}
+	h.clients[userID][client] = struct{}{}
+	h.mu.Unlock()
+
+	go client.writeLoop()
+	return client, nil
+}
+
+// Broadcast sends message to every connected device of userID.
+func (h *Hub) Broadcast(userID string, message []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for client := range h.clients[userID] {
+		client.enqueue(message)
+	}
+}
+
+// Devices lists the names of userID's connected devices.
+func (h *Hub) Devices(userID string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	seen := make(map[string]bool)
+	devices := []string{}
+	for client := range h.clients[userID] {
+		if !seen[client.Device] {
+			seen[client.Device] = true
+			devices = append(devices, client.Device)
+		}
+	}
+	sort.Strings(devices)
+	return devices
+}
+
+// Close disconnects every client. http.Server.Shutdown doesn't track
+// hijacked connections, so this is registered as a shutdown hook.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, clients := range h.clients {
+		for client := range clients {
+			client.close()
+		}
+	}
+}
+
+// Send sends message to this device only.
+func (c *Client) Send(message []byte) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	c.enqueue(message)
+}
+
+// Listen passes each message from the device to handle until the
+// connection closes, then unregisters the client.
+func (c *Client) Listen(handle func(message []byte)) {
+	defer c.unregister()
+
+	c.conn.SetReadLimit(maxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	for {
+		_, message, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		handle(message)
+	}
+}
+
+// enqueue must be called with the hub locked. A device that can't keep up
+// is disconnected rather than left with stale state; it resyncs on
+// reconnect.
+func (c *Client) enqueue(message []byte) {
+	if c.closed {
+		return
+	}
+	select {
+	case c.send <- message:
+	default:
+		c.close()
+	}
+}
+
+// close must be called with the hub locked.
+func (c *Client) close() {
+	if !c.closed {
+		c.closed = true
+		close(c.send)
+	}
+}
+
+func (c *Client) unregister() {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	c.close()
+	if clients := c.hub.clients[c.UserID]; clients != nil {
+		delete(clients, c)
+		if len(clients) == 0 {
+			delete(c.hub.clients, c.UserID)
+		}
+	}
+}
+
+func (c *Client) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case message, ok := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
+				return
+			}
+			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
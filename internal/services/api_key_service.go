@@ -0,0 +1,98 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type APIKeyService struct {
+	DB *mongo.Database
+}
+
+func (s *APIKeyService) CreateAPIKey(key *models.APIKey) error {
+	collection := s.DB.Collection("api_keys")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	key.CreatedAt = time.Now()
+	_, err := collection.InsertOne(ctx, key)
+	return err
+}
+
+func (s *APIKeyService) GetAPIKeysByUserID(userID string) ([]models.APIKey, error) {
+	collection := s.DB.Collection("api_keys")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var keys []models.APIKey
+	err = cursor.All(ctx, &keys)
+	return keys, err
+}
+
+func (s *APIKeyService) GetAPIKeyByID(keyID string) (*models.APIKey, error) {
+	return s.findAPIKey(bson.M{"key_id": keyID})
+}
+
+// GetAPIKeyByKey looks up the key a player authenticates with.
+func (s *APIKeyService) GetAPIKeyByKey(key string) (*models.APIKey, error) {
+	if key == "" {
+		return nil, mongo.ErrNoDocuments
+	}
+	return s.findAPIKey(bson.M{"key": key})
+}
+
+func (s *APIKeyService) findAPIKey(filter bson.M) (*models.APIKey, error) {
+	collection := s.DB.Collection("api_keys")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var key models.APIKey
+	err := collection.FindOne(ctx, filter).Decode(&key)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+func (s *APIKeyService) DeleteAPIKey(keyID string) error {
+	collection := s.DB.Collection("api_keys")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"key_id": keyID})
+	return err
+}
+
+// TouchAPIKey records that the key was just used.
+func (s *APIKeyService) TouchAPIKey(keyID string) error {
+	collection := s.DB.Collection("api_keys")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"key_id": keyID}, bson.M{"$set": bson.M{"last_used_at": time.Now()}})
+	return err
+}
+
+func (s *APIKeyService) EnsureIndexes() error {
+	collection := s.DB.Collection("api_keys")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "key", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
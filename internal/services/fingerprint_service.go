@@ -0,0 +1,125 @@
+package services
+
+import (
+	"context"
+	"math"
+	"sort"
+	"time"
+
+	"projectpi-backend/internal/fingerprint"
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// DuplicateThreshold is the fingerprint similarity above which two songs are
+// considered the same recording.
+const DuplicateThreshold = 0.85
+
+type FingerprintService struct {
+	DB *mongo.Database
+}
+
+func (s *FingerprintService) SaveFingerprint(fp *models.Fingerprint) error {
+	collection := s.DB.Collection("fingerprints")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	fp.CreatedAt = time.Now()
+	_, err := collection.ReplaceOne(ctx, bson.M{"song_id": fp.SongID}, fp, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (s *FingerprintService) GetFingerprintsByUserID(userID string) ([]models.Fingerprint, error) {
+	collection := s.DB.Collection("fingerprints")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var fingerprints []models.Fingerprint
+	err = cursor.All(ctx, &fingerprints)
+	return fingerprints, err
+}
+
+// FindDuplicates groups the user's songs whose fingerprints match. Songs are
+// only compared when their durations are close, which keeps the pairwise
+// comparison cheap for personal libraries.
+func (s *FingerprintService) FindDuplicates(userID string) ([]models.DuplicateGroup, error) {
+	fingerprints, err := s.GetFingerprintsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(fingerprints, func(i, j int) bool { return fingerprints[i].Duration < fingerprints[j].Duration })
+
+	decoded := make([][]uint32, len(fingerprints))
+	for i, fp := range fingerprints {
+		decoded[i] = fingerprint.Decode(fp.Data)
+	}
+
+	// Union-find over matching pairs
+	parent := make([]int, len(fingerprints))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	lowest := make(map[int]float64)
+
+	for i := range fingerprints {
+		for j := i + 1; j < len(fingerprints); j++ {
+			a, b := fingerprints[i].Duration, fingerprints[j].Duration
+			if a > 0 && b-a > math.Max(5, 0.05*b) {
+				break
+			}
+			similarity := fingerprint.Similarity(decoded[i], decoded[j])
+			if similarity < DuplicateThreshold {
+				continue
+			}
+			ri, rj := find(i), find(j)
+			low := similarity
+			for _, r := range []int{ri, rj} {
+				if v, ok := lowest[r]; ok && v < low {
+					low = v
+				}
+			}
+			delete(lowest, ri)
+			delete(lowest, rj)
+			parent[ri] = rj
+			lowest[rj] = low
+		}
+	}
+
+	groups := make(map[int]*models.DuplicateGroup)
+	var roots []int
+	for i, fp := range fingerprints {
+		root := find(i)
+		if _, linked := lowest[root]; !linked {
+			continue
+		}
+		group, ok := groups[root]
+		if !ok {
+			group = &models.DuplicateGroup{Similarity: lowest[root]}
+			groups[root] = group
+			roots = append(roots, root)
+		}
+		group.SongIDs = append(group.SongIDs, fp.SongID)
+	}
+
+	result := make([]models.DuplicateGroup, 0, len(roots))
+	for _, root := range roots {
+		result = append(result, *groups[root])
+	}
+	return result, nil
+}
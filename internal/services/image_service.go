@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"os"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/storage"
+	"projectpi-backend/internal/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type ImageService struct {
+	DB *mongo.Database
+}
+
+func (s *ImageService) CreateImage(img *models.Image) error {
+	collection := s.DB.Collection("images")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	img.CreatedAt = time.Now()
+	img.UpdatedAt = time.Now()
+	_, err := collection.InsertOne(ctx, img)
+	return err
+}
+
+func (s *ImageService) GetImageByID(imageID string) (*models.Image, error) {
+	collection := s.DB.Collection("images")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var img models.Image
+	err := collection.FindOne(ctx, bson.M{"image_id": imageID}).Decode(&img)
+	if err != nil {
+		return nil, err
+	}
+	return &img, nil
+}
+
+func (s *ImageService) GetImagesByUserID(userID string) ([]models.Image, error) {
+	collection := s.DB.Collection("images")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var images []models.Image
+	err = cursor.All(ctx, &images)
+	return images, err
+}
+
+func (s *ImageService) DeleteImage(imageID string) error {
+	collection := s.DB.Collection("images")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"image_id": imageID})
+	return err
+}
+
+// MigrateImageSongs moves images that were uploaded through /upload out of
+// the songs collection: the file is moved to where images are stored, an
+// Image is created for it and the song and its playlist entries are
+// removed. The image ID is derived from the song ID, so a rerun after a
+// partial failure picks up where it stopped instead of duplicating images.
+// It returns the number of songs migrated.
+func (s *ImageService) MigrateImageSongs(store *storage.Local) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	songsCollection := s.DB.Collection("songs")
+	cursor, err := songsCollection.Find(ctx, bson.M{
+		"filename": bson.M{"$regex": `\.(jpe?g|png|gif|webp)$`, "$options": "i"},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []models.Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, song := range songs {
+		img := models.Image{
+			ImageID:  "IMAGE-" + strings.TrimPrefix(song.SongID, "SONG-"),
+			Kind:     models.ImageKindSong,
+			Filename: song.Filename,
+			UserID:   song.UserID,
+		}
+		parts := storage.ImageParts(img.UserID, img.ImageID)
+
+		err := store.Rename([]string{song.UserID, song.Filename}, parts)
+		if err != nil && !os.IsNotExist(err) {
+			return migrated, err
+		}
+		if f, err := store.Open(parts...); err == nil {
+			if info, err := f.Stat(); err == nil {
+				img.Size = info.Size()
+			}
+			img.ContentType, img.Width, img.Height, _ = utils.DetectImage(f)
+			f.Close()
+		}
+
+		img.CreatedAt = song.CreatedAt
+		img.UpdatedAt = time.Now()
+		_, err = s.DB.Collection("images").UpdateOne(ctx,
+			bson.M{"image_id": img.ImageID},
+			bson.M{"$setOnInsert": img},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return migrated, err
+		}
+		if _, err := songsCollection.DeleteOne(ctx, bson.M{"song_id": song.SongID}); err != nil {
+			return migrated, err
+		}
+		if _, err := s.DB.Collection("playlist_songs").DeleteMany(ctx, bson.M{"song_id": song.SongID}); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// MigrateImageFiles moves image files stored under their upload name, in
+// the user's song directory, to where images are stored now. Where several
+// images had the same name only the file that survived is left, and it
+// goes to the first of them. It returns the number of files moved.
+func (s *ImageService) MigrateImageFiles(store *storage.Local) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	cursor, err := s.DB.Collection("images").Find(ctx, bson.M{})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var images []models.Image
+	if err := cursor.All(ctx, &images); err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, img := range images {
+		parts := storage.ImageParts(img.UserID, img.ImageID)
+		if store.Exists(parts...) {
+			continue
+		}
+		err := store.Rename([]string{img.UserID, "images", img.Filename}, parts)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return moved, err
+		}
+		moved++
+	}
+	return moved, nil
+}
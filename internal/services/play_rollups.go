@@ -0,0 +1,250 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// RollupDayFormat is the format of PlayRollup.Day. Days are in UTC.
+const RollupDayFormat = "2006-01-02"
+
+// rollupEvents are the play events rollups are computed from.
+var rollupEvents = []string{models.PlayEventStart, models.PlayEventScrobble, models.PlayEventComplete, models.PlayEventSkip}
+
+// rollupDay identifies the rollups of one day of one user.
+type rollupDay struct {
+	userID string
+	day    string
+}
+
+// updateRollups recomputes the rollups of the days plays fall on, along
+// with days whose update failed before. Days are recomputed from the stored
+// plays rather than added to, so retrying one can't count a play twice.
+func (s *PlayService) updateRollups(ctx context.Context, plays []models.Play) error {
+	s.mu.Lock()
+	days := s.staleRollups
+	s.staleRollups = nil
+	s.mu.Unlock()
+	if days == nil {
+		days = make(map[rollupDay]bool)
+	}
+	for _, play := range plays {
+		days[rollupDay{play.UserID, play.Timestamp.UTC().Format(RollupDayFormat)}] = true
+	}
+
+	var err error
+	for day := range days {
+		if err = s.rebuildRollupDay(ctx, day); err != nil {
+			break
+		}
+		delete(days, day)
+	}
+	if len(days) > 0 {
+		s.mu.Lock()
+		if s.staleRollups == nil {
+			s.staleRollups = make(map[rollupDay]bool)
+		}
+		for day := range days {
+			s.staleRollups[day] = true
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// rebuildRollupDay replaces the rollups of a user's day with totals of the
+// plays stored for it. Starts and scrobbles count as a listen; completes
+// and skips add how far the user listened. Each rollup is replaced in
+// place, so readers never see the day empty.
+func (s *PlayService) rebuildRollupDay(ctx context.Context, day rollupDay) error {
+	start, err := time.Parse(RollupDayFormat, day.day)
+	if err != nil {
+		return err
+	}
+	cursor, err := s.DB.Collection("plays").Find(ctx, bson.M{
+		"user_id":   day.userID,
+		"event":     bson.M{"$in": rollupEvents},
+		"timestamp": bson.M{"$gte": start, "$lt": start.AddDate(0, 0, 1)},
+	})
+	if err != nil {
+		return err
+	}
+	var plays []models.Play
+	if err := cursor.All(ctx, &plays); err != nil {
+		return err
+	}
+
+	songs, err := s.rollupSongs(ctx, plays)
+	if err != nil {
+		return err
+	}
+
+	type key struct{ songID, title, artist string }
+	type total struct{ plays, listenedMs int64 }
+	totals := make(map[key]*total)
+	for _, play := range plays {
+		song, matched := songs[play.SongID]
+		duration := int64(song.Duration * 1000)
+
+		var t total
+		switch play.Event {
+		case models.PlayEventStart:
+			t.plays = 1
+		case models.PlayEventScrobble:
+			t.plays = 1
+			t.listenedMs = duration
+		case models.PlayEventComplete:
+			t.listenedMs = play.PositionMs
+			if t.listenedMs == 0 {
+				t.listenedMs = duration
+			}
+		case models.PlayEventSkip:
+			t.listenedMs = play.PositionMs
+		}
+		if t.plays == 0 && t.listenedMs == 0 {
+			continue
+		}
+
+		title, artist := play.Title, play.Artist
+		if matched {
+			title, artist = song.Title, song.Artist
+		}
+		k := key{play.SongID, title, artist}
+		if totals[k] == nil {
+			totals[k] = &total{}
+		}
+		totals[k].plays += t.plays
+		totals[k].listenedMs += t.listenedMs
+	}
+
+	collection := s.DB.Collection("play_rollups")
+	kept := make([]bson.M, 0, len(totals))
+	writes := make([]mongo.WriteModel, 0, len(totals))
+	for k, t := range totals {
+		filter := bson.M{"user_id": day.userID, "day": day.day, "song_id": k.songID, "title": k.title, "artist": k.artist}
+		kept = append(kept, bson.M{"song_id": k.songID, "title": k.title, "artist": k.artist})
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(filter).
+			SetUpdate(bson.M{"$set": bson.M{"plays": t.plays, "listened_ms": t.listenedMs}}).
+			SetUpsert(true))
+	}
+	if len(writes) > 0 {
+		if _, err := collection.BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+	}
+
+	// Songs renamed or merged since leave rollups under their old key
+	stale := bson.M{"user_id": day.userID, "day": day.day}
+	if len(kept) > 0 {
+		stale["$nor"] = kept
+	}
+	_, err = collection.DeleteMany(ctx, stale)
+	return err
+}
+
+// rollupSongs returns the songs played, by song ID.
+func (s *PlayService) rollupSongs(ctx context.Context, plays []models.Play) (map[string]models.Song, error) {
+	seen := make(map[string]bool)
+	songIDs := []string{}
+	for _, play := range plays {
+		if play.SongID != "" && !seen[play.SongID] {
+			seen[play.SongID] = true
+			songIDs = append(songIDs, play.SongID)
+		}
+	}
+	songs := make(map[string]models.Song, len(songIDs))
+	if len(songIDs) == 0 {
+		return songs, nil
+	}
+
+	cursor, err := s.DB.Collection("songs").Find(ctx, bson.M{"song_id": bson.M{"$in": songIDs}},
+		options.Find().SetProjection(bson.M{"song_id": 1, "title": 1, "artist": 1, "duration": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var found []models.Song
+	if err := cursor.All(ctx, &found); err != nil {
+		return nil, err
+	}
+	for _, song := range found {
+		songs[song.SongID] = song
+	}
+	return songs, nil
+}
+
+// RebuildRollups recomputes every user's rollups from their play events,
+// for plays recorded before rollups existed. Days are replaced one at a
+// time, so it can run while the API does. It returns the number of days
+// rebuilt.
+func (s *PlayService) RebuildRollups() (int, error) {
+	ctx := context.Background()
+
+	cursor, err := s.DB.Collection("plays").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"event": bson.M{"$in": rollupEvents}}}},
+		{{Key: "$group", Value: bson.M{"_id": bson.M{
+			"user_id": "$user_id",
+			"day":     bson.M{"$dateToString": bson.M{"format": "%Y-%m-%d", "date": "$timestamp"}},
+		}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	type dayGroup struct {
+		ID struct {
+			UserID string `bson:"user_id"`
+			Day    string `bson:"day"`
+		} `bson:"_id"`
+	}
+	rebuilt := make(map[rollupDay]bool)
+	for cursor.Next(ctx) {
+		var group dayGroup
+		if err := cursor.Decode(&group); err != nil {
+			return len(rebuilt), err
+		}
+		day := rollupDay{group.ID.UserID, group.ID.Day}
+		dayCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		err := s.rebuildRollupDay(dayCtx, day)
+		cancel()
+		if err != nil {
+			return len(rebuilt), err
+		}
+		rebuilt[day] = true
+	}
+	if err := cursor.Err(); err != nil {
+		return len(rebuilt), err
+	}
+
+	// Rollups of days that no longer have any plays
+	rollups, err := s.DB.Collection("play_rollups").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$group", Value: bson.M{"_id": bson.M{"user_id": "$user_id", "day": "$day"}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return len(rebuilt), err
+	}
+	defer rollups.Close(ctx)
+	for rollups.Next(ctx) {
+		var group dayGroup
+		if err := rollups.Decode(&group); err != nil {
+			return len(rebuilt), err
+		}
+		if rebuilt[rollupDay{group.ID.UserID, group.ID.Day}] {
+			continue
+		}
+		_, err := s.DB.Collection("play_rollups").DeleteMany(ctx, bson.M{"user_id": group.ID.UserID, "day": group.ID.Day})
+		if err != nil {
+			return len(rebuilt), err
+		}
+	}
+	return len(rebuilt), rollups.Err()
+}
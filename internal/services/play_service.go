@@ -0,0 +1,518 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+const (
+	// playFlushInterval is how long play events wait in memory at most
+	playFlushInterval = 5 * time.Second
+	// playFlushSize flushes early once this many events are waiting
+	playFlushSize = 500
+	// maxPendingPlays caps the events kept in memory while writes fail;
+	// beyond it the oldest are dropped
+	maxPendingPlays = 50000
+)
+
+// PlayService records play events. Events are buffered and written in
+// batches so that progress pings from many players don't each cost a write.
+type PlayService struct {
+	DB *mongo.Database
+
+	mu      sync.Mutex
+	pending []models.Play
+	// staleRollups are days whose rollups failed to update, retried with
+	// the next flush
+	staleRollups map[rollupDay]bool
+	flush        chan struct{}
+	stop         chan struct{}
+	stopped      chan struct{}
+}
+
+// Start begins flushing buffered events in the background.
+func (s *PlayService) Start() {
+	s.flush = make(chan struct{}, 1)
+	s.stop = make(chan struct{})
+	s.stopped = make(chan struct{})
+
+	go func() {
+		defer close(s.stopped)
+		ticker := time.NewTicker(playFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-s.flush:
+			case <-s.stop:
+				if err := s.Flush(); err != nil {
+					log.Println("Failed to flush play events:", err)
+				}
+				return
+			}
+			if err := s.Flush(); err != nil {
+				log.Println("Failed to flush play events:", err)
+			}
+		}
+	}()
+}
+
+// Close writes any buffered events and stops the background flusher.
+func (s *PlayService) Close() {
+	close(s.stop)
+	<-s.stopped
+}
+
+// RecordPlays buffers events for the next batch write.
+func (s *PlayService) RecordPlays(plays []models.Play) {
+	now := time.Now()
+	s.mu.Lock()
+	for _, play := range plays {
+		// IDs are assigned here so a retried write can't store an event twice
+		play.ID = primitive.NewObjectID()
+		play.CreatedAt = now
+		s.pending = append(s.pending, play)
+	}
+	full := len(s.pending) >= playFlushSize
+	s.mu.Unlock()
+
+	if full {
+		select {
+		case s.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Flush writes buffered events. Only the latest progress event of each
+// listening session in the batch is kept, since earlier ones carry no
+// information a later one doesn't. Events that couldn't be written are put
+// back to be retried with the next batch.
+func (s *PlayService) Flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	s.pending = nil
+	retryRollups := len(s.staleRollups) > 0
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		if retryRollups {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			return s.updateRollups(ctx, nil)
+		}
+		return nil
+	}
+
+	type session struct{ userID, songID, sessionID, device string }
+	latest := make(map[session]int)
+	for i, play := range pending {
+		if play.Event == models.PlayEventProgress {
+			latest[session{play.UserID, play.SongID, play.SessionID, play.Device}] = i
+		}
+	}
+	plays := make([]models.Play, 0, len(pending))
+	docs := make([]interface{}, 0, len(pending))
+	for i, play := range pending {
+		if play.Event == models.PlayEventProgress && latest[session{play.UserID, play.SongID, play.SessionID, play.Device}] != i {
+			continue
+		}
+		plays = append(plays, play)
+		docs = append(docs, play)
+	}
+
+	collection := s.DB.Collection("plays")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// Events stored by an earlier, partly failed attempt collide on _id, and
+	// scrobbles a player submitted twice on the scrobble index
+	_, err := collection.InsertMany(ctx, docs, options.InsertMany().SetOrdered(false))
+	if err != nil && !duplicateKeysOnly(err) {
+		s.requeue(plays)
+		return err
+	}
+	plays = withoutRejected(plays, err)
+
+	// The plays are stored; positions and rollups are updated independently
+	// so a failure in one doesn't leave the other behind
+	positionsErr := s.savePositionsFromPlays(ctx, plays)
+	if err := s.updateRollups(ctx, plays); err != nil {
+		return err
+	}
+	return positionsErr
+}
+
+// withoutRejected removes the plays a bulk insert rejected from plays.
+func withoutRejected(plays []models.Play, err error) []models.Play {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) {
+		return plays
+	}
+	rejected := make(map[int]bool, len(bulkErr.WriteErrors))
+	for _, e := range bulkErr.WriteErrors {
+		rejected[e.Index] = true
+	}
+	stored := make([]models.Play, 0, len(plays))
+	for i, play := range plays {
+		if !rejected[i] {
+			stored = append(stored, play)
+		}
+	}
+	return stored
+}
+
+// requeue puts plays that failed to be written back in front of the events
+// recorded since, dropping the oldest beyond maxPendingPlays.
+func (s *PlayService) requeue(plays []models.Play) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pending = append(plays, s.pending...)
+	if dropped := len(s.pending) - maxPendingPlays; dropped > 0 {
+		log.Printf("Play event buffer full, dropping %d events", dropped)
+		s.pending = s.pending[dropped:]
+	}
+}
+
+// savePositionsFromPlays moves each listened song's resume position to the
+// latest event in the batch.
+func (s *PlayService) savePositionsFromPlays(ctx context.Context, plays []models.Play) error {
+	type key struct{ userID, songID string }
+	latest := make(map[key]models.Play)
+	for _, play := range plays {
+		if play.SongID == "" {
+			continue
+		}
+		k := key{play.UserID, play.SongID}
+		if prev, ok := latest[k]; !ok || !play.Timestamp.Before(prev.Timestamp) {
+			latest[k] = play
+		}
+	}
+
+	writes := make([]mongo.WriteModel, 0, len(latest))
+	for _, play := range latest {
+		position := models.PlaybackPosition{
+			UserID:     play.UserID,
+			SongID:     play.SongID,
+			PositionMs: play.PositionMs,
+			Device:     play.Device,
+			UpdatedAt:  play.Timestamp,
+		}
+		// A finished song starts from the beginning next time
+		if play.Event == models.PlayEventComplete || play.Event == models.PlayEventScrobble {
+			position.PositionMs = 0
+			position.Completed = true
+		}
+		writes = append(writes, positionUpsert(position))
+	}
+	if len(writes) == 0 {
+		return nil
+	}
+	return ignoreDuplicateKeys(s.DB.Collection("playback_positions").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)))
+}
+
+// positionUpsert only replaces a stored position that is older than
+// position. A newer stored position makes the upsert collide with the
+// unique (user_id, song_id) index instead, which callers ignore.
+func positionUpsert(position models.PlaybackPosition) mongo.WriteModel {
+	return mongo.NewUpdateOneModel().
+		SetFilter(bson.M{
+			"user_id":    position.UserID,
+			"song_id":    position.SongID,
+			"updated_at": bson.M{"$lte": position.UpdatedAt},
+		}).
+		SetUpdate(bson.M{"$set": bson.M{
+			"position_ms": position.PositionMs,
+			"completed":   position.Completed,
+			"device":      position.Device,
+			"updated_at":  position.UpdatedAt,
+		}}).
+		SetUpsert(true)
+}
+
+// duplicateKeysOnly reports whether err is made up of duplicate key errors
+// only, i.e. every write it rejected collided with a stored document.
+func duplicateKeysOnly(err error) bool {
+	var writeErrors []mongo.WriteError
+	var bulkErr mongo.BulkWriteException
+	var writeErr mongo.WriteException
+	switch {
+	case errors.As(err, &bulkErr):
+		if bulkErr.WriteConcernError != nil {
+			return false
+		}
+		for _, e := range bulkErr.WriteErrors {
+			writeErrors = append(writeErrors, e.WriteError)
+		}
+	case errors.As(err, &writeErr):
+		if writeErr.WriteConcernError != nil {
+			return false
+		}
+		writeErrors = writeErr.WriteErrors
+	}
+	if len(writeErrors) == 0 {
+		return false
+	}
+	for _, e := range writeErrors {
+		if !mongo.IsDuplicateKeyError(e) {
+			return false
+		}
+	}
+	return true
+}
+
+// ignoreDuplicateKeys drops the error of a bulk write whose only failures
+// are duplicate keys, such as positionUpserts losing to newer positions.
+// Any other error in the batch is returned.
+func ignoreDuplicateKeys(_ *mongo.BulkWriteResult, err error) error {
+	if duplicateKeysOnly(err) {
+		return nil
+	}
+	return err
+}
+
+// SavePosition records where the user stopped in a song.
+func (s *PlayService) SavePosition(position models.PlaybackPosition) error {
+	collection := s.DB.Collection("playback_positions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return ignoreDuplicateKeys(collection.BulkWrite(ctx, []mongo.WriteModel{positionUpsert(position)}))
+}
+
+// GetPositions returns the user's resume positions (ms) for the given songs,
+// or for all songs when songIDs is nil.
+func (s *PlayService) GetPositions(userID string, songIDs []string) (map[string]int64, error) {
+	collection := s.DB.Collection("playback_positions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "position_ms": bson.M{"$gt": 0}}
+	if songIDs != nil {
+		filter["song_id"] = bson.M{"$in": songIDs}
+	}
+	cursor, err := collection.Find(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var positions []models.PlaybackPosition
+	if err := cursor.All(ctx, &positions); err != nil {
+		return nil, err
+	}
+	result := make(map[string]int64, len(positions))
+	for _, position := range positions {
+		result[position.SongID] = position.PositionMs
+	}
+	return result, nil
+}
+
+// GetContinueListening returns the user's unfinished songs, most recently
+// played first. Only songs the user still owns are returned.
+func (s *PlayService) GetContinueListening(userID string, limit int) ([]models.ContinueListeningEntry, error) {
+	collection := s.DB.Collection("playback_positions")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID, "completed": false, "position_ms": bson.M{"$gt": 0}}}},
+		{{Key: "$sort", Value: bson.M{"updated_at": -1}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "songs",
+			"localField":   "song_id",
+			"foreignField": "song_id",
+			"as":           "song",
+		}}},
+		{{Key: "$unwind", Value: "$song"}},
+		{{Key: "$match", Value: bson.M{"song.user_id": userID}}},
+		{{Key: "$limit", Value: int64(limit)}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []models.ContinueListeningEntry
+	err = cursor.All(ctx, &entries)
+	return entries, err
+}
+
+func (s *PlayService) EnsureIndexes() error {
+	collection := s.DB.Collection("plays")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "event", Value: 1}, {Key: "timestamp", Value: -1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	// A player retrying a submission mustn't count a listen twice
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "timestamp", Value: 1},
+			{Key: "artist", Value: 1},
+			{Key: "title", Value: 1},
+		},
+		Options: options.Index().
+			SetUnique(true).
+			SetName("unique_scrobble").
+			SetPartialFilterExpression(bson.M{"event": models.PlayEventScrobble}),
+	})
+	if err != nil {
+		return err
+	}
+
+	// One resume position per user and song; positionUpsert relies on it
+	_, err = s.DB.Collection("playback_positions").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}, {Key: "song_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Collection("play_rollups").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{
+			{Key: "user_id", Value: 1},
+			{Key: "day", Value: 1},
+			{Key: "song_id", Value: 1},
+			{Key: "title", Value: 1},
+			{Key: "artist", Value: 1},
+		},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Smart playlists total a user's plays of each song
+	_, err = s.DB.Collection("play_rollups").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "user_id", Value: 1}, {Key: "song_id", Value: 1}},
+	})
+	return err
+}
+
+// listenEvents are the play events that count as a listen: songs started
+// in ProjectPi and listens scrobbled by external players.
+var listenEvents = []string{models.PlayEventStart, models.PlayEventScrobble}
+
+// GetHistory returns a page of the user's listens, newest first, with the
+// song that was played, and the total number of listens.
+func (s *PlayService) GetHistory(userID string, page int, limit int) ([]models.HistoryEntry, int64, error) {
+	collection := s.DB.Collection("plays")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	filter := bson.M{"user_id": userID, "event": bson.M{"$in": listenEvents}}
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$skip", Value: int64((page - 1) * limit)}},
+		{{Key: "$limit", Value: int64(limit)}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "songs",
+			"localField":   "song_id",
+			"foreignField": "song_id",
+			"as":           "song",
+		}}},
+		{{Key: "$unwind", Value: bson.M{"path": "$song", "preserveNullAndEmptyArrays": true}}},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var history []models.HistoryEntry
+	err = cursor.All(ctx, &history)
+	return history, total, err
+}
+
+// EachListen calls fn with every listen of the user, newest first, stopping
+// at the first error.
+func (s *PlayService) EachListen(ctx context.Context, userID string, fn func(entry models.HistoryEntry) error) error {
+	collection := s.DB.Collection("plays")
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": userID, "event": bson.M{"$in": listenEvents}}}},
+		{{Key: "$sort", Value: bson.D{{Key: "timestamp", Value: -1}, {Key: "_id", Value: -1}}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "songs",
+			"localField":   "song_id",
+			"foreignField": "song_id",
+			"as":           "song",
+		}}},
+		{{Key: "$unwind", Value: bson.M{"path": "$song", "preserveNullAndEmptyArrays": true}}},
+	})
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var entry models.HistoryEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+// MigrateDuplicateScrobbles removes scrobbles submitted more than once,
+// keeping the first, so the unique scrobble index can be created. Rebuild
+// the rollups afterwards. It returns the number of scrobbles removed.
+func (s *PlayService) MigrateDuplicateScrobbles() (int, error) {
+	collection := s.DB.Collection("plays")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"event": models.PlayEventScrobble}}},
+		{{Key: "$sort", Value: bson.M{"_id": 1}}},
+		{{Key: "$group", Value: bson.M{
+			"_id": bson.M{"user_id": "$user_id", "timestamp": "$timestamp", "artist": "$artist", "title": "$title"},
+			"ids": bson.M{"$push": "$_id"},
+		}}},
+		{{Key: "$match", Value: bson.M{"ids.1": bson.M{"$exists": true}}}},
+	}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	removed := 0
+	for cursor.Next(ctx) {
+		var group struct {
+			IDs []primitive.ObjectID `bson:"ids"`
+		}
+		if err := cursor.Decode(&group); err != nil {
+			return removed, err
+		}
+		result, err := collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": group.IDs[1:]}})
+		if err != nil {
+			return removed, err
+		}
+		removed += int(result.DeletedCount)
+	}
+	return removed, cursor.Err()
+}
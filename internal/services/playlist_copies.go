@@ -0,0 +1,286 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var ErrSmartPlaylist = errors.New("smart playlists have no entries to change")
+
+// copyDurationTolerance is how far apart, in seconds, two songs' durations
+// may be for one to stand in for the other in a copy
+const copyDurationTolerance = 3
+
+// DuplicatePlaylist copies one of the owner's playlists into a new private
+// playlist called name. Like a fork, other members' songs are matched to
+// the owner's own (see matchEntries). It returns the copy and how many
+// entries had no match.
+func (s *PlaylistService) DuplicatePlaylist(source *models.Playlist, name string) (*models.Playlist, int, error) {
+	return s.copyPlaylist(source, source.UserID, name)
+}
+
+// ForkPlaylist copies someone else's playlist into userID's library as a
+// new private playlist called name. Other members' songs are theirs to
+// share, and a copy would keep them reachable after the source playlist is
+// gone, so the fork has userID's own copies of them where userID has one
+// (see matchEntries). It returns the fork and how many entries had no
+// match.
+func (s *PlaylistService) ForkPlaylist(source *models.Playlist, userID string, name string) (*models.Playlist, int, error) {
+	return s.copyPlaylist(source, userID, name)
+}
+
+func (s *PlaylistService) copyPlaylist(source *models.Playlist, userID string, name string) (*models.Playlist, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	now := time.Now()
+	playlist := &models.Playlist{
+		PlaylistID:  utils.GeneratePlaylistID(),
+		Name:        name,
+		Description: source.Description,
+		UserID:      userID,
+		Visibility:  models.PlaylistPrivate,
+		Smart:       source.Smart,
+		ForkedFrom:  source.PlaylistID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	// Artwork images are only readable by their owner
+	if userID == source.UserID {
+		playlist.ArtworkID = source.ArtworkID
+	}
+
+	unmatched := 0
+	err := s.inTransaction(ctx, func(ctx context.Context) error {
+		unmatched = 0
+		if _, err := s.DB.Collection("playlists").InsertOne(ctx, playlist); err != nil {
+			return err
+		}
+		if source.Smart != nil {
+			return nil
+		}
+
+		entries, err := s.orderedEntries(ctx, source.PlaylistID)
+		if err != nil {
+			return err
+		}
+		entries, unmatched, err = s.matchEntries(ctx, entries, userID)
+		if err != nil {
+			return err
+		}
+		writes := make([]mongo.WriteModel, 0, len(entries))
+		for i, entry := range entries {
+			entry.ID = primitive.NilObjectID
+			entry.EntryID = utils.GenerateEntryID(uint(i))
+			entry.PlaylistID = playlist.PlaylistID
+			entry.AddedAt = now
+			writes = append(writes, mongo.NewInsertOneModel().SetDocument(entry))
+		}
+		if len(writes) == 0 {
+			return nil
+		}
+		_, err = s.DB.Collection("playlist_songs").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false))
+		return err
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return playlist, unmatched, nil
+}
+
+// MergePlaylists appends the songs in source to target, in source's order,
+// leaving out songs target already has and repeats within source. Other
+// users' songs are matched to userID's own, as in a fork (see
+// matchEntries). With deleteSource the source playlist is deleted in the
+// same transaction. It returns how many entries were added, how many were
+// left out as already there, and how many had no match.
+func (s *PlaylistService) MergePlaylists(target *models.Playlist, source *models.Playlist, userID string, deleteSource bool) (added, skipped, unmatched int, err error) {
+	if target.Smart != nil {
+		return 0, 0, 0, ErrSmartPlaylist
+	}
+	sourceEntries, err := s.GetPlaylistContents(source)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err = s.inTransaction(ctx, func(ctx context.Context) error {
+		added, skipped = 0, 0
+		entries, err := s.orderedEntries(ctx, target.PlaylistID)
+		if err != nil {
+			return err
+		}
+		seen := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			seen[entry.SongID] = true
+		}
+
+		matched, n, err := s.matchEntries(ctx, sourceEntries, userID)
+		if err != nil {
+			return err
+		}
+		unmatched = n
+		var adds []models.PlaylistSong
+		for _, entry := range matched {
+			if seen[entry.SongID] {
+				skipped++
+				continue
+			}
+			seen[entry.SongID] = true
+			adds = append(adds, entry)
+		}
+		if deleteSource {
+			if err := s.deletePlaylist(ctx, source.PlaylistID); err != nil {
+				return err
+			}
+		}
+		if len(adds) == 0 {
+			return nil
+		}
+
+		ranks, err := s.ranksAt(ctx, entries, len(entries), len(adds))
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		writes := make([]mongo.WriteModel, 0, len(adds))
+		for i, entry := range adds {
+			entry.ID = primitive.NilObjectID
+			entry.EntryID = utils.GenerateEntryID(uint(i))
+			entry.PlaylistID = target.PlaylistID
+			entry.Rank = ranks[i]
+			entry.AddedAt = now
+			writes = append(writes, mongo.NewInsertOneModel().SetDocument(entry))
+		}
+		if _, err := s.DB.Collection("playlist_songs").BulkWrite(ctx, writes, options.BulkWrite().SetOrdered(false)); err != nil {
+			return err
+		}
+		added = len(adds)
+		return s.touchPlaylist(ctx, target.PlaylistID)
+	})
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	return added, skipped, unmatched, nil
+}
+
+// matchEntries resolves entries to userID's songs, keeping their order.
+// userID's own entries are kept as they are. Other users' songs, and songs
+// deleted since, are matched to a song of userID's with the same title and
+// artist and a duration within copyDurationTolerance, so a copy never
+// refers to someone else's song. It returns the resolved entries, all
+// added by userID, and how many entries had no match.
+func (s *PlaylistService) matchEntries(ctx context.Context, entries []models.PlaylistSong, userID string) ([]models.PlaylistSong, int, error) {
+	collection := s.DB.Collection("songs")
+	projection := options.Find().SetProjection(bson.M{"song_id": 1, "user_id": 1, "title": 1, "artist": 1, "duration": 1})
+
+	var songIDs []string
+	needsMatch := false
+	for _, entry := range entries {
+		if entry.Unavailable || entry.AddedBy != userID {
+			needsMatch = true
+		}
+		if !entry.Unavailable && entry.AddedBy != userID {
+			songIDs = append(songIDs, entry.SongID)
+		}
+	}
+	if !needsMatch {
+		return entries, 0, nil
+	}
+
+	// What other users' entries are, by who added them
+	type songKey struct{ userID, songID string }
+	others := make(map[songKey]models.Song, len(songIDs))
+	if len(songIDs) > 0 {
+		cursor, err := collection.Find(ctx, bson.M{"song_id": bson.M{"$in": songIDs}}, projection)
+		if err != nil {
+			return nil, 0, err
+		}
+		var songs []models.Song
+		if err := cursor.All(ctx, &songs); err != nil {
+			return nil, 0, err
+		}
+		for _, song := range songs {
+			others[songKey{song.UserID, song.SongID}] = song
+		}
+	}
+
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID}, projection)
+	if err != nil {
+		return nil, 0, err
+	}
+	var library []models.Song
+	if err := cursor.All(ctx, &library); err != nil {
+		return nil, 0, err
+	}
+	byTitle := make(map[string][]models.Song, len(library))
+	for _, song := range library {
+		key := copyMatchKey(song.Title)
+		byTitle[key] = append(byTitle[key], song)
+	}
+
+	matched := make([]models.PlaylistSong, 0, len(entries))
+	unmatched := 0
+	for _, entry := range entries {
+		if !entry.Unavailable && entry.AddedBy == userID {
+			matched = append(matched, entry)
+			continue
+		}
+
+		var want models.Song
+		if song, ok := others[songKey{entry.AddedBy, entry.SongID}]; ok && !entry.Unavailable {
+			want = song
+		} else if entry.Deleted != nil {
+			want = models.Song{Title: entry.Deleted.Title, Artist: entry.Deleted.Artist, Duration: entry.Deleted.Duration}
+		}
+		song := closestSong(byTitle[copyMatchKey(want.Title)], want)
+		if want.Title == "" || song == nil {
+			unmatched++
+			continue
+		}
+		entry.SongID = song.SongID
+		entry.AddedBy = userID
+		entry.Unavailable = false
+		entry.Deleted = nil
+		matched = append(matched, entry)
+	}
+	return matched, unmatched, nil
+}
+
+// closestSong returns the candidate by want's artist whose duration is
+// closest to want's, within copyDurationTolerance, or nil.
+func closestSong(candidates []models.Song, want models.Song) *models.Song {
+	var best *models.Song
+	bestDiff := math.Inf(1)
+	for i := range candidates {
+		song := &candidates[i]
+		if copyMatchKey(song.Artist) != copyMatchKey(want.Artist) {
+			continue
+		}
+		diff := 0.0
+		if want.Duration > 0 && song.Duration > 0 {
+			diff = math.Abs(want.Duration - song.Duration)
+		}
+		if diff <= copyDurationTolerance && diff < bestDiff {
+			best, bestDiff = song, diff
+		}
+	}
+	return best
+}
+
+func copyMatchKey(s string) string {
+	return strings.ToLower(strings.Join(strings.Fields(s), " "))
+}
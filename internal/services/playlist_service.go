@@ -2,16 +2,40 @@ package services
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"sync"
 	"time"
 
 	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/utils"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// playlistRankStep is the rank gap between consecutive entries after a
+// rebalance, leaving room for many moves between them.
+const playlistRankStep = 1024.0
+
+var (
+	ErrPlaylistPosition      = errors.New("position out of range")
+	ErrPlaylistOrder         = errors.New("order must list every entry exactly once")
+	ErrPlaylistEntryNotFound = errors.New("playlist entry not found")
+	ErrCollaboratorNotFound  = errors.New("collaborator not found")
 )
 
 type PlaylistService struct {
 	DB *mongo.Database
+
+	transactions transactionSupport
+
+	// smartSongsCache holds recent evaluations of smart playlists for
+	// HasSong, which runs on every signed stream request
+	smartSongsMu    sync.Mutex
+	smartSongsCache map[string]smartSongSet
 }
 
 func (s *PlaylistService) CreatePlaylist(playlist *models.Playlist) error {
@@ -19,18 +43,26 @@ func (s *PlaylistService) CreatePlaylist(playlist *models.Playlist) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	if playlist.Visibility == "" {
+		playlist.Visibility = models.PlaylistPrivate
+	}
 	playlist.CreatedAt = time.Now()
 	playlist.UpdatedAt = time.Now()
 	_, err := collection.InsertOne(ctx, playlist)
 	return err
 }
 
+// GetPlaylistsByUserID returns the playlists the user owns or collaborates
+// on.
 func (s *PlaylistService) GetPlaylistsByUserID(userID string) ([]models.Playlist, error) {
 	collection := s.DB.Collection("playlists")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{"user_id": userID})
+	cursor, err := collection.Find(ctx, bson.M{"$or": []bson.M{
+		{"user_id": userID},
+		{"collaborators.user_id": userID},
+	}})
 	if err != nil {
 		return nil, err
 	}
@@ -64,12 +96,31 @@ func (s *PlaylistService) UpdatePlaylist(playlistID string, updates bson.M) erro
 	return err
 }
 
-func (s *PlaylistService) DeletePlaylist(playlistID string) error {
+// SetSmartRules makes the playlist a smart playlist with rules, or a
+// regular one again when rules is nil. Entries stored before it became
+// smart are kept and come back then.
+func (s *PlaylistService) SetSmartRules(playlistID string, rules *models.SmartRules) error {
 	collection := s.DB.Collection("playlists")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := collection.DeleteOne(ctx, bson.M{"playlist_id": playlistID})
+	update := bson.M{"$set": bson.M{"smart": rules, "updated_at": time.Now()}}
+	if rules == nil {
+		update = bson.M{"$unset": bson.M{"smart": ""}, "$set": bson.M{"updated_at": time.Now()}}
+	}
+	_, err := collection.UpdateOne(ctx, bson.M{"playlist_id": playlistID}, update)
+	return err
+}
+
+func (s *PlaylistService) DeletePlaylist(playlistID string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.deletePlaylist(ctx, playlistID)
+}
+
+func (s *PlaylistService) deletePlaylist(ctx context.Context, playlistID string) error {
+	_, err := s.DB.Collection("playlists").DeleteOne(ctx, bson.M{"playlist_id": playlistID})
 	if err != nil {
 		return err
 	}
@@ -77,46 +128,678 @@ func (s *PlaylistService) DeletePlaylist(playlistID string) error {
 	// Also delete all songs in this playlist
 	playlistSongsCollection := s.DB.Collection("playlist_songs")
 	_, err = playlistSongsCollection.DeleteMany(ctx, bson.M{"playlist_id": playlistID})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Collection("playlist_shares").DeleteMany(ctx, bson.M{"playlist_id": playlistID})
 	return err
 }
 
-func (s *PlaylistService) AddSongToPlaylist(playlistID string, songID string, position int) error {
-	collection := s.DB.Collection("playlist_songs")
+// SetCollaborator gives userID role on the playlist, inviting them if they
+// aren't a collaborator yet.
+func (s *PlaylistService) SetCollaborator(playlistID string, userID string, role string) error {
+	collection := s.DB.Collection("playlists")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	playlistSong := models.PlaylistSong{
-		PlaylistID: playlistID,
-		SongID:     songID,
-		Position:   position,
-		CreatedAt:  time.Now(),
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"playlist_id": playlistID, "collaborators.user_id": userID},
+		bson.M{"$set": bson.M{"collaborators.$.role": role, "updated_at": time.Now()}})
+	if err != nil || result.MatchedCount > 0 {
+		return err
 	}
 
-	_, err := collection.InsertOne(ctx, playlistSong)
+	// The user_id condition keeps a concurrent invite from adding them twice
+	_, err = collection.UpdateOne(ctx,
+		bson.M{"playlist_id": playlistID, "collaborators.user_id": bson.M{"$ne": userID}},
+		bson.M{
+			"$push": bson.M{"collaborators": models.PlaylistCollaborator{UserID: userID, Role: role, AddedAt: time.Now()}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		})
 	return err
 }
 
+// RemoveCollaborator takes away userID's access to the playlist. Entries
+// they added stay.
+func (s *PlaylistService) RemoveCollaborator(playlistID string, userID string) error {
+	collection := s.DB.Collection("playlists")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.UpdateOne(ctx,
+		bson.M{"playlist_id": playlistID, "collaborators.user_id": userID},
+		bson.M{
+			"$pull": bson.M{"collaborators": bson.M{"user_id": userID}},
+			"$set":  bson.M{"updated_at": time.Now()},
+		})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrCollaboratorNotFound
+	}
+	return nil
+}
+
+// AddSongToPlaylist adds entry to its playlist before the entry at
+// position (1-based), or at the end when position is 0 or past the end. The
+// entry's ID, rank and added time are set.
+func (s *PlaylistService) AddSongToPlaylist(entry *models.PlaylistSong, position int) error {
+	collection := s.DB.Collection("playlist_songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	entries, err := s.orderedEntries(ctx, entry.PlaylistID)
+	if err != nil {
+		return err
+	}
+	index := len(entries)
+	if position > 0 && position <= len(entries) {
+		index = position - 1
+	}
+	rank, err := s.rankAt(ctx, entries, index)
+	if err != nil {
+		return err
+	}
+
+	entry.EntryID = utils.GenerateEntryID(uint(time.Now().UnixNano() % 10000))
+	entry.Rank = rank
+	entry.Position = index + 1
+	entry.AddedAt = time.Now()
+	if _, err := collection.InsertOne(ctx, entry); err != nil {
+		return err
+	}
+	return s.touchPlaylist(ctx, entry.PlaylistID)
+}
+
+// MoveSong moves the entry at position from to position to (both 1-based).
+func (s *PlaylistService) MoveSong(playlistID string, from int, to int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	entries, err := s.orderedEntries(ctx, playlistID)
+	if err != nil {
+		return err
+	}
+	if from < 1 || from > len(entries) {
+		return ErrPlaylistPosition
+	}
+	return s.moveEntry(ctx, entries, from-1, to)
+}
+
+// MoveEntry moves an entry to position to (1-based).
+func (s *PlaylistService) MoveEntry(playlistID string, entryID string, to int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	entries, err := s.orderedEntries(ctx, playlistID)
+	if err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if entry.EntryID == entryID {
+			return s.moveEntry(ctx, entries, i, to)
+		}
+	}
+	return ErrPlaylistEntryNotFound
+}
+
+// moveEntry moves entries[index] to position to. Only the moved entry is
+// written.
+func (s *PlaylistService) moveEntry(ctx context.Context, entries []models.PlaylistSong, index int, to int) error {
+	if to < 1 || to > len(entries) {
+		return ErrPlaylistPosition
+	}
+	if index == to-1 {
+		return nil
+	}
+
+	moved := entries[index]
+	rest := append(append([]models.PlaylistSong{}, entries[:index]...), entries[index+1:]...)
+	rank, err := s.rankAt(ctx, rest, to-1)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Collection("playlist_songs").UpdateOne(ctx, bson.M{"_id": moved.ID}, bson.M{"$set": bson.M{"rank": rank}})
+	if err != nil {
+		return err
+	}
+	return s.touchPlaylist(ctx, moved.PlaylistID)
+}
+
+// ReorderSongs puts the playlist in a new order, given as the IDs of all of
+// its entries. Every entry is re-ranked.
+func (s *PlaylistService) ReorderSongs(playlistID string, order []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	entries, err := s.orderedEntries(ctx, playlistID)
+	if err != nil {
+		return err
+	}
+	if len(order) != len(entries) {
+		return ErrPlaylistOrder
+	}
+	byID := make(map[string]models.PlaylistSong, len(entries))
+	for _, entry := range entries {
+		byID[entry.EntryID] = entry
+	}
+	reordered := make([]models.PlaylistSong, 0, len(entries))
+	for _, entryID := range order {
+		entry, ok := byID[entryID]
+		if !ok {
+			return ErrPlaylistOrder
+		}
+		delete(byID, entryID)
+		reordered = append(reordered, entry)
+	}
+	if err := s.rebalance(ctx, reordered); err != nil {
+		return err
+	}
+	return s.touchPlaylist(ctx, playlistID)
+}
+
+// GetEntry returns an entry of the playlist. Its Position is not set.
+func (s *PlaylistService) GetEntry(playlistID string, entryID string) (*models.PlaylistSong, error) {
+	collection := s.DB.Collection("playlist_songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var entry models.PlaylistSong
+	err := collection.FindOne(ctx, bson.M{"playlist_id": playlistID, "entry_id": entryID}).Decode(&entry)
+	if err == mongo.ErrNoDocuments {
+		return nil, ErrPlaylistEntryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &entry, nil
+}
+
+func (s *PlaylistService) UpdateEntry(playlistID string, entryID string, updates bson.M) error {
+	collection := s.DB.Collection("playlist_songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.UpdateOne(ctx, bson.M{"playlist_id": playlistID, "entry_id": entryID}, bson.M{"$set": updates})
+	if err != nil {
+		return err
+	}
+	if result.MatchedCount == 0 {
+		return ErrPlaylistEntryNotFound
+	}
+	return s.touchPlaylist(ctx, playlistID)
+}
+
+func (s *PlaylistService) RemoveEntry(playlistID string, entryID string) error {
+	collection := s.DB.Collection("playlist_songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.M{"playlist_id": playlistID, "entry_id": entryID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrPlaylistEntryNotFound
+	}
+	return s.touchPlaylist(ctx, playlistID)
+}
+
+// RemoveSongFromPlaylist removes one occurrence of a song, the first in
+// playlist order. Use RemoveEntry to choose which.
 func (s *PlaylistService) RemoveSongFromPlaylist(playlistID string, songID string) error {
 	collection := s.DB.Collection("playlist_songs")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := collection.DeleteOne(ctx, bson.M{"playlist_id": playlistID, "song_id": songID})
+	opts := options.FindOneAndDelete().SetSort(bson.D{{Key: "rank", Value: 1}, {Key: "_id", Value: 1}})
+	err := collection.FindOneAndDelete(ctx, bson.M{"playlist_id": playlistID, "song_id": songID}, opts).Err()
+	if err == mongo.ErrNoDocuments {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.touchPlaylist(ctx, playlistID)
+}
+
+// BatchUpdate removes the entries removeEntryIDs, then adds adds as a
+// block before the entry at position (1-based), or at the end when position
+// is 0 or past the end. The added entries' IDs, ranks and added times are
+// set. Where the server supports transactions (see SupportsTransactions)
+// it all happens in one; elsewhere a failure can leave part of it applied.
+func (s *PlaylistService) BatchUpdate(playlistID string, adds []*models.PlaylistSong, position int, removeEntryIDs []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	apply := func(ctx context.Context) error {
+		collection := s.DB.Collection("playlist_songs")
+		if len(removeEntryIDs) > 0 {
+			_, err := collection.DeleteMany(ctx, bson.M{
+				"playlist_id": playlistID,
+				"entry_id":    bson.M{"$in": removeEntryIDs},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if len(adds) == 0 {
+			return s.touchPlaylist(ctx, playlistID)
+		}
+
+		entries, err := s.orderedEntries(ctx, playlistID)
+		if err != nil {
+			return err
+		}
+		index := len(entries)
+		if position > 0 && position <= len(entries) {
+			index = position - 1
+		}
+		ranks, err := s.ranksAt(ctx, entries, index, len(adds))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now()
+		docs := make([]interface{}, 0, len(adds))
+		for i, entry := range adds {
+			entry.EntryID = utils.GenerateEntryID(uint(i))
+			entry.PlaylistID = playlistID
+			entry.Rank = ranks[i]
+			entry.Position = index + i + 1
+			entry.AddedAt = now
+			docs = append(docs, entry)
+		}
+		if _, err := collection.InsertMany(ctx, docs); err != nil {
+			return err
+		}
+		return s.touchPlaylist(ctx, playlistID)
+	}
+
+	return s.inTransaction(ctx, apply)
+}
+
+// touchPlaylist sets the playlist's updated time after a write to its
+// entries, so Last-Modified covers them.
+func (s *PlaylistService) touchPlaylist(ctx context.Context, playlistID string) error {
+	_, err := s.DB.Collection("playlists").UpdateOne(ctx,
+		bson.M{"playlist_id": playlistID},
+		bson.M{"$set": bson.M{"updated_at": time.Now()}})
 	return err
 }
 
+// SupportsTransactions reports whether the server can run writes such as
+// BatchUpdate's in a transaction, all or nothing.
+func (s *PlaylistService) SupportsTransactions() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.transactions.check(ctx, s.DB)
+}
+
+// inTransaction runs fn in a transaction where the server supports them
+// (see transactionSupport).
+func (s *PlaylistService) inTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return s.transactions.run(ctx, s.DB, fn)
+}
+
+// GetPlaylistSongs returns the playlist's entries in order, with dense
+// positions.
 func (s *PlaylistService) GetPlaylistSongs(playlistID string) ([]models.PlaylistSong, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return s.orderedEntries(ctx, playlistID)
+}
+
+// GetPlaylistContents returns the playlist's entries in order like
+// GetPlaylistSongs, evaluating smart playlists from their rules.
+func (s *PlaylistService) GetPlaylistContents(playlist *models.Playlist) ([]models.PlaylistSong, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if playlist.Smart != nil {
+		return s.smartSongs(ctx, playlist)
+	}
+	return s.orderedEntries(ctx, playlist.PlaylistID)
+}
+
+// GetPlaylistEntries returns a page of the playlist's entries in order,
+// each joined with its song, and the total number of entries. Only songs
+// belonging to the user who added the entry are joined, and only
+// songFields (bson names) of them are loaded. Entries without a song are
+// marked unavailable. A smart playlist is evaluated from its rules.
+func (s *PlaylistService) GetPlaylistEntries(playlist *models.Playlist, songFields []string, page int, limit int) ([]models.PlaylistEntry, int64, error) {
 	collection := s.DB.Collection("playlist_songs")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	cursor, err := collection.Find(ctx, bson.M{"playlist_id": playlistID})
+	if playlist.Smart != nil {
+		return s.smartEntries(ctx, playlist, songFields, page, limit)
+	}
+
+	filter := bson.M{"playlist_id": playlist.PlaylistID}
+	total, err := collection.CountDocuments(ctx, filter)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	projection := bson.M{"song_id": 1}
+	for _, field := range songFields {
+		projection[field] = 1
+	}
+	skip := (page - 1) * limit
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: filter}},
+		{{Key: "$sort", Value: bson.D{{Key: "rank", Value: 1}, {Key: "_id", Value: 1}}}},
+		{{Key: "$skip", Value: int64(skip)}},
+		{{Key: "$limit", Value: int64(limit)}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "songs",
+			"let":  bson.M{"song_id": "$song_id", "added_by": "$added_by"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$song_id", "$$song_id"}},
+					bson.M{"$eq": bson.A{"$user_id", "$$added_by"}},
+				}}}},
+				bson.M{"$project": projection},
+			},
+			"as": "song",
+		}}},
+		{{Key: "$unwind", Value: bson.M{"path": "$song", "preserveNullAndEmptyArrays": true}}},
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var entries []models.PlaylistEntry
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, 0, err
+	}
+	for i := range entries {
+		entries[i].Position = skip + i + 1
+		if entries[i].Song == nil || entries[i].Unavailable {
+			entries[i].Song = nil
+			entries[i].Unavailable = true
+		}
+	}
+	return entries, total, nil
+}
+
+// CountUnavailableEntries returns how many of the playlist's entries have
+// no song: the song was deleted or doesn't belong to whoever added the
+// entry. Smart playlists only hold existing songs.
+func (s *PlaylistService) CountUnavailableEntries(playlist *models.Playlist) (int64, error) {
+	if playlist.Smart != nil {
+		return 0, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := s.DB.Collection("playlist_songs").Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"playlist_id": playlist.PlaylistID}}},
+		{{Key: "$lookup", Value: bson.M{
+			"from": "songs",
+			"let":  bson.M{"song_id": "$song_id", "added_by": "$added_by"},
+			"pipeline": bson.A{
+				bson.M{"$match": bson.M{"$expr": bson.M{"$and": bson.A{
+					bson.M{"$eq": bson.A{"$song_id", "$$song_id"}},
+					bson.M{"$eq": bson.A{"$user_id", "$$added_by"}},
+				}}}},
+				bson.M{"$project": bson.M{"_id": 1}},
+			},
+			"as": "song",
+		}}},
+		{{Key: "$match", Value: bson.M{"$or": bson.A{
+			bson.M{"unavailable": true},
+			bson.M{"song": bson.M{"$size": 0}},
+		}}}},
+		{{Key: "$count", Value: "unavailable"}},
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Unavailable int64 `bson:"unavailable"`
+	}
+	if err := cursor.All(ctx, &result); err != nil || len(result) == 0 {
+		return 0, err
+	}
+	return result[0].Unavailable, nil
+}
+
+func (s *PlaylistService) orderedEntries(ctx context.Context, playlistID string) ([]models.PlaylistSong, error) {
+	collection := s.DB.Collection("playlist_songs")
+
+	opts := options.Find().SetSort(bson.D{{Key: "rank", Value: 1}, {Key: "_id", Value: 1}})
+	cursor, err := collection.Find(ctx, bson.M{"playlist_id": playlistID}, opts)
 	if err != nil {
 		return nil, err
 	}
 	defer cursor.Close(ctx)
 
 	var playlistSongs []models.PlaylistSong
-	err = cursor.All(ctx, &playlistSongs)
-	return playlistSongs, err
+	if err := cursor.All(ctx, &playlistSongs); err != nil {
+		return nil, err
+	}
+	for i := range playlistSongs {
+		playlistSongs[i].Position = i + 1
+	}
+	return playlistSongs, nil
+}
+
+// rankAt returns a rank that places an entry at index of entries, between
+// its would-be neighbours.
+func (s *PlaylistService) rankAt(ctx context.Context, entries []models.PlaylistSong, index int) (float64, error) {
+	ranks, err := s.ranksAt(ctx, entries, index, 1)
+	if err != nil {
+		return 0, err
+	}
+	return ranks[0], nil
+}
+
+// ranksAt returns n increasing ranks that place a block of entries at index
+// of entries. When they don't fit between the neighbours as floats the
+// playlist is re-ranked first.
+func (s *PlaylistService) ranksAt(ctx context.Context, entries []models.PlaylistSong, index int, n int) ([]float64, error) {
+	if ranks, ok := ranksBetween(entries, index, n); ok {
+		return ranks, nil
+	}
+	if err := s.rebalance(ctx, entries); err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		entries[i].Rank = float64(i+1) * playlistRankStep
+	}
+	ranks, _ := ranksBetween(entries, index, n)
+	return ranks, nil
+}
+
+func ranksBetween(entries []models.PlaylistSong, index int, n int) ([]float64, bool) {
+	ranks := make([]float64, n)
+	switch {
+	case len(entries) == 0:
+		for i := range ranks {
+			ranks[i] = float64(i+1) * playlistRankStep
+		}
+		return ranks, true
+	case index == 0:
+		for i := range ranks {
+			ranks[i] = entries[0].Rank - float64(n-i)*playlistRankStep
+		}
+		return ranks, true
+	case index >= len(entries):
+		for i := range ranks {
+			ranks[i] = entries[len(entries)-1].Rank + float64(i+1)*playlistRankStep
+		}
+		return ranks, true
+	}
+
+	lo, hi := entries[index-1].Rank, entries[index].Rank
+	previous := lo
+	for i := range ranks {
+		ranks[i] = lo + (hi-lo)*float64(i+1)/float64(n+1)
+		if ranks[i] <= previous || ranks[i] >= hi {
+			return nil, false
+		}
+		previous = ranks[i]
+	}
+	return ranks, true
+}
+
+// rebalance spaces out the ranks of entries, in the given order.
+func (s *PlaylistService) rebalance(ctx context.Context, entries []models.PlaylistSong) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	writes := make([]mongo.WriteModel, 0, len(entries))
+	for i, entry := range entries {
+		writes = append(writes, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"_id": entry.ID}).
+			SetUpdate(bson.M{"$set": bson.M{"rank": float64(i+1) * playlistRankStep}}))
+	}
+	_, err := s.DB.Collection("playlist_songs").BulkWrite(ctx, writes)
+	return err
+}
+
+func (s *PlaylistService) EnsureIndexes() error {
+	collection := s.DB.Collection("playlist_songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "playlist_id", Value: 1}, {Key: "rank", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "playlist_id", Value: 1}, {Key: "entry_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = s.DB.Collection("playlists").Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "collaborators.user_id", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.ensureShareIndexes(ctx)
+}
+
+// MigratePlaylistRanks ranks the entries of playlists created before
+// entries had ranks, in their old position order. Entries added since, which
+// already have a rank, keep their order after the old ones. It returns the
+// number of playlists migrated.
+func (s *PlaylistService) MigratePlaylistRanks() (int, error) {
+	collection := s.DB.Collection("playlist_songs")
+	ctx := context.Background()
+
+	playlistIDs, err := collection.Distinct(ctx, "playlist_id", bson.M{"rank": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+
+	migrated := 0
+	for _, value := range playlistIDs {
+		playlistID, ok := value.(string)
+		if !ok {
+			continue
+		}
+
+		cursor, err := collection.Find(ctx, bson.M{"playlist_id": playlistID})
+		if err != nil {
+			return migrated, err
+		}
+		var entries []struct {
+			ID        primitive.ObjectID `bson:"_id"`
+			Rank      *float64           `bson:"rank"`
+			Position  int                `bson:"position"`
+			CreatedAt time.Time          `bson:"created_at"`
+		}
+		err = cursor.All(ctx, &entries)
+		cursor.Close(ctx)
+		if err != nil {
+			return migrated, err
+		}
+
+		sort.SliceStable(entries, func(i, j int) bool {
+			a, b := entries[i], entries[j]
+			switch {
+			case (a.Rank == nil) != (b.Rank == nil):
+				return a.Rank == nil
+			case a.Rank != nil:
+				return *a.Rank < *b.Rank
+			case a.Position != b.Position:
+				return a.Position < b.Position
+			}
+			return a.CreatedAt.Before(b.CreatedAt)
+		})
+		ordered := make([]models.PlaylistSong, 0, len(entries))
+		for _, entry := range entries {
+			ordered = append(ordered, models.PlaylistSong{ID: entry.ID})
+		}
+		if err := s.rebalance(ctx, ordered); err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// MigratePlaylistEntries gives entries created before entries had IDs an
+// entry ID, and records their creation time as added time and the playlist
+// owner as who added them. It returns the number of entries migrated.
+func (s *PlaylistService) MigratePlaylistEntries() (int, error) {
+	collection := s.DB.Collection("playlist_songs")
+	ctx := context.Background()
+
+	cursor, err := collection.Find(ctx, bson.M{"entry_id": bson.M{"$exists": false}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	owners := make(map[string]string)
+	migrated := 0
+	for cursor.Next(ctx) {
+		var entry struct {
+			ID         primitive.ObjectID `bson:"_id"`
+			PlaylistID string             `bson:"playlist_id"`
+			CreatedAt  time.Time          `bson:"created_at"`
+		}
+		if err := cursor.Decode(&entry); err != nil {
+			return migrated, err
+		}
+
+		owner, ok := owners[entry.PlaylistID]
+		if !ok {
+			if playlist, err := s.GetPlaylistByID(entry.PlaylistID); err == nil {
+				owner = playlist.UserID
+			}
+			owners[entry.PlaylistID] = owner
+		}
+
+		// created_at and position are left for the playlist-ranks migration
+		_, err := collection.UpdateOne(ctx, bson.M{"_id": entry.ID}, bson.M{"$set": bson.M{
+			"entry_id": utils.GenerateEntryID(uint(migrated % 10000)),
+			"added_at": entry.CreatedAt,
+			"added_by": owner,
+		}})
+		if err != nil {
+			return migrated, err
+		}
+		migrated++
+	}
+	return migrated, cursor.Err()
 }
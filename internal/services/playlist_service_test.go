@@ -0,0 +1,277 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math"
+	"reflect"
+	"testing"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo/integration/mtest"
+)
+
+func entriesRanked(ranks ...float64) []models.PlaylistSong {
+	entries := make([]models.PlaylistSong, len(ranks))
+	for i, rank := range ranks {
+		entries[i].Rank = rank
+	}
+	return entries
+}
+
+func TestRanksBetween(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []models.PlaylistSong
+		index   int
+		n       int
+		want    []float64
+		ok      bool
+	}{
+		{
+			name:    "empty playlist",
+			entries: nil,
+			index:   0,
+			n:       3,
+			want:    []float64{1024, 2048, 3072},
+			ok:      true,
+		},
+		{
+			name:    "before the first entry",
+			entries: entriesRanked(1024, 2048),
+			index:   0,
+			n:       2,
+			want:    []float64{-1024, 0},
+			ok:      true,
+		},
+		{
+			name:    "after the last entry",
+			entries: entriesRanked(1024, 2048),
+			index:   2,
+			n:       2,
+			want:    []float64{3072, 4096},
+			ok:      true,
+		},
+		{
+			name:    "past the end appends",
+			entries: entriesRanked(1024),
+			index:   5,
+			n:       1,
+			want:    []float64{2048},
+			ok:      true,
+		},
+		{
+			name:    "between two entries",
+			entries: entriesRanked(1024, 2048),
+			index:   1,
+			n:       3,
+			want:    []float64{1280, 1536, 1792},
+			ok:      true,
+		},
+		{
+			name:    "no room between equal ranks",
+			entries: entriesRanked(1024, 1024),
+			index:   1,
+			n:       1,
+			ok:      false,
+		},
+		{
+			name:    "no room between adjacent floats",
+			entries: entriesRanked(1024, math.Nextafter(1024, 2048)),
+			index:   1,
+			n:       1,
+			ok:      false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ranksBetween(tt.entries, tt.index, tt.n)
+			if ok != tt.ok {
+				t.Fatalf("ranksBetween() ok = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				return
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("ranksBetween() = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("ranksBetween() = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRanksAtRebalancesWhenAdjacent(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("insert between the first two entries", func(mt *mtest.T) {
+		s := &PlaylistService{DB: mt.DB}
+		entries := entriesRanked(1024, 2048)
+		for i := range entries {
+			entries[i].ID = primitive.NewObjectID()
+		}
+		mt.AddMockResponses(mtest.CreateSuccessResponse())
+
+		// Each insert halves the gap after the first entry until no float
+		// fits in it
+		for inserts := 0; ; inserts++ {
+			if inserts > 100 {
+				mt.Fatal("ranksAt() never rebalanced")
+			}
+			ranks, err := s.ranksAt(context.Background(), entries, 1, 1)
+			if err != nil {
+				mt.Fatalf("ranksAt() error = %v", err)
+			}
+			if ranks[0] <= entries[0].Rank || ranks[0] >= entries[1].Rank {
+				mt.Fatalf("ranksAt() = %v, not between %v and %v", ranks[0], entries[0].Rank, entries[1].Rank)
+			}
+
+			if event := mt.GetStartedEvent(); event != nil {
+				if event.CommandName != "update" {
+					mt.Fatalf("rebalance ran %q, want update", event.CommandName)
+				}
+				updates, _ := event.Command.Lookup("updates").Array().Values()
+				if len(updates) != len(entries) {
+					mt.Errorf("rebalance updated %d entries, want %d", len(updates), len(entries))
+				}
+				for i, entry := range entries {
+					if want := float64(i+1) * playlistRankStep; entry.Rank != want {
+						mt.Errorf("entry %d rank = %v after rebalance, want %v", i, entry.Rank, want)
+					}
+				}
+				if inserts < 10 {
+					mt.Errorf("rebalanced after %d inserts, want many", inserts)
+				}
+				return
+			}
+
+			inserted := models.PlaylistSong{ID: primitive.NewObjectID(), Rank: ranks[0]}
+			entries = append(entries[:1], append([]models.PlaylistSong{inserted}, entries[1:]...)...)
+		}
+	})
+}
+
+func TestRemoveEntryOfDuplicate(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+
+	mt.Run("removes only the chosen entry", func(mt *mtest.T) {
+		s := &PlaylistService{DB: mt.DB}
+		mt.AddMockResponses(
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}),
+			mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 1}, bson.E{Key: "nModified", Value: 1}),
+		)
+
+		// The playlist has SONG-1 twice, as ENTRY-1 and ENTRY-2
+		if err := s.RemoveEntry("PLAYLIST-1", "ENTRY-2"); err != nil {
+			mt.Fatalf("RemoveEntry() error = %v", err)
+		}
+
+		event := mt.GetStartedEvent()
+		if event == nil || event.CommandName != "delete" {
+			mt.Fatalf("RemoveEntry() didn't delete")
+		}
+		var command struct {
+			Deletes []struct {
+				Q     bson.M `bson:"q"`
+				Limit int    `bson:"limit"`
+			} `bson:"deletes"`
+		}
+		if err := bson.Unmarshal(event.Command, &command); err != nil {
+			mt.Fatal(err)
+		}
+		want := bson.M{"playlist_id": "PLAYLIST-1", "entry_id": "ENTRY-2"}
+		if len(command.Deletes) != 1 || !reflect.DeepEqual(command.Deletes[0].Q, want) || command.Deletes[0].Limit != 1 {
+			mt.Errorf("RemoveEntry() deleted %+v, want one entry matching %v", command.Deletes, want)
+		}
+	})
+
+	mt.Run("entry already removed", func(mt *mtest.T) {
+		s := &PlaylistService{DB: mt.DB}
+		mt.AddMockResponses(mtest.CreateSuccessResponse(bson.E{Key: "n", Value: 0}))
+
+		if err := s.RemoveEntry("PLAYLIST-1", "ENTRY-2"); !errors.Is(err, ErrPlaylistEntryNotFound) {
+			mt.Errorf("RemoveEntry() error = %v, want %v", err, ErrPlaylistEntryNotFound)
+		}
+	})
+}
+
+func TestGetPlaylistEntriesFields(t *testing.T) {
+	mt := mtest.New(t, mtest.NewOptions().ClientType(mtest.Mock))
+	mt.Run("second page with only titles", func(mt *mtest.T) {
+		s := &PlaylistService{DB: mt.DB}
+		mt.AddMockResponses(
+			mtest.CreateCursorResponse(0, "db.playlist_songs", mtest.FirstBatch, bson.D{{Key: "n", Value: int32(5)}}),
+			mtest.CreateCursorResponse(0, "db.playlist_songs", mtest.FirstBatch,
+				bson.D{
+					{Key: "entry_id", Value: "ENTRY-3"},
+					{Key: "song_id", Value: "SONG-3"},
+					{Key: "song", Value: bson.D{{Key: "song_id", Value: "SONG-3"}, {Key: "title", Value: "Third"}}},
+				},
+				// Added by someone who no longer has the song
+				bson.D{
+					{Key: "entry_id", Value: "ENTRY-4"},
+					{Key: "song_id", Value: "SONG-4"},
+				},
+			),
+		)
+
+		playlist := &models.Playlist{PlaylistID: "PLAYLIST-1"}
+		entries, total, err := s.GetPlaylistEntries(playlist, []string{"title"}, 2, 2)
+		if err != nil {
+			mt.Fatalf("GetPlaylistEntries() error = %v", err)
+		}
+		if total != 5 {
+			mt.Errorf("GetPlaylistEntries() total = %d, want 5", total)
+		}
+		if len(entries) != 2 {
+			mt.Fatalf("GetPlaylistEntries() returned %d entries, want 2", len(entries))
+		}
+		if entries[0].Position != 3 || entries[0].Song == nil || entries[0].Song.Title != "Third" || entries[0].Unavailable {
+			mt.Errorf("first entry = %+v, want position 3 with its title", entries[0])
+		}
+		if entries[1].Position != 4 || entries[1].Song != nil || !entries[1].Unavailable {
+			mt.Errorf("second entry = %+v, want position 4 and unavailable", entries[1])
+		}
+
+		mt.GetStartedEvent() // the count
+		event := mt.GetStartedEvent()
+		if event == nil || event.CommandName != "aggregate" {
+			mt.Fatalf("GetPlaylistEntries() didn't aggregate")
+		}
+		var command struct {
+			Pipeline []bson.M `bson:"pipeline"`
+		}
+		if err := bson.Unmarshal(event.Command, &command); err != nil {
+			mt.Fatal(err)
+		}
+		var skip, limit interface{}
+		var project interface{}
+		for _, stage := range command.Pipeline {
+			if v, ok := stage["$skip"]; ok {
+				skip = v
+			}
+			if v, ok := stage["$limit"]; ok {
+				limit = v
+			}
+			if lookup, ok := stage["$lookup"].(bson.M); ok {
+				for _, inner := range lookup["pipeline"].(bson.A) {
+					if v, ok := inner.(bson.M)["$project"]; ok {
+						project = v
+					}
+				}
+			}
+		}
+		if skip != int64(2) || limit != int64(2) {
+			mt.Errorf("pipeline skips %v and limits %v, want 2 and 2", skip, limit)
+		}
+		if want := (bson.M{"song_id": int32(1), "title": int32(1)}); !reflect.DeepEqual(project, want) {
+			mt.Errorf("songs projected to %v, want %v", project, want)
+		}
+	})
+}
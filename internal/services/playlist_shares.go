@@ -0,0 +1,143 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/utils"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// ErrShareNotFound is returned for unknown or revoked share tokens, and for
+// tokens of playlists that were made private.
+var ErrShareNotFound = errors.New("share not found")
+
+// CreateShare creates a new share link token for the playlist.
+func (s *PlaylistService) CreateShare(playlistID string, createdBy string) (*models.PlaylistShare, error) {
+	collection := s.DB.Collection("playlist_shares")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	token, err := utils.GenerateToken()
+	if err != nil {
+		return nil, err
+	}
+	share := models.PlaylistShare{
+		Token:      token,
+		PlaylistID: playlistID,
+		CreatedBy:  createdBy,
+		CreatedAt:  time.Now(),
+	}
+	if _, err := collection.InsertOne(ctx, share); err != nil {
+		return nil, err
+	}
+	return &share, nil
+}
+
+func (s *PlaylistService) GetShares(playlistID string) ([]models.PlaylistShare, error) {
+	collection := s.DB.Collection("playlist_shares")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"playlist_id": playlistID}, options.Find().SetSort(bson.M{"created_at": 1}))
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var shares []models.PlaylistShare
+	err = cursor.All(ctx, &shares)
+	return shares, err
+}
+
+// RevokeShare deletes a share token, so links with it stop working.
+func (s *PlaylistService) RevokeShare(playlistID string, token string) error {
+	collection := s.DB.Collection("playlist_shares")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	result, err := collection.DeleteOne(ctx, bson.M{"playlist_id": playlistID, "token": token})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return ErrShareNotFound
+	}
+	return nil
+}
+
+// GetSharedPlaylist returns the playlist a share token gives access to.
+func (s *PlaylistService) GetSharedPlaylist(token string) (*models.Playlist, error) {
+	collection := s.DB.Collection("playlist_shares")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var share models.PlaylistShare
+	err := collection.FindOne(ctx, bson.M{"token": token}).Decode(&share)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	playlist, err := s.GetPlaylistByID(share.PlaylistID)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return nil, ErrShareNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if playlist.Visibility != models.PlaylistUnlisted && playlist.Visibility != models.PlaylistPublic {
+		return nil, ErrShareNotFound
+	}
+	return playlist, nil
+}
+
+// HasSong reports whether the song is available in the playlist, added by
+// its owner.
+func (s *PlaylistService) HasSong(playlist *models.Playlist, songID string, ownerID string) (bool, error) {
+	collection := s.DB.Collection("playlist_songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if playlist.Smart != nil {
+		if ownerID != playlist.UserID {
+			return false, nil
+		}
+		songIDs, err := s.cachedSmartSongs(ctx, playlist)
+		if err != nil {
+			return false, err
+		}
+		return songIDs[songID], nil
+	}
+
+	count, err := collection.CountDocuments(ctx, bson.M{
+		"playlist_id": playlist.PlaylistID,
+		"song_id":     songID,
+		"added_by":    ownerID,
+		"unavailable": bson.M{"$ne": true},
+	}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
+func (s *PlaylistService) ensureShareIndexes(ctx context.Context) error {
+	collection := s.DB.Collection("playlist_shares")
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "token", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "playlist_id", Value: 1}},
+	})
+	return err
+}
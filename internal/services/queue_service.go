@@ -0,0 +1,294 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// MaxQueueLength is the most songs a play queue may hold.
+const MaxQueueLength = 1000
+
+var (
+	ErrQueueConflict = errors.New("queue was changed by another device")
+	ErrQueueTooLong  = errors.New("queue is too long")
+	ErrQueueIndex    = errors.New("queue index out of range")
+)
+
+type QueueService struct {
+	DB *mongo.Database
+}
+
+// GetQueue returns the user's queue, or an empty one if they have none yet.
+func (s *QueueService) GetQueue(userID string) (*models.PlayQueue, error) {
+	collection := s.DB.Collection("play_queues")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var queue models.PlayQueue
+	err := collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&queue)
+	if err == mongo.ErrNoDocuments {
+		return &models.PlayQueue{UserID: userID, SongIDs: []string{}, CurrentIndex: -1, Repeat: models.RepeatOff}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &queue, nil
+}
+
+// UpdateQueue applies change to the user's queue and saves it. Devices
+// update the queue concurrently, so the write only succeeds if nobody else
+// saved in between; on a conflict the change is retried on fresh state.
+func (s *QueueService) UpdateQueue(userID string, change func(q *models.PlayQueue) error) (*models.PlayQueue, error) {
+	for attempt := 0; attempt < 3; attempt++ {
+		queue, err := s.GetQueue(userID)
+		if err != nil {
+			return nil, err
+		}
+		if err := change(queue); err != nil {
+			return nil, err
+		}
+		err = s.saveQueue(queue)
+		if err == ErrQueueConflict {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return queue, nil
+	}
+	return nil, ErrQueueConflict
+}
+
+func (s *QueueService) saveQueue(queue *models.PlayQueue) error {
+	collection := s.DB.Collection("play_queues")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	previous := queue.Version
+	queue.Version++
+	queue.UpdatedAt = time.Now()
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"user_id": queue.UserID, "version": previous},
+		bson.M{"$set": bson.M{
+			"song_ids":            queue.SongIDs,
+			"current_index":       queue.CurrentIndex,
+			"position_ms":         queue.PositionMs,
+			"is_playing":          queue.IsPlaying,
+			"shuffle":             queue.Shuffle,
+			"shuffle_order":       queue.ShuffleOrder,
+			"repeat":              queue.Repeat,
+			"active_device":       queue.ActiveDevice,
+			"context_playlist_id": queue.ContextPlaylistID,
+			"version":             queue.Version,
+			"updated_at":          queue.UpdatedAt,
+		}},
+		options.Update().SetUpsert(true),
+	)
+	// With a newer version stored the filter misses and the upsert collides
+	// with the unique user_id index
+	if mongo.IsDuplicateKeyError(err) {
+		return ErrQueueConflict
+	}
+	return err
+}
+
+func (s *QueueService) EnsureIndexes() error {
+	collection := s.DB.Collection("play_queues")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "user_id", Value: 1}},
+		Options: options.Index().SetUnique(true),
+	})
+	return err
+}
+
+// ReplaceQueue starts playing songIDs from startIndex.
+func ReplaceQueue(q *models.PlayQueue, songIDs []string, startIndex int, playlistID string) error {
+	if len(songIDs) > MaxQueueLength {
+		return ErrQueueTooLong
+	}
+	if len(songIDs) > 0 && (startIndex < 0 || startIndex >= len(songIDs)) {
+		return ErrQueueIndex
+	}
+	q.SongIDs = songIDs
+	q.ContextPlaylistID = playlistID
+	q.CurrentIndex = -1
+	q.PositionMs = 0
+	q.IsPlaying = false
+	if len(songIDs) > 0 {
+		q.CurrentIndex = startIndex
+		q.IsPlaying = true
+	}
+	if q.Shuffle {
+		reshuffle(q)
+	}
+	return nil
+}
+
+// AddToQueue appends songIDs, or inserts them after the current song when
+// next is set.
+func AddToQueue(q *models.PlayQueue, songIDs []string, next bool) error {
+	if len(q.SongIDs)+len(songIDs) > MaxQueueLength {
+		return ErrQueueTooLong
+	}
+	at := len(q.SongIDs)
+	if next && q.CurrentIndex >= 0 {
+		at = q.CurrentIndex + 1
+	}
+
+	songs := make([]string, 0, len(q.SongIDs)+len(songIDs))
+	songs = append(songs, q.SongIDs[:at]...)
+	songs = append(songs, songIDs...)
+	songs = append(songs, q.SongIDs[at:]...)
+	q.SongIDs = songs
+	if q.CurrentIndex < 0 {
+		q.CurrentIndex = 0
+	}
+
+	if q.Shuffle {
+		// Keep the existing order, shifting indexes past the insertion point,
+		// and play the new songs right after the current one when next is set
+		order := make([]int, 0, len(q.SongIDs))
+		added := make([]int, len(songIDs))
+		for i := range added {
+			added[i] = at + i
+		}
+		for _, i := range q.ShuffleOrder {
+			if i >= at {
+				i += len(songIDs)
+			}
+			order = append(order, i)
+			if next && i == q.CurrentIndex {
+				order = append(order, added...)
+			}
+		}
+		if !next || len(order) < len(q.SongIDs) {
+			order = append(order, added...)
+		}
+		q.ShuffleOrder = order
+	}
+	return nil
+}
+
+// RemoveFromQueue removes the song at index.
+func RemoveFromQueue(q *models.PlayQueue, index int) error {
+	if index < 0 || index >= len(q.SongIDs) {
+		return ErrQueueIndex
+	}
+	q.SongIDs = append(q.SongIDs[:index], q.SongIDs[index+1:]...)
+
+	if q.Shuffle {
+		order := make([]int, 0, len(q.SongIDs))
+		for _, i := range q.ShuffleOrder {
+			switch {
+			case i == index:
+				continue
+			case i > index:
+				i--
+			}
+			order = append(order, i)
+		}
+		q.ShuffleOrder = order
+	}
+
+	switch {
+	case len(q.SongIDs) == 0:
+		q.CurrentIndex = -1
+		q.PositionMs = 0
+		q.IsPlaying = false
+	case index < q.CurrentIndex:
+		q.CurrentIndex--
+	case index == q.CurrentIndex:
+		// The following song takes the removed one's place
+		q.PositionMs = 0
+		if q.CurrentIndex >= len(q.SongIDs) {
+			q.CurrentIndex = len(q.SongIDs) - 1
+		}
+	}
+	return nil
+}
+
+// ClearQueue empties the queue but keeps shuffle and repeat settings.
+func ClearQueue(q *models.PlayQueue) {
+	q.SongIDs = []string{}
+	q.ShuffleOrder = nil
+	q.CurrentIndex = -1
+	q.PositionMs = 0
+	q.IsPlaying = false
+	q.ContextPlaylistID = ""
+}
+
+// SkipQueue moves by delta songs (1 for next, -1 for previous) in play
+// order, wrapping when repeating the whole queue. Skipping past the end
+// otherwise stops playback.
+func SkipQueue(q *models.PlayQueue, delta int) {
+	if len(q.SongIDs) == 0 {
+		return
+	}
+	order := playOrder(q)
+	pos := 0
+	for i, index := range order {
+		if index == q.CurrentIndex {
+			pos = i
+			break
+		}
+	}
+
+	pos += delta
+	switch {
+	case pos >= len(order) && q.Repeat == models.RepeatAll:
+		pos = 0
+	case pos < 0 && q.Repeat == models.RepeatAll:
+		pos = len(order) - 1
+	case pos >= len(order):
+		pos = len(order) - 1
+		q.IsPlaying = false
+	case pos < 0:
+		pos = 0
+	}
+	q.CurrentIndex = order[pos]
+	q.PositionMs = 0
+}
+
+// SetShuffle turns shuffling on or off. Turning it on shuffles the songs
+// after the current one.
+func SetShuffle(q *models.PlayQueue, shuffle bool) {
+	q.Shuffle = shuffle
+	if shuffle {
+		reshuffle(q)
+	} else {
+		q.ShuffleOrder = nil
+	}
+}
+
+func reshuffle(q *models.PlayQueue) {
+	order := rand.Perm(len(q.SongIDs))
+	for i, index := range order {
+		if index == q.CurrentIndex {
+			order[0], order[i] = order[i], order[0]
+			break
+		}
+	}
+	q.ShuffleOrder = order
+}
+
+func playOrder(q *models.PlayQueue) []int {
+	if q.Shuffle && len(q.ShuffleOrder) == len(q.SongIDs) {
+		return q.ShuffleOrder
+	}
+	order := make([]int, len(q.SongIDs))
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
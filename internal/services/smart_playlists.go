@@ -0,0 +1,354 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// MaxSmartPlaylistSongs caps how many songs a smart playlist evaluates to.
+const MaxSmartPlaylistSongs = 1000
+
+var ErrSmartRules = errors.New("invalid smart playlist rules")
+
+// Kinds of smart rule fields, which decide the operators they take.
+const (
+	smartText   = "text"
+	smartNumber = "number"
+	smartDate   = "date"
+)
+
+type smartField struct {
+	kind string
+	path string // in the song document, after the listening lookup
+	// listening fields come from play rollups rather than the song
+	listening bool
+}
+
+var smartFields = map[string]smartField{
+	"title":       {kind: smartText, path: "title"},
+	"artist":      {kind: smartText, path: "artist"},
+	"album":       {kind: smartText, path: "album"},
+	"genre":       {kind: smartText, path: "genre"},
+	"duration":    {kind: smartNumber, path: "duration"}, // seconds
+	"added":       {kind: smartDate, path: "created_at"},
+	"plays":       {kind: smartNumber, path: "plays", listening: true},
+	"last_played": {kind: smartDate, path: "last_played", listening: true},
+}
+
+var smartOperators = map[string][]string{
+	smartText:   {"is", "is_not", "contains", "not_contains", "starts_with"},
+	smartNumber: {"is", "is_not", "gt", "lt"},
+	// Values are a number of days
+	smartDate: {"in_last", "not_in_last"},
+}
+
+// ValidateSmartRules checks rules and fills in their defaults.
+func ValidateSmartRules(rules *models.SmartRules) error {
+	if rules.Match == "" {
+		rules.Match = "all"
+	}
+	if rules.Sort == "" {
+		rules.Sort = "title"
+	}
+	if rules.Limit <= 0 || rules.Limit > MaxSmartPlaylistSongs {
+		rules.Limit = MaxSmartPlaylistSongs
+	}
+	if rules.Match != "all" && rules.Match != "any" {
+		return fmt.Errorf("%w: match must be all or any", ErrSmartRules)
+	}
+	if _, ok := smartFields[strings.TrimPrefix(rules.Sort, "-")]; !ok {
+		return fmt.Errorf("%w: unknown sort field %q", ErrSmartRules, rules.Sort)
+	}
+	_, _, err := smartFilter(rules, time.Now())
+	return err
+}
+
+// smartFilter compiles rules into a filter on songs, and reports whether
+// the filter or sort needs the listening fields.
+func smartFilter(rules *models.SmartRules, now time.Time) (bson.M, bool, error) {
+	listening := smartFields[strings.TrimPrefix(rules.Sort, "-")].listening
+	conditions := make(bson.A, 0, len(rules.Rules))
+	for _, rule := range rules.Rules {
+		field, ok := smartFields[rule.Field]
+		if !ok {
+			return nil, false, fmt.Errorf("%w: unknown field %q", ErrSmartRules, rule.Field)
+		}
+		condition, err := smartCondition(field, rule, now)
+		if err != nil {
+			return nil, false, err
+		}
+		conditions = append(conditions, condition)
+		listening = listening || field.listening
+	}
+
+	switch {
+	case len(conditions) == 0:
+		return bson.M{}, listening, nil
+	case rules.Match == "any":
+		return bson.M{"$or": conditions}, listening, nil
+	default:
+		return bson.M{"$and": conditions}, listening, nil
+	}
+}
+
+func smartCondition(field smartField, rule models.SmartRule, now time.Time) (bson.M, error) {
+	valid := false
+	for _, operator := range smartOperators[field.kind] {
+		valid = valid || operator == rule.Operator
+	}
+	if !valid {
+		return nil, fmt.Errorf("%w: %s doesn't take operator %q", ErrSmartRules, rule.Field, rule.Operator)
+	}
+
+	switch field.kind {
+	case smartText:
+		pattern := regexp.QuoteMeta(rule.Value)
+		switch rule.Operator {
+		case "is", "is_not":
+			pattern = "^" + pattern + "$"
+		case "starts_with":
+			pattern = "^" + pattern
+		}
+		regex := bson.M{"$regex": pattern, "$options": "i"}
+		if rule.Operator == "is_not" || rule.Operator == "not_contains" {
+			return bson.M{field.path: bson.M{"$not": regex}}, nil
+		}
+		return bson.M{field.path: regex}, nil
+
+	case smartNumber:
+		value, err := strconv.ParseFloat(rule.Value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s needs a number", ErrSmartRules, rule.Field)
+		}
+		operators := map[string]string{"is": "$eq", "is_not": "$ne", "gt": "$gt", "lt": "$lt"}
+		return bson.M{field.path: bson.M{operators[rule.Operator]: value}}, nil
+
+	default:
+		days, err := strconv.Atoi(rule.Value)
+		if err != nil || days <= 0 {
+			return nil, fmt.Errorf("%w: %s needs a number of days", ErrSmartRules, rule.Field)
+		}
+		since := now.AddDate(0, 0, -days)
+		var cutoff interface{} = since
+		if rule.Field == "last_played" {
+			// Rollups only know the day of a listen
+			cutoff = since.UTC().Format(RollupDayFormat)
+		}
+		// Songs never played have no last_played, so they count as not
+		// played in the last days
+		if rule.Operator == "not_in_last" {
+			return bson.M{field.path: bson.M{"$not": bson.M{"$gte": cutoff}}}, nil
+		}
+		return bson.M{field.path: bson.M{"$gte": cutoff}}, nil
+	}
+}
+
+// smartPipeline returns the stages that select and order the songs of a
+// smart playlist.
+func smartPipeline(playlist *models.Playlist) (mongo.Pipeline, error) {
+	rules := playlist.Smart
+	filter, listening, err := smartFilter(rules, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: bson.M{"user_id": playlist.UserID}}},
+	}
+	if listening {
+		pipeline = append(pipeline,
+			bson.D{{Key: "$lookup", Value: bson.M{
+				"from": "play_rollups",
+				"let":  bson.M{"song_id": "$song_id"},
+				"pipeline": bson.A{
+					bson.M{"$match": bson.M{
+						"user_id": playlist.UserID,
+						"$expr":   bson.M{"$eq": bson.A{"$song_id", "$$song_id"}},
+					}},
+					bson.M{"$group": bson.M{
+						"_id":         nil,
+						"plays":       bson.M{"$sum": "$plays"},
+						"last_played": bson.M{"$max": "$day"},
+					}},
+				},
+				"as": "listening",
+			}}},
+			bson.D{{Key: "$addFields", Value: bson.M{
+				"plays":       bson.M{"$ifNull": bson.A{bson.M{"$arrayElemAt": bson.A{"$listening.plays", 0}}, 0}},
+				"last_played": bson.M{"$arrayElemAt": bson.A{"$listening.last_played", 0}},
+			}}},
+		)
+	}
+
+	direction := 1
+	sortField := rules.Sort
+	if strings.HasPrefix(sortField, "-") {
+		direction = -1
+		sortField = sortField[1:]
+	}
+	limit := rules.Limit
+	if limit <= 0 || limit > MaxSmartPlaylistSongs {
+		limit = MaxSmartPlaylistSongs
+	}
+	return append(pipeline,
+		bson.D{{Key: "$match", Value: filter}},
+		bson.D{{Key: "$sort", Value: bson.D{{Key: smartFields[sortField].path, Value: direction}, {Key: "_id", Value: 1}}}},
+		bson.D{{Key: "$limit", Value: int64(limit)}},
+	), nil
+}
+
+// smartEntries evaluates a smart playlist and returns a page of its songs
+// as entries, and the total number of songs. Smart entries have no entry
+// ID since they aren't stored.
+func (s *PlaylistService) smartEntries(ctx context.Context, playlist *models.Playlist, songFields []string, page int, limit int) ([]models.PlaylistEntry, int64, error) {
+	pipeline, err := smartPipeline(playlist)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	projection := bson.M{"song_id": 1, "created_at": 1}
+	for _, field := range songFields {
+		projection[field] = 1
+	}
+	skip := (page - 1) * limit
+	pipeline = append(pipeline, bson.D{{Key: "$facet", Value: bson.M{
+		"total": bson.A{bson.M{"$count": "count"}},
+		"songs": bson.A{
+			bson.M{"$skip": int64(skip)},
+			bson.M{"$limit": int64(limit)},
+			bson.M{"$project": projection},
+		},
+	}}})
+
+	cursor, err := s.DB.Collection("songs").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []struct {
+		Total []struct {
+			Count int64 `bson:"count"`
+		} `bson:"total"`
+		Songs []models.Song `bson:"songs"`
+	}
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, 0, err
+	}
+	if len(result) == 0 || len(result[0].Total) == 0 {
+		return []models.PlaylistEntry{}, 0, nil
+	}
+
+	songs := result[0].Songs
+	entries := make([]models.PlaylistEntry, 0, len(songs))
+	for i := range songs {
+		entries = append(entries, models.PlaylistEntry{
+			PlaylistSong: smartEntry(playlist, &songs[i], skip+i+1),
+			Song:         &songs[i],
+		})
+	}
+	return entries, result[0].Total[0].Count, nil
+}
+
+// smartSongs evaluates a smart playlist into entries, without songs.
+func (s *PlaylistService) smartSongs(ctx context.Context, playlist *models.Playlist) ([]models.PlaylistSong, error) {
+	pipeline, err := smartPipeline(playlist)
+	if err != nil {
+		return nil, err
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$project", Value: bson.M{"song_id": 1, "created_at": 1}}})
+
+	cursor, err := s.DB.Collection("songs").Aggregate(ctx, pipeline)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []models.Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		return nil, err
+	}
+	entries := make([]models.PlaylistSong, 0, len(songs))
+	for i := range songs {
+		entries = append(entries, smartEntry(playlist, &songs[i], i+1))
+	}
+	return entries, nil
+}
+
+// smartSongsTTL is how long HasSong trusts an evaluation of a smart
+// playlist. Players fetch a song in many range requests, which shouldn't
+// each evaluate the rules again.
+const smartSongsTTL = time.Minute
+
+// maxSmartSongsCache caps how many smart playlist evaluations are cached.
+const maxSmartSongsCache = 256
+
+type smartSongSet struct {
+	updatedAt time.Time
+	expires   time.Time
+	songIDs   map[string]bool
+}
+
+// cachedSmartSongs returns the song IDs a smart playlist evaluates to,
+// reusing an evaluation made in the last smartSongsTTL unless the playlist
+// changed since.
+func (s *PlaylistService) cachedSmartSongs(ctx context.Context, playlist *models.Playlist) (map[string]bool, error) {
+	now := time.Now()
+	s.smartSongsMu.Lock()
+	cached, ok := s.smartSongsCache[playlist.PlaylistID]
+	s.smartSongsMu.Unlock()
+	if ok && now.Before(cached.expires) && cached.updatedAt.Equal(playlist.UpdatedAt) {
+		return cached.songIDs, nil
+	}
+
+	entries, err := s.smartSongs(ctx, playlist)
+	if err != nil {
+		return nil, err
+	}
+	songIDs := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		songIDs[entry.SongID] = true
+	}
+
+	s.smartSongsMu.Lock()
+	defer s.smartSongsMu.Unlock()
+	if s.smartSongsCache == nil {
+		s.smartSongsCache = make(map[string]smartSongSet)
+	}
+	if len(s.smartSongsCache) >= maxSmartSongsCache {
+		for id, set := range s.smartSongsCache {
+			if !now.Before(set.expires) {
+				delete(s.smartSongsCache, id)
+			}
+		}
+		if len(s.smartSongsCache) >= maxSmartSongsCache {
+			s.smartSongsCache = make(map[string]smartSongSet)
+		}
+	}
+	s.smartSongsCache[playlist.PlaylistID] = smartSongSet{
+		updatedAt: playlist.UpdatedAt,
+		expires:   now.Add(smartSongsTTL),
+		songIDs:   songIDs,
+	}
+	return songIDs, nil
+}
+
+func smartEntry(playlist *models.Playlist, song *models.Song, position int) models.PlaylistSong {
+	return models.PlaylistSong{
+		PlaylistID: playlist.PlaylistID,
+		SongID:     song.SongID,
+		Position:   position,
+		AddedBy:    playlist.UserID,
+		AddedAt:    song.CreatedAt,
+	}
+}
@@ -2,16 +2,26 @@ package services
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math"
+	"os"
 	"time"
 
+	"projectpi-backend/internal/audio"
 	"projectpi-backend/internal/models"
+	"projectpi-backend/internal/storage"
 
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 type SongService struct {
 	DB *mongo.Database
+
+	transactions transactionSupport
 }
 
 func (s *SongService) CreateSong(song *models.Song) error {
@@ -59,10 +69,163 @@ func (s *SongService) DeleteSong(songID string) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
-	_, err := collection.DeleteOne(ctx, bson.M{"song_id": songID})
+	var song models.Song
+	err := collection.FindOneAndDelete(ctx, bson.M{"song_id": songID}).Decode(&song)
+	if err != nil && err != mongo.ErrNoDocuments {
+		return err
+	}
+
+	// Also delete data generated for this song
+	for _, name := range []string{"waveforms", "fingerprints", "playback_positions"} {
+		if _, err := s.DB.Collection(name).DeleteMany(ctx, bson.M{"song_id": songID}); err != nil {
+			return err
+		}
+	}
+
+	// Playlists keep a tombstone where the song was
+	tombstone := bson.M{"unavailable": true}
+	if err == nil {
+		tombstone["deleted"] = models.DeletedSong{Title: song.Title, Artist: song.Artist, Duration: song.Duration}
+	}
+	_, err = s.DB.Collection("playlist_songs").UpdateMany(ctx, bson.M{"song_id": songID}, bson.M{"$set": tombstone})
+	if err != nil {
+		return err
+	}
+	return s.touchPlaylists(ctx, []string{songID})
+}
+
+// touchPlaylists sets the updated time of the playlists with any of the
+// songs, whose entries are being changed, so Last-Modified covers them.
+func (s *SongService) touchPlaylists(ctx context.Context, songIDs []string) error {
+	playlistIDs, err := s.DB.Collection("playlist_songs").Distinct(ctx, "playlist_id", bson.M{"song_id": bson.M{"$in": songIDs}})
+	if err != nil || len(playlistIDs) == 0 {
+		return err
+	}
+	_, err = s.DB.Collection("playlists").UpdateMany(ctx,
+		bson.M{"playlist_id": bson.M{"$in": playlistIDs}},
+		bson.M{"$set": bson.M{"updated_at": time.Now()}})
 	return err
 }
 
+// MergeSongs keeps keepID and deletes the songs in duplicateIDs, repointing
+// everything that refers to them to the kept song: playlist entries, play
+// history and its rollups, play queues and resume positions. On a replica
+// set it all happens in one transaction, so a failed merge changes nothing.
+func (s *SongService) MergeSongs(keepID string, duplicateIDs []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return s.transactions.run(ctx, s.DB, func(ctx context.Context) error {
+		if err := s.touchPlaylists(ctx, duplicateIDs); err != nil {
+			return err
+		}
+		filter := bson.M{"song_id": bson.M{"$in": duplicateIDs}}
+		for _, name := range []string{"playlist_songs", "plays"} {
+			_, err := s.DB.Collection(name).UpdateMany(ctx, filter, bson.M{"$set": bson.M{"song_id": keepID}})
+			if err != nil {
+				return err
+			}
+		}
+		if err := s.mergeRollups(ctx, keepID, duplicateIDs); err != nil {
+			return err
+		}
+		if err := s.mergePositions(ctx, keepID, duplicateIDs); err != nil {
+			return err
+		}
+
+		// Queues change under connected devices, so they get a new version
+		_, err := s.DB.Collection("play_queues").UpdateMany(ctx,
+			bson.M{"song_ids": bson.M{"$in": duplicateIDs}},
+			bson.M{
+				"$set": bson.M{"song_ids.$[id]": keepID, "updated_at": time.Now()},
+				"$inc": bson.M{"version": 1},
+			},
+			options.Update().SetArrayFilters(options.ArrayFilters{
+				Filters: []interface{}{bson.M{"id": bson.M{"$in": duplicateIDs}}},
+			}),
+		)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range []string{"songs", "waveforms", "fingerprints", "playback_positions"} {
+			if _, err := s.DB.Collection(name).DeleteMany(ctx, filter); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// mergeRollups adds the duplicates' play rollups to the kept song's. A day
+// can already have a rollup for the kept song, so they can't just be
+// repointed.
+func (s *SongService) mergeRollups(ctx context.Context, keepID string, duplicateIDs []string) error {
+	collection := s.DB.Collection("play_rollups")
+	cursor, err := collection.Find(ctx, bson.M{"song_id": bson.M{"$in": duplicateIDs}})
+	if err != nil {
+		return err
+	}
+	var rollups []models.PlayRollup
+	if err := cursor.All(ctx, &rollups); err != nil {
+		return err
+	}
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	writes := make([]mongo.WriteModel, 0, 2*len(rollups))
+	for _, r := range rollups {
+		writes = append(writes,
+			mongo.NewUpdateOneModel().
+				SetFilter(bson.M{"user_id": r.UserID, "day": r.Day, "song_id": keepID, "title": r.Title, "artist": r.Artist}).
+				SetUpdate(bson.M{"$inc": bson.M{"plays": r.Plays, "listened_ms": r.ListenedMs}}).
+				SetUpsert(true),
+			mongo.NewDeleteOneModel().SetFilter(bson.M{"_id": r.ID}))
+	}
+	_, err = collection.BulkWrite(ctx, writes)
+	return err
+}
+
+// mergePositions keeps the most recent resume position among the kept song
+// and its duplicates, per user.
+func (s *SongService) mergePositions(ctx context.Context, keepID string, duplicateIDs []string) error {
+	collection := s.DB.Collection("playback_positions")
+	cursor, err := collection.Find(ctx,
+		bson.M{"song_id": bson.M{"$in": append([]string{keepID}, duplicateIDs...)}},
+		options.Find().SetSort(bson.D{{Key: "updated_at", Value: 1}}))
+	if err != nil {
+		return err
+	}
+	var positions []models.PlaybackPosition
+	if err := cursor.All(ctx, &positions); err != nil {
+		return err
+	}
+
+	latest := make(map[string]models.PlaybackPosition)
+	for _, p := range positions {
+		latest[p.UserID] = p
+	}
+	for userID, p := range latest {
+		if p.SongID == keepID {
+			continue
+		}
+		_, err := collection.UpdateOne(ctx,
+			bson.M{"user_id": userID, "song_id": keepID},
+			bson.M{"$set": bson.M{
+				"position_ms": p.PositionMs,
+				"completed":   p.Completed,
+				"device":      p.Device,
+				"updated_at":  p.UpdatedAt,
+			}},
+			options.Update().SetUpsert(true))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *SongService) UpdateSong(songID string, updates bson.M) error {
 	collection := s.DB.Collection("songs")
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -96,3 +259,365 @@ func (s *SongService) SearchSongs(query string, userID string) ([]models.Song, e
 	err = cursor.All(ctx, &songs)
 	return songs, err
 }
+
+func (s *SongService) GetSongsByAlbum(userID string, album string) ([]models.Song, error) {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID, "album": album})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []models.Song
+	err = cursor.All(ctx, &songs)
+	return songs, err
+}
+
+// UpdateAlbumGain recomputes the album gain of every analyzed song in the
+// user's album from the songs' integrated loudness, and clears the album's
+// pending album gain jobs.
+func (s *SongService) UpdateAlbumGain(userID string, album string) error {
+	if album == "" {
+		return nil
+	}
+	songs, err := s.GetSongsByAlbum(userID, album)
+	if err != nil {
+		return err
+	}
+
+	// Album loudness is the energy mean of the track loudness values
+	var energy, peak float64
+	analyzed := 0
+	for _, song := range songs {
+		if song.Loudness == nil {
+			continue
+		}
+		energy += math.Pow(10, song.Loudness.IntegratedLUFS/10)
+		peak = math.Max(peak, song.Loudness.TrackPeak)
+		analyzed++
+	}
+	if analyzed == 0 {
+		// Each song's loudness analysis updates the album again
+		return s.clearAlbumPending(userID, album)
+	}
+	albumLoudness := 10 * math.Log10(energy/float64(analyzed))
+
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "album": album, "loudness": bson.M{"$exists": true}},
+		bson.M{"$set": bson.M{
+			"loudness.album_gain_db": models.ReplayGainReference - albumLoudness,
+			"loudness.album_peak":    peak,
+		}},
+	)
+	if err != nil {
+		return err
+	}
+	_, err = collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "album": album},
+		bson.M{"$pull": bson.M{"pending_jobs": models.JobAlbumGain}},
+	)
+	return err
+}
+
+func (s *SongService) clearAlbumPending(userID string, album string) error {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "album": album},
+		bson.M{"$pull": bson.M{"pending_jobs": models.JobAlbumGain}},
+	)
+	return err
+}
+
+// MarkPending records that job is owed to the song.
+func (s *SongService) MarkPending(songID string, job string) error {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"song_id": songID}, bson.M{"$addToSet": bson.M{"pending_jobs": job}})
+	return err
+}
+
+// MarkAlbumPending records that the album gain of the user's album is owed,
+// on every song of the album.
+func (s *SongService) MarkAlbumPending(userID string, album string) error {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateMany(ctx,
+		bson.M{"user_id": userID, "album": album},
+		bson.M{"$addToSet": bson.M{"pending_jobs": models.JobAlbumGain}},
+	)
+	return err
+}
+
+// ClearPending records that job is done for the song.
+func (s *SongService) ClearPending(songID string, job string) error {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx, bson.M{"song_id": songID}, bson.M{"$pull": bson.M{"pending_jobs": job}})
+	return err
+}
+
+// GetPendingSongs returns the songs that are owed background processing.
+func (s *SongService) GetPendingSongs() ([]models.Song, error) {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"pending_jobs.0": bson.M{"$exists": true}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []models.Song
+	err = cursor.All(ctx, &songs)
+	return songs, err
+}
+
+// MigrateSongProcessing marks songs uploaded before their analysis could be
+// resumed, or whose analysis was dropped, as owed it: loudness when they
+// have none, and a fingerprint when they have none, so they're considered
+// for duplicate detection. The API schedules it when it next starts. It
+// returns the number of jobs marked.
+func (s *SongService) MigrateSongProcessing() (int, error) {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	marked := 0
+	result, err := collection.UpdateMany(ctx,
+		bson.M{"loudness": bson.M{"$exists": false}},
+		bson.M{"$addToSet": bson.M{"pending_jobs": models.JobLoudness}},
+	)
+	if err != nil {
+		return 0, err
+	}
+	marked += int(result.ModifiedCount)
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$lookup", Value: bson.M{
+			"from":         "fingerprints",
+			"localField":   "song_id",
+			"foreignField": "song_id",
+			"as":           "fingerprint",
+		}}},
+		{{Key: "$match", Value: bson.M{"fingerprint": bson.M{"$size": 0}}}},
+		{{Key: "$project", Value: bson.M{"song_id": 1}}},
+	})
+	if err != nil {
+		return marked, err
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var song models.Song
+		if err := cursor.Decode(&song); err != nil {
+			return marked, err
+		}
+		result, err := collection.UpdateOne(ctx,
+			bson.M{"song_id": song.SongID},
+			bson.M{"$addToSet": bson.M{"pending_jobs": models.JobFingerprint}},
+		)
+		if err != nil {
+			return marked, err
+		}
+		marked += int(result.ModifiedCount)
+	}
+	return marked, cursor.Err()
+}
+
+// ResetAlbumGain makes an analyzed song without an album its own album.
+func (s *SongService) ResetAlbumGain(songID string) error {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"song_id": songID, "loudness": bson.M{"$exists": true}},
+		mongo.Pipeline{{{Key: "$set", Value: bson.M{
+			"loudness.album_gain_db": "$loudness.track_gain_db",
+			"loudness.album_peak":    "$loudness.track_peak",
+		}}}},
+	)
+	return err
+}
+
+// MigrateSongFormats detects and stores the format of songs uploaded before
+// formats were recorded. It returns the number of songs updated.
+func (s *SongService) MigrateSongFormats(store *storage.Local) (int, error) {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"$or": []bson.M{
+		{"format": bson.M{"$exists": false}},
+		{"format": ""},
+	}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []models.Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, song := range songs {
+		f, err := store.Open(song.UserID, song.Filename)
+		if err != nil {
+			continue
+		}
+		header := make([]byte, audio.HeaderSize)
+		n, _ := io.ReadFull(f, header)
+		f.Close()
+
+		format, ok := audio.Detect(header[:n])
+		if !ok {
+			continue
+		}
+		_, err = collection.UpdateOne(ctx, bson.M{"song_id": song.SongID}, bson.M{"$set": bson.M{
+			"format":       format.Name,
+			"content_type": format.ContentType,
+		}})
+		if err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// MigrateContentHashes stores the SHA-256 of songs uploaded before content
+// hashes were recorded. It returns the number of songs updated.
+func (s *SongService) MigrateContentHashes(store *storage.Local) (int, error) {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Minute)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"$or": []bson.M{
+		{"content_hash": bson.M{"$exists": false}},
+		{"content_hash": ""},
+	}})
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []models.Song
+	if err := cursor.All(ctx, &songs); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, song := range songs {
+		f, err := store.Open(song.UserID, song.Filename)
+		if err != nil {
+			continue
+		}
+		hash := sha256.New()
+		_, err = io.Copy(hash, f)
+		f.Close()
+		if err != nil {
+			continue
+		}
+
+		// Not an edit, so updated_at is left alone
+		_, err = collection.UpdateOne(ctx, bson.M{"song_id": song.SongID}, bson.M{"$set": bson.M{
+			"content_hash": hex.EncodeToString(hash.Sum(nil)),
+		}})
+		if err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
+}
+
+// GetSongsByIDs returns those of the given songs that belong to userID.
+func (s *SongService) GetSongsByIDs(userID string, songIDs []string) ([]models.Song, error) {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"user_id": userID, "song_id": bson.M{"$in": songIDs}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var songs []models.Song
+	err = cursor.All(ctx, &songs)
+	return songs, err
+}
+
+// FindSongByTitleArtist finds the user's song with the given title and
+// artist, ignoring case and accents. Songs uploaded without an artist tag
+// match on title alone.
+func (s *SongService) FindSongByTitleArtist(userID string, title string, artist string) (*models.Song, error) {
+	collection := s.DB.Collection("songs")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Strength 1 compares base letters only. Sorting by artist descending
+	// prefers a song whose artist matched over one without an artist.
+	opts := options.FindOne().
+		SetCollation(&options.Collation{Locale: "en", Strength: 1}).
+		SetSort(bson.M{"artist": -1})
+	var song models.Song
+	err := collection.FindOne(ctx, bson.M{
+		"user_id": userID,
+		"title":   title,
+		"artist":  bson.M{"$in": []string{artist, ""}},
+	}, opts).Decode(&song)
+	if err != nil {
+		return nil, err
+	}
+	return &song, nil
+}
+
+// MigrateHLSRenditions removes HLS renditions packaged into the users' song
+// directories before they got a directory of their own. They are packaged
+// again on the next request. It returns the number of directories removed.
+func (s *SongService) MigrateHLSRenditions(store *storage.Local) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	userIDs, err := s.DB.Collection("songs").Distinct(ctx, "user_id", bson.M{})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, userID := range userIDs {
+		id, ok := userID.(string)
+		if !ok {
+			continue
+		}
+		// A song uploaded as "hls" is a file, not renditions
+		if info, err := os.Stat(store.Path(id, "hls")); err != nil || !info.IsDir() {
+			continue
+		}
+		if err := store.RemoveAll(id, "hls"); err != nil {
+			return removed, err
+		}
+		removed++
+	}
+	return removed, nil
+}
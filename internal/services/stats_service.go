@@ -0,0 +1,274 @@
+package services
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// StatsService aggregates listening statistics from the daily play rollups
+// kept by PlayService.
+type StatsService struct {
+	DB *mongo.Database
+}
+
+// rollupFacets are the $facet stages shared by stats and wrapped.
+type rollupFacets struct {
+	Totals []struct {
+		Plays      int64 `bson:"plays"`
+		ListenedMs int64 `bson:"listened_ms"`
+	} `bson:"totals"`
+	TopSongs   []models.SongStat   `bson:"top_songs"`
+	TopArtists []models.ArtistStat `bson:"top_artists"`
+	Days       []models.PeriodStat `bson:"days"`
+	Months     []models.PeriodStat `bson:"months"`
+	Songs      []struct {
+		Count int `bson:"count"`
+	} `bson:"songs"`
+	Artists []struct {
+		Count int `bson:"count"`
+	} `bson:"artists"`
+}
+
+// songKey groups rollups by song, or by title and artist for scrobbles that
+// matched no song.
+var songKey = bson.M{"$cond": bson.A{
+	bson.M{"$eq": bson.A{"$song_id", ""}},
+	bson.M{"title": "$title", "artist": "$artist"},
+	"$song_id",
+}}
+
+func periodFacet(period interface{}) bson.A {
+	return bson.A{
+		bson.M{"$group": bson.M{
+			"_id":         period,
+			"plays":       bson.M{"$sum": "$plays"},
+			"listened_ms": bson.M{"$sum": "$listened_ms"},
+		}},
+		bson.M{"$sort": bson.M{"_id": 1}},
+	}
+}
+
+func (s *StatsService) aggregateRollups(match bson.M, limit int, wrapped bool) (*rollupFacets, error) {
+	collection := s.DB.Collection("play_rollups")
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	facets := bson.M{
+		"totals": bson.A{
+			bson.M{"$group": bson.M{
+				"_id":         nil,
+				"plays":       bson.M{"$sum": "$plays"},
+				"listened_ms": bson.M{"$sum": "$listened_ms"},
+			}},
+		},
+		// Rollups are sorted by day, so $last is a song's latest title
+		"top_songs": bson.A{
+			bson.M{"$group": bson.M{
+				"_id":         songKey,
+				"song_id":     bson.M{"$last": "$song_id"},
+				"title":       bson.M{"$last": "$title"},
+				"artist":      bson.M{"$last": "$artist"},
+				"plays":       bson.M{"$sum": "$plays"},
+				"listened_ms": bson.M{"$sum": "$listened_ms"},
+			}},
+			bson.M{"$sort": bson.D{{Key: "plays", Value: -1}, {Key: "listened_ms", Value: -1}}},
+			bson.M{"$limit": limit},
+		},
+		"top_artists": bson.A{
+			bson.M{"$match": bson.M{"artist": bson.M{"$ne": ""}}},
+			bson.M{"$group": bson.M{
+				"_id":         "$artist",
+				"plays":       bson.M{"$sum": "$plays"},
+				"listened_ms": bson.M{"$sum": "$listened_ms"},
+				"songs":       bson.M{"$addToSet": songKey},
+			}},
+			bson.M{"$set": bson.M{"songs": bson.M{"$size": "$songs"}}},
+			bson.M{"$sort": bson.D{{Key: "plays", Value: -1}, {Key: "listened_ms", Value: -1}}},
+			bson.M{"$limit": limit},
+		},
+		"days": periodFacet("$day"),
+	}
+	if wrapped {
+		facets["months"] = periodFacet(bson.M{"$substrCP": bson.A{"$day", 0, 7}})
+		facets["songs"] = bson.A{
+			bson.M{"$group": bson.M{"_id": songKey}},
+			bson.M{"$count": "count"},
+		}
+		facets["artists"] = bson.A{
+			bson.M{"$match": bson.M{"artist": bson.M{"$ne": ""}}},
+			bson.M{"$group": bson.M{"_id": "$artist"}},
+			bson.M{"$count": "count"},
+		}
+	}
+
+	cursor, err := collection.Aggregate(ctx, mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$sort", Value: bson.M{"day": 1}}},
+		{{Key: "$facet", Value: facets}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var result []rollupFacets
+	if err := cursor.All(ctx, &result); err != nil {
+		return nil, err
+	}
+	if len(result) == 0 {
+		result = append(result, rollupFacets{})
+	}
+	result[0].fillEmpty()
+	return &result[0], nil
+}
+
+// GetStats returns the user's listening stats for the days from through to
+// (YYYY-MM-DD, inclusive), with the top limit songs and artists. An empty
+// from means since the first listen. Streaks cover all listens.
+func (s *StatsService) GetStats(userID string, from string, to string, limit int) (*models.ListeningStats, error) {
+	day := bson.M{"$lte": to}
+	if from != "" {
+		day["$gte"] = from
+	}
+	facets, err := s.aggregateRollups(bson.M{"user_id": userID, "day": day}, limit, false)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &models.ListeningStats{
+		From:       from,
+		To:         to,
+		TopSongs:   facets.TopSongs,
+		TopArtists: facets.TopArtists,
+		Days:       withMinutes(facets.Days),
+	}
+	if len(facets.Totals) > 0 {
+		stats.Plays = facets.Totals[0].Plays
+		stats.Minutes = facets.Totals[0].ListenedMs / 60000
+	}
+
+	days, err := s.listeningDays(userID)
+	if err != nil {
+		return nil, err
+	}
+	stats.CurrentStreak, stats.LongestStreak = streaks(days, time.Now().UTC())
+	return stats, nil
+}
+
+// GetWrapped returns the user's year in review.
+func (s *StatsService) GetWrapped(userID string, year int, limit int) (*models.Wrapped, error) {
+	prefix := strconv.Itoa(year)
+	facets, err := s.aggregateRollups(bson.M{
+		"user_id": userID,
+		"day":     bson.M{"$gte": prefix + "-01-01", "$lte": prefix + "-12-31"},
+	}, limit, true)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := &models.Wrapped{
+		Year:       year,
+		TopSongs:   facets.TopSongs,
+		TopArtists: facets.TopArtists,
+		Months:     withMinutes(facets.Months),
+	}
+	if len(facets.Totals) > 0 {
+		wrapped.Plays = facets.Totals[0].Plays
+		wrapped.Minutes = facets.Totals[0].ListenedMs / 60000
+	}
+	if len(facets.Songs) > 0 {
+		wrapped.DistinctSongs = facets.Songs[0].Count
+	}
+	if len(facets.Artists) > 0 {
+		wrapped.DistinctArtists = facets.Artists[0].Count
+	}
+
+	days := withMinutes(facets.Days)
+	dates := make([]string, 0, len(days))
+	for i, day := range days {
+		dates = append(dates, day.Period)
+		if wrapped.BusiestDay == nil || day.ListenedMs > wrapped.BusiestDay.ListenedMs {
+			wrapped.BusiestDay = &days[i]
+		}
+	}
+	_, wrapped.LongestStreak = streaks(dates, time.Time{})
+	return wrapped, nil
+}
+
+// listeningDays returns the days the user listened to anything, in order.
+func (s *StatsService) listeningDays(userID string) ([]string, error) {
+	collection := s.DB.Collection("play_rollups")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	values, err := collection.Distinct(ctx, "day", bson.M{"user_id": userID, "plays": bson.M{"$gt": 0}})
+	if err != nil {
+		return nil, err
+	}
+	days := make([]string, 0, len(values))
+	for _, value := range values {
+		if day, ok := value.(string); ok {
+			days = append(days, day)
+		}
+	}
+	sort.Strings(days)
+	return days, nil
+}
+
+// streaks returns the current and longest runs of consecutive days in
+// sorted days. The current streak is still alive if its last day is today
+// or yesterday; it is 0 for a zero today.
+func streaks(days []string, today time.Time) (int, int) {
+	longest, run := 0, 0
+	var previous time.Time
+	for _, value := range days {
+		day, err := time.Parse(RollupDayFormat, value)
+		if err != nil {
+			continue
+		}
+		if !previous.IsZero() && day.Sub(previous) == 24*time.Hour {
+			run++
+		} else {
+			run = 1
+		}
+		if run > longest {
+			longest = run
+		}
+		previous = day
+	}
+
+	if today.IsZero() || previous.IsZero() {
+		return 0, longest
+	}
+	today = today.Truncate(24 * time.Hour)
+	if today.Sub(previous) > 24*time.Hour {
+		return 0, longest
+	}
+	return run, longest
+}
+
+func (f *rollupFacets) fillEmpty() {
+	if f.TopSongs == nil {
+		f.TopSongs = []models.SongStat{}
+	}
+	if f.TopArtists == nil {
+		f.TopArtists = []models.ArtistStat{}
+	}
+}
+
+func withMinutes(periods []models.PeriodStat) []models.PeriodStat {
+	if periods == nil {
+		return []models.PeriodStat{}
+	}
+	for i := range periods {
+		periods[i].Minutes = periods[i].ListenedMs / 60000
+	}
+	return periods
+}
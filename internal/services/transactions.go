@@ -0,0 +1,60 @@
+package services
+
+import (
+	"context"
+	"sync"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+// transactionSupport runs writes in a transaction on a replica set or
+// sharded cluster. A standalone server doesn't support transactions, so
+// there they just run. The zero value is ready to use.
+type transactionSupport struct {
+	mu        sync.Mutex
+	checked   bool
+	supported bool
+}
+
+// run runs fn in a transaction when db's server supports them.
+func (t *transactionSupport) run(ctx context.Context, db *mongo.Database, fn func(ctx context.Context) error) error {
+	if !t.check(ctx, db) {
+		return fn(ctx)
+	}
+	session, err := db.Client().StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(sc mongo.SessionContext) (interface{}, error) {
+		return nil, fn(sc)
+	})
+	return err
+}
+
+// check reports whether the server is a replica set member or a mongos
+// router. The answer is kept once the server has given one; servers older
+// than 4.4.2 only know hello as isMaster.
+func (t *transactionSupport) check(ctx context.Context, db *mongo.Database) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.checked {
+		return t.supported
+	}
+
+	var hello bson.M
+	err := db.RunCommand(ctx, bson.M{"hello": 1}).Decode(&hello)
+	if err != nil {
+		err = db.RunCommand(ctx, bson.M{"isMaster": 1}).Decode(&hello)
+	}
+	if err != nil {
+		// Check again next time rather than giving up on transactions
+		return false
+	}
+	_, replicaSet := hello["setName"]
+	t.supported = replicaSet || hello["msg"] == "isdbgrid"
+	t.checked = true
+	return t.supported
+}
@@ -76,3 +76,56 @@ func (s *UserService) AuthenticateUser(email, password string) (*models.User, er
 
 	return &user, nil
 }
+
+func (s *UserService) GetUserByID(userID string) (*models.User, error) {
+	collection := s.DB.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := collection.FindOne(ctx, bson.M{"user_id": userID}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUsersByIDs returns those of the given users that exist.
+func (s *UserService) GetUsersByIDs(userIDs []string) ([]models.User, error) {
+	collection := s.DB.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	cursor, err := collection.Find(ctx, bson.M{"user_id": bson.M{"$in": userIDs}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var users []models.User
+	err = cursor.All(ctx, &users)
+	return users, err
+}
+
+func (s *UserService) GetUserByUsername(username string) (*models.User, error) {
+	collection := s.DB.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var user models.User
+	err := collection.FindOne(ctx, bson.M{"username": username}).Decode(&user)
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+func (s *UserService) UpdateUser(userID string, updates bson.M) error {
+	collection := s.DB.Collection("users")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	updates["updated_at"] = time.Now()
+	_, err := collection.UpdateOne(ctx, bson.M{"user_id": userID}, bson.M{"$set": updates})
+	return err
+}
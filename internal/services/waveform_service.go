@@ -0,0 +1,82 @@
+package services
+
+import (
+	"context"
+	"time"
+
+	"projectpi-backend/internal/models"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+type WaveformService struct {
+	DB *mongo.Database
+}
+
+func (s *WaveformService) GetWaveformBySongID(songID string) (*models.Waveform, error) {
+	collection := s.DB.Collection("waveforms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var waveform models.Waveform
+	err := collection.FindOne(ctx, bson.M{"song_id": songID}).Decode(&waveform)
+	if err != nil {
+		return nil, err
+	}
+	return &waveform, nil
+}
+
+// SetStatus records the processing state of a song's waveform, creating the
+// document if it doesn't exist yet.
+func (s *WaveformService) SetStatus(songID string, userID string, status string, errMsg string) error {
+	collection := s.DB.Collection("waveforms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"song_id": songID},
+		bson.M{
+			"$set":         bson.M{"user_id": userID, "status": status, "error": errMsg, "updated_at": time.Now()},
+			"$setOnInsert": bson.M{"created_at": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+func (s *WaveformService) SaveWaveform(waveform *models.Waveform) error {
+	collection := s.DB.Collection("waveforms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	waveform.UpdatedAt = time.Now()
+	_, err := collection.UpdateOne(ctx,
+		bson.M{"song_id": waveform.SongID},
+		bson.M{
+			"$set": bson.M{
+				"user_id":     waveform.UserID,
+				"status":      waveform.Status,
+				"error":       waveform.Error,
+				"sample_rate": waveform.SampleRate,
+				"levels":      waveform.Levels,
+				"updated_at":  waveform.UpdatedAt,
+			},
+			"$setOnInsert": bson.M{"created_at": time.Now()},
+		},
+		options.Update().SetUpsert(true),
+	)
+	return err
+}
+
+// DeletePending removes the song's waveform if it is still pending, so the
+// next request for it schedules it again.
+func (s *WaveformService) DeletePending(songID string) error {
+	collection := s.DB.Collection("waveforms")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	_, err := collection.DeleteOne(ctx, bson.M{"song_id": songID, "status": models.StatusPending})
+	return err
+}
@@ -0,0 +1,49 @@
+package signing
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSignerVerify(t *testing.T) {
+	signer := &Signer{Key: []byte("test key")}
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+	signature := signer.Sign("SONG-1", "USER-1", future)
+	tampered := "1" + signature[1:]
+	if signature[0] == '1' {
+		tampered = "0" + signature[1:]
+	}
+
+	tests := []struct {
+		name      string
+		signer    *Signer
+		resource  string
+		subject   string
+		expires   int64
+		signature string
+		want      bool
+	}{
+		{"valid", signer, "SONG-1", "USER-1", future, signature, true},
+		{"expired", signer, "SONG-1", "USER-1", past, signer.Sign("SONG-1", "USER-1", past), false},
+		{"expiry extended", signer, "SONG-1", "USER-1", future + 3600, signature, false},
+		{"other resource", signer, "SONG-2", "USER-1", future, signature, false},
+		{"other subject", signer, "SONG-1", "USER-2", future, signature, false},
+		{"share subject", signer, "SONG-1", "share:USER-1", future, signature, false},
+		{"tampered signature", signer, "SONG-1", "USER-1", future, tampered, false},
+		{"truncated signature", signer, "SONG-1", "USER-1", future, signature[:32], false},
+		{"empty signature", signer, "SONG-1", "USER-1", future, "", false},
+		{"other key", &Signer{Key: []byte("other key")}, "SONG-1", "USER-1", future, signature, false},
+		// The fields are joined with newlines, so moving one between them
+		// must not produce the same message
+		{"field boundary moved", signer, "SONG-1\nUSER-1", "", future, signature, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.signer.Verify(tt.resource, tt.subject, tt.expires, tt.signature); got != tt.want {
+				t.Errorf("Verify() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Local stores files on the local disk under Root. Files are addressed by
+// path parts relative to Root, e.g. (userID, filename) for an uploaded song.
+type Local struct {
+	Root string
+}
+
+// ImageParts returns where an image is stored: under its ID rather than its
+// upload name, so two images with the same name don't overwrite each other,
+// and apart from the users' song directories.
+func ImageParts(userID string, imageID string) []string {
+	return []string{"images", userID, imageID}
+}
+
+// HLSParts returns where the HLS renditions of a song, or one of their
+// files, are stored. Like images they are kept out of the users' song
+// directories, where an upload with the same name would collide with them.
+func HLSParts(userID string, songID string, file ...string) []string {
+	return append([]string{"hls", userID, songID}, file...)
+}
+
+// Path returns the on-disk path for the given parts.
+func (l *Local) Path(parts ...string) string {
+	return filepath.Join(append([]string{l.Root}, parts...)...)
+}
+
+// Dir creates (if needed) and returns the directory for the given parts.
+func (l *Local) Dir(parts ...string) (string, error) {
+	dir := l.Path(parts...)
+	return dir, os.MkdirAll(dir, os.ModePerm)
+}
+
+// Save writes r to the given location, creating parent directories. The
+// data is written to a temporary file first so readers never see a partial
+// file.
+func (l *Local) Save(r io.Reader, parts ...string) error {
+	path := l.Path(parts...)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (l *Local) Open(parts ...string) (*os.File, error) {
+	return os.Open(l.Path(parts...))
+}
+
+func (l *Local) Exists(parts ...string) bool {
+	_, err := os.Stat(l.Path(parts...))
+	return err == nil
+}
+
+func (l *Local) Rename(from []string, to []string) error {
+	dst := l.Path(to...)
+	if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(l.Path(from...), dst)
+}
+
+func (l *Local) Remove(parts ...string) error {
+	return os.Remove(l.Path(parts...))
+}
+
+func (l *Local) RemoveAll(parts ...string) error {
+	return os.RemoveAll(l.Path(parts...))
+}
@@ -0,0 +1,160 @@
+package transcode
+
+import (
+	"container/list"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Cache keeps transcoded files on disk and evicts the least recently used
+// ones once their total size exceeds MaxBytes.
+type Cache struct {
+	Dir      string
+	MaxBytes int64
+
+	mu       sync.Mutex
+	size     int64
+	order    *list.List // front is most recently used
+	entries  map[string]*list.Element
+	inflight map[string]*fill
+}
+
+type cacheEntry struct {
+	name string
+	size int64
+}
+
+type fill struct {
+	done chan struct{}
+	err  error
+}
+
+// NewCache creates a cache in dir, picking up files left by a previous run.
+func NewCache(dir string, maxBytes int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	c := &Cache{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		inflight: make(map[string]*fill),
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	type existing struct {
+		name    string
+		size    int64
+		modTime time.Time
+	}
+	var found []existing
+	for _, f := range files {
+		info, err := f.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		if filepath.Ext(f.Name()) == ".tmp" {
+			os.Remove(filepath.Join(dir, f.Name()))
+			continue
+		}
+		found = append(found, existing{f.Name(), info.Size(), info.ModTime()})
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].modTime.After(found[j].modTime) })
+	for _, f := range found {
+		c.entries[f.name] = c.order.PushBack(&cacheEntry{f.name, f.size})
+		c.size += f.size
+	}
+	c.mu.Lock()
+	c.evictLocked()
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Fetch opens the cached file called name, calling create to produce it on
+// a miss. Concurrent fetches of the same name share one call to create. The
+// file is opened while nothing can be evicted, and an evicted file stays
+// readable until the caller closes it.
+func (c *Cache) Fetch(name string, create func(dst string) error) (*os.File, error) {
+	path := filepath.Join(c.Dir, name)
+
+	c.mu.Lock()
+	if el, ok := c.entries[name]; ok {
+		file, err := os.Open(path)
+		if err == nil {
+			c.order.MoveToFront(el)
+			c.mu.Unlock()
+			now := time.Now()
+			os.Chtimes(path, now, now)
+			return file, nil
+		}
+		// Removed behind the cache's back, produce it again
+		c.order.Remove(el)
+		delete(c.entries, name)
+		c.size -= el.Value.(*cacheEntry).size
+	}
+	if f, ok := c.inflight[name]; ok {
+		c.mu.Unlock()
+		<-f.done
+		if f.err != nil {
+			return nil, f.err
+		}
+		return c.Fetch(name, create)
+	}
+	f := &fill{done: make(chan struct{})}
+	c.inflight[name] = f
+	c.mu.Unlock()
+
+	f.err = c.create(path, create)
+
+	var file *os.File
+	c.mu.Lock()
+	delete(c.inflight, name)
+	if f.err == nil {
+		file, f.err = os.Open(path)
+	}
+	if f.err == nil {
+		if info, err := file.Stat(); err == nil {
+			c.entries[name] = c.order.PushFront(&cacheEntry{name, info.Size()})
+			c.size += info.Size()
+			c.evictLocked()
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+
+	if f.err != nil {
+		return nil, f.err
+	}
+	return file, nil
+}
+
+// create writes to a temporary file first so a half-written transcode is
+// never served.
+func (c *Cache) create(path string, create func(dst string) error) error {
+	tmp := path + ".tmp"
+	if err := create(tmp); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// evictLocked removes least recently used files until the cache fits, but
+// always keeps the newest entry so a single oversized file is still served.
+func (c *Cache) evictLocked() {
+	for c.MaxBytes > 0 && c.size > c.MaxBytes && c.order.Len() > 1 {
+		el := c.order.Back()
+		entry := el.Value.(*cacheEntry)
+		c.order.Remove(el)
+		delete(c.entries, entry.name)
+		c.size -= entry.size
+		os.Remove(filepath.Join(c.Dir, entry.name))
+	}
+}
@@ -0,0 +1,50 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+)
+
+// Decoder decodes an audio file to raw signed 16-bit little-endian mono PCM.
+type Decoder interface {
+	DecodePCM(ctx context.Context, src string, sampleRate int) (io.ReadCloser, error)
+}
+
+func (f *FFmpeg) DecodePCM(ctx context.Context, src string, sampleRate int) (io.ReadCloser, error) {
+	cmd := exec.CommandContext(ctx, f.binary(), "-hide_banner", "-loglevel", "error",
+		"-i", src, "-vn", "-ac", "1", "-ar", strconv.Itoa(sampleRate), "-f", "s16le", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	p := &pcmStream{cmd: cmd, stdout: stdout}
+	cmd.Stderr = &p.stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// pcmStream reports ffmpeg's exit status when the stream is closed.
+type pcmStream struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+}
+
+func (p *pcmStream) Read(b []byte) (int, error) {
+	return p.stdout.Read(b)
+}
+
+func (p *pcmStream) Close() error {
+	// Drain so ffmpeg isn't killed by a closed pipe when the reader stopped early
+	io.Copy(io.Discard, p.stdout)
+	if err := p.cmd.Wait(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(p.stderr.Bytes()))
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package transcode
+
+import (
+	"mime"
+	"strconv"
+	"strings"
+)
+
+// Format is an output format the transcoder can produce.
+type Format struct {
+	Name           string
+	ContentType    string
+	Ext            string
+	Codec          string
+	Muxer          string
+	Args           []string
+	DefaultBitrate int
+}
+
+var formats = map[string]Format{
+	"opus": {Name: "opus", ContentType: "audio/ogg; codecs=opus", Ext: ".opus", Codec: "libopus", Muxer: "ogg", DefaultBitrate: 96},
+	"ogg":  {Name: "ogg", ContentType: "audio/ogg", Ext: ".ogg", Codec: "libvorbis", Muxer: "ogg", DefaultBitrate: 128},
+	"aac":  {Name: "aac", ContentType: "audio/mp4", Ext: ".m4a", Codec: "aac", Muxer: "mp4", Args: []string{"-movflags", "+faststart"}, DefaultBitrate: 128},
+	"mp3":  {Name: "mp3", ContentType: "audio/mpeg", Ext: ".mp3", Codec: "libmp3lame", Muxer: "mp3", DefaultBitrate: 128},
+}
+
+// preference is the order formats are offered in when negotiating from
+// client capabilities: best quality per bit first, most compatible last.
+var preference = []string{"opus", "aac", "ogg", "mp3"}
+
+const (
+	MinBitrate = 32
+	MaxBitrate = 320
+)
+
+// LookupFormat returns the output format with the given name.
+func LookupFormat(name string) (Format, bool) {
+	f, ok := formats[strings.ToLower(name)]
+	return f, ok
+}
+
+// Negotiate picks the output format for a request. An explicit format name
+// wins; otherwise ("" or "auto") the formats the client says it supports,
+// then its Accept header are used, and mp3 is the fallback every client
+// can play.
+func Negotiate(requested, accept string, supports []string) (Format, bool) {
+	if requested != "" && requested != "auto" {
+		return LookupFormat(requested)
+	}
+
+	for _, name := range preference {
+		if contains(supports, name) || Accepts(accept, formats[name].ContentType) {
+			return formats[name], true
+		}
+	}
+	return formats["mp3"], true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Accepts reports whether the Accept header explicitly lists contentType
+// (or its bare media type). Wildcards are ignored since browsers send */*
+// whether or not they can play a format.
+func Accepts(accept, contentType string) bool {
+	want, wantParams, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil || mediaType != want {
+			continue
+		}
+		if q, ok := params["q"]; ok {
+			if v, _ := strconv.ParseFloat(q, 64); v <= 0 {
+				continue
+			}
+		}
+		if codecs, ok := wantParams["codecs"]; ok {
+			if got, ok := params["codecs"]; ok && got != codecs {
+				continue
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// ClampBitrate returns bitrate limited to the supported range, or the
+// format's default when bitrate is zero.
+func ClampBitrate(f Format, bitrate int) int {
+	if bitrate <= 0 {
+		return f.DefaultBitrate
+	}
+	if bitrate < MinBitrate {
+		return MinBitrate
+	}
+	if bitrate > MaxBitrate {
+		return MaxBitrate
+	}
+	return bitrate
+}
@@ -0,0 +1,114 @@
+package transcode
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// HLSBitrates are the renditions (kbps) produced for adaptive streaming.
+// Each rendition is written to a directory named after its bitrate, e.g. "128k".
+var HLSBitrates = []int{64, 128, 192}
+
+// HLSMasterPlaylist is the name of the master playlist in a packaged directory.
+const HLSMasterPlaylist = "master.m3u8"
+
+// hlsSegmentSeconds is the target duration of each segment.
+const hlsSegmentSeconds = 6
+
+// Packager segments an audio file into HLS renditions in dir.
+type Packager interface {
+	PackageHLS(ctx context.Context, src, dir string, bitrates []int) error
+}
+
+func (f *FFmpeg) PackageHLS(ctx context.Context, src, dir string, bitrates []int) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-vn", "-map_metadata", "-1"}
+	streamMap := make([]string, len(bitrates))
+	for i, bitrate := range bitrates {
+		args = append(args, "-map", "0:a:0", fmt.Sprintf("-b:a:%d", i), strconv.Itoa(bitrate)+"k")
+		streamMap[i] = fmt.Sprintf("a:%d,name:%dk", i, bitrate)
+	}
+	args = append(args,
+		"-c:a", "aac",
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(dir, "%v", "segment_%03d.ts"),
+		"-master_pl_name", HLSMasterPlaylist,
+		"-var_stream_map", strings.Join(streamMap, " "),
+		filepath.Join(dir, "%v", "index.m3u8"),
+	)
+	return f.run(ctx, args)
+}
+
+// HLS packages songs into HLS renditions on first use.
+type HLS struct {
+	Packager Packager
+
+	mu       sync.Mutex
+	inflight map[string]*fill
+}
+
+// Ensure packages src into dir unless dir already holds a complete package.
+// Packaging happens in a sibling directory that is renamed into place once
+// ffmpeg finishes, so a half-packaged song is never served.
+func (h *HLS) Ensure(src, dir string) error {
+	if _, err := os.Stat(filepath.Join(dir, HLSMasterPlaylist)); err == nil {
+		return nil
+	}
+
+	h.mu.Lock()
+	if h.inflight == nil {
+		h.inflight = make(map[string]*fill)
+	}
+	if f, ok := h.inflight[dir]; ok {
+		h.mu.Unlock()
+		<-f.done
+		return f.err
+	}
+	f := &fill{done: make(chan struct{})}
+	h.inflight[dir] = f
+	h.mu.Unlock()
+
+	f.err = h.pack(src, dir)
+
+	h.mu.Lock()
+	delete(h.inflight, dir)
+	h.mu.Unlock()
+	close(f.done)
+	return f.err
+}
+
+func (h *HLS) pack(src, dir string) error {
+	tmp := dir + ".tmp"
+	os.RemoveAll(tmp)
+	for _, bitrate := range HLSBitrates {
+		if err := os.MkdirAll(filepath.Join(tmp, strconv.Itoa(bitrate)+"k"), os.ModePerm); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+	defer cancel()
+	if err := h.Packager.PackageHLS(ctx, src, tmp, HLSBitrates); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+
+	os.RemoveAll(dir)
+	return os.Rename(tmp, dir)
+}
+
+// HLSRendition reports whether name is one of the rendition directories.
+func HLSRendition(name string) bool {
+	for _, bitrate := range HLSBitrates {
+		if name == strconv.Itoa(bitrate)+"k" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+)
+
+// Loudness is the result of an EBU R128 measurement.
+type Loudness struct {
+	Integrated float64 // LUFS
+	TruePeak   float64 // dBTP
+	Range      float64 // LU
+}
+
+// LoudnessAnalyzer measures the loudness of an audio file.
+type LoudnessAnalyzer interface {
+	AnalyzeLoudness(ctx context.Context, src string) (Loudness, error)
+}
+
+// AnalyzeLoudness runs ffmpeg's loudnorm filter in measurement mode and
+// parses the JSON summary it prints to stderr.
+func (f *FFmpeg) AnalyzeLoudness(ctx context.Context, src string) (Loudness, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.binary(), "-hide_banner", "-nostats", "-i", src, "-vn",
+		"-af", "loudnorm=print_format=json", "-f", "null", "-")
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return Loudness{}, fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	out := stderr.Bytes()
+	start := bytes.LastIndexByte(out, '{')
+	end := bytes.LastIndexByte(out, '}')
+	if start < 0 || end < start {
+		return Loudness{}, errors.New("ffmpeg: no loudnorm summary in output")
+	}
+	var summary struct {
+		InputI   string `json:"input_i"`
+		InputTP  string `json:"input_tp"`
+		InputLRA string `json:"input_lra"`
+	}
+	if err := json.Unmarshal(out[start:end+1], &summary); err != nil {
+		return Loudness{}, err
+	}
+
+	l := Loudness{
+		Integrated: parseLevel(summary.InputI),
+		TruePeak:   parseLevel(summary.InputTP),
+		Range:      parseLevel(summary.InputLRA),
+	}
+	if math.IsInf(l.Integrated, -1) {
+		return Loudness{}, errors.New("track is silent")
+	}
+	return l, nil
+}
+
+// parseLevel parses a loudnorm value, which may be "-inf" for silence.
+func parseLevel(s string) float64 {
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return math.Inf(-1)
+	}
+	return v
+}
@@ -0,0 +1,41 @@
+package transcode
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Pipeline transcodes songs on demand and caches the results.
+type Pipeline struct {
+	Transcoder Transcoder
+	Cache      *Cache
+}
+
+// transcodeTimeout bounds a single transcode. Transcodes are detached from
+// the request so a client hanging up doesn't waste the work for the next one.
+const transcodeTimeout = 10 * time.Minute
+
+// Transcoded opens a transcode of the file at src, producing it if it isn't
+// cached yet; the caller closes the file. id identifies the source (e.g. a
+// song ID), and its size and modification time are part of the cache key
+// so a replaced file is never served stale.
+func (p *Pipeline) Transcoded(id, src string, opts Options) (*os.File, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, err
+	}
+
+	key := fmt.Sprintf("%s|%d|%d|%s|%d|%.2f", id, info.Size(), info.ModTime().UnixNano(), opts.Format.Name, opts.Bitrate, opts.GainDB)
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:16]) + opts.Format.Ext
+
+	return p.Cache.Fetch(name, func(dst string) error {
+		ctx, cancel := context.WithTimeout(context.Background(), transcodeTimeout)
+		defer cancel()
+		return p.Transcoder.Transcode(ctx, src, dst, opts)
+	})
+}
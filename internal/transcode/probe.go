@@ -0,0 +1,101 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// ProbeResult describes an audio file's stream and tags.
+type ProbeResult struct {
+	Duration   float64 // seconds
+	Codec      string
+	SampleRate int
+	Channels   int
+	Bitrate    int // bits per second
+	Tags       map[string]string
+}
+
+// ErrNotAudio is returned by Probe for files ffprobe can't read or that
+// have no audio stream, e.g. video-only MP4s or bare ID3 tags.
+var ErrNotAudio = errors.New("not an audio file")
+
+// Prober reads stream information and tags from an audio file.
+type Prober interface {
+	Probe(ctx context.Context, src string) (ProbeResult, error)
+}
+
+// FFprobe probes by shelling out to an ffprobe binary.
+type FFprobe struct {
+	Binary string
+}
+
+func (f *FFprobe) Probe(ctx context.Context, src string) (ProbeResult, error) {
+	binary := f.Binary
+	if binary == "" {
+		binary = "ffprobe"
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, binary, "-v", "error", "-print_format", "json",
+		"-show_format", "-show_streams", "-select_streams", "a:0", src)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && ctx.Err() == nil {
+			return ProbeResult{}, fmt.Errorf("%w: ffprobe: %s", ErrNotAudio, bytes.TrimSpace(stderr.Bytes()))
+		}
+		return ProbeResult{}, fmt.Errorf("ffprobe: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	var out struct {
+		Streams []struct {
+			CodecName  string            `json:"codec_name"`
+			SampleRate string            `json:"sample_rate"`
+			Channels   int               `json:"channels"`
+			BitRate    string            `json:"bit_rate"`
+			Tags       map[string]string `json:"tags"`
+		} `json:"streams"`
+		Format struct {
+			Duration string            `json:"duration"`
+			BitRate  string            `json:"bit_rate"`
+			Tags     map[string]string `json:"tags"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		return ProbeResult{}, err
+	}
+	if len(out.Streams) == 0 || out.Streams[0].CodecName == "" {
+		return ProbeResult{}, fmt.Errorf("%w: no audio stream in %s", ErrNotAudio, src)
+	}
+
+	stream := out.Streams[0]
+	result := ProbeResult{
+		Codec:    stream.CodecName,
+		Channels: stream.Channels,
+		Tags:     make(map[string]string),
+	}
+	result.Duration, _ = strconv.ParseFloat(out.Format.Duration, 64)
+	result.SampleRate, _ = strconv.Atoi(stream.SampleRate)
+	if result.Bitrate, _ = strconv.Atoi(stream.BitRate); result.Bitrate == 0 {
+		result.Bitrate, _ = strconv.Atoi(out.Format.BitRate)
+	}
+
+	// Ogg formats keep tags on the stream, others on the container. Keys
+	// vary in case between formats (TITLE, title, ...).
+	for _, tags := range []map[string]string{stream.Tags, out.Format.Tags} {
+		for k, v := range tags {
+			k = strings.ToLower(k)
+			if _, ok := result.Tags[k]; !ok && v != "" {
+				result.Tags[k] = v
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,54 @@
+package transcode
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strconv"
+)
+
+// Options describes the rendition a Transcoder should produce.
+type Options struct {
+	Format  Format
+	Bitrate int     // kbps
+	GainDB  float64 // applied before encoding, 0 for none
+}
+
+// Transcoder converts the audio file at src into dst.
+type Transcoder interface {
+	Transcode(ctx context.Context, src, dst string, opts Options) error
+}
+
+// FFmpeg transcodes by shelling out to an ffmpeg binary.
+type FFmpeg struct {
+	Binary string
+}
+
+func (f *FFmpeg) binary() string {
+	if f.Binary == "" {
+		return "ffmpeg"
+	}
+	return f.Binary
+}
+
+func (f *FFmpeg) Transcode(ctx context.Context, src, dst string, opts Options) error {
+	args := []string{"-hide_banner", "-loglevel", "error", "-y", "-i", src, "-vn", "-map_metadata", "-1"}
+	if opts.GainDB != 0 {
+		args = append(args, "-af", fmt.Sprintf("volume=%.2fdB", opts.GainDB))
+	}
+	args = append(args, "-c:a", opts.Format.Codec, "-b:a", strconv.Itoa(opts.Bitrate)+"k")
+	args = append(args, opts.Format.Args...)
+	args = append(args, "-f", opts.Format.Muxer, dst)
+	return f.run(ctx, args)
+}
+
+func (f *FFmpeg) run(ctx context.Context, args []string) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, f.binary(), args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("ffmpeg: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
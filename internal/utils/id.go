@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"time"
 )
@@ -12,3 +14,29 @@ func GenerateUserID(num uint) string {
 func GenerateSongID(num uint) string {
 	return fmt.Sprintf("SONG-%d-%d", num, time.Now().UnixNano())
 }
+
+func GenerateImageID(num uint) string {
+	return fmt.Sprintf("IMAGE-%d-%d", num, time.Now().UnixNano())
+}
+
+func GeneratePlaylistID() string {
+	return fmt.Sprintf("PLAYLIST-%d-%d", time.Now().Unix(), time.Now().UnixNano()%1000000)
+}
+
+func GenerateEntryID(num uint) string {
+	return fmt.Sprintf("ENTRY-%d-%d", num, time.Now().UnixNano())
+}
+
+func GenerateAPIKeyID(num uint) string {
+	return fmt.Sprintf("KEY-%d-%d", num, time.Now().UnixNano())
+}
+
+// GenerateToken returns a random 32 character hex string, the format of
+// Last.fm API keys and secrets.
+func GenerateToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"errors"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"net/http"
+)
+
+var AllowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// DetectImage sniffs the content type of r and, where the format is
+// decodable, its dimensions. r is rewound before returning.
+func DetectImage(r io.ReadSeeker) (string, int, int, error) {
+	header := make([]byte, 512)
+	n, err := io.ReadFull(r, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", 0, 0, err
+	}
+	contentType := http.DetectContentType(header[:n])
+	if !AllowedImageTypes[contentType] {
+		return contentType, 0, 0, errors.New("unsupported image type")
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return "", 0, 0, err
+	}
+	width, height := 0, 0
+	if config, _, err := image.DecodeConfig(r); err == nil {
+		width, height = config.Width, config.Height
+	}
+	_, err = r.Seek(0, io.SeekStart)
+	return contentType, width, height, err
+}
@@ -0,0 +1,53 @@
+package waveform
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// JSON is the audiowaveform JSON representation of Peaks.
+type JSON struct {
+	Version         int    `json:"version"`
+	Channels        int    `json:"channels"`
+	SampleRate      int    `json:"sample_rate"`
+	SamplesPerPixel int    `json:"samples_per_pixel"`
+	Bits            int    `json:"bits"`
+	Length          int    `json:"length"`
+	Data            []int8 `json:"data"`
+}
+
+func (p Peaks) JSON() JSON {
+	data := make([]int8, len(p.Data))
+	for i, b := range p.Data {
+		data[i] = int8(b)
+	}
+	return JSON{
+		Version:         Version,
+		Channels:        1,
+		SampleRate:      p.SampleRate,
+		SamplesPerPixel: p.SamplesPerPixel,
+		Bits:            Bits,
+		Length:          p.Length(),
+		Data:            data,
+	}
+}
+
+// flag8Bit marks 8-bit data in the binary header's flags field.
+const flag8Bit = 1
+
+// WriteBinary writes p in the audiowaveform binary (.dat) format.
+func (p Peaks) WriteBinary(w io.Writer) error {
+	header := []int32{
+		Version,
+		flag8Bit,
+		int32(p.SampleRate),
+		int32(p.SamplesPerPixel),
+		int32(p.Length()),
+		1, // channels
+	}
+	if err := binary.Write(w, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	_, err := w.Write(p.Data)
+	return err
+}
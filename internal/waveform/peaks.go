@@ -0,0 +1,80 @@
+package waveform
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+)
+
+// Version is the audiowaveform data format version produced by this package.
+const Version = 2
+
+// Bits is the sample resolution of the generated peaks.
+const Bits = 8
+
+// Peaks is a downsampled waveform: one (min, max) pair per pixel, each
+// pixel covering SamplesPerPixel input samples. Data holds int8 values
+// stored as bytes, min before max, as in audiowaveform's 8-bit format.
+type Peaks struct {
+	SampleRate      int
+	SamplesPerPixel int
+	Data            []byte
+}
+
+// Length is the number of pixels in p.
+func (p Peaks) Length() int {
+	return len(p.Data) / 2
+}
+
+type level struct {
+	peaks    Peaks
+	min, max int8
+	count    int
+}
+
+func (l *level) flush() {
+	l.peaks.Data = append(l.peaks.Data, byte(l.min), byte(l.max))
+	l.min, l.max, l.count = 127, -128, 0
+}
+
+// Compute reads signed 16-bit little-endian mono PCM from r and returns
+// peaks at each of the given resolutions in a single pass.
+func Compute(r io.Reader, sampleRate int, samplesPerPixel []int) ([]Peaks, error) {
+	levels := make([]*level, len(samplesPerPixel))
+	for i, spp := range samplesPerPixel {
+		levels[i] = &level{peaks: Peaks{SampleRate: sampleRate, SamplesPerPixel: spp}, min: 127, max: -128}
+	}
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	var buf [2]byte
+	for {
+		if _, err := io.ReadFull(br, buf[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			return nil, err
+		}
+		sample := int8(int16(binary.LittleEndian.Uint16(buf[:])) >> 8)
+		for _, l := range levels {
+			if sample < l.min {
+				l.min = sample
+			}
+			if sample > l.max {
+				l.max = sample
+			}
+			l.count++
+			if l.count == l.peaks.SamplesPerPixel {
+				l.flush()
+			}
+		}
+	}
+
+	result := make([]Peaks, len(levels))
+	for i, l := range levels {
+		if l.count > 0 {
+			l.flush()
+		}
+		result[i] = l.peaks
+	}
+	return result, nil
+}